@@ -0,0 +1,427 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	defaultInitialLimit = 20
+	defaultMaxLimit     = 1000
+	defaultBackoff      = 0.9
+	defaultTolerance    = 1.5
+	defaultSmoothing    = 0.2
+	defaultLongWindow   = 600
+	gradientQueueSize   = 4    // Gradient2 headroom added to the limit
+	longRTTDecay        = 0.95 // Gradient2 long RTT pull down when far above short
+)
+
+// LimitAlgorithm is how an adaptive concurrency limit moves.
+type LimitAlgorithm int
+
+const (
+	// LimitFixed never moves: a static limit to compare against.
+	LimitFixed LimitAlgorithm = iota
+	// LimitAIMD adds one while calls succeed and the limit is in use,
+	// and cuts by BackoffRatio on a failure or a call over Timeout.
+	LimitAIMD
+	// LimitVegas estimates the queue from how far RTT is above the
+	// lowest RTT seen and grows or shrinks to keep it small.
+	LimitVegas
+	// LimitGradient2 scales the limit by the ratio of long term to
+	// short term RTT, like Netflix's Gradient2Limit.
+	LimitGradient2
+)
+
+func (a LimitAlgorithm) String() string {
+	switch a {
+	case LimitFixed:
+		return "fixed"
+	case LimitAIMD:
+		return "aimd"
+	case LimitVegas:
+		return "vegas"
+	case LimitGradient2:
+		return "gradient2"
+	}
+
+	return "unknown"
+}
+
+// AdaptiveLimitConf configures an adaptive concurrency limit, on an
+// app's instances (AppConf) or on a caller's calls to an endpoint
+// (RemoteCall).  Calls over the limit fail at once with a 503.
+type AdaptiveLimitConf struct {
+	Algorithm    LimitAlgorithm
+	InitialLimit int          // (0 = 20)
+	MinLimit     int          // (0 = 1)
+	MaxLimit     int          // (0 = 1000)
+	BackoffRatio float64      // AIMD decrease factor (0 = 0.9)
+	Timeout      Milliseconds // AIMD: slower calls count as drops (0 = off)
+	Tolerance    float64      // Gradient2 RTT growth tolerated (0 = 1.5)
+	Smoothing    float64      // Gradient2 weight of each new limit (0 = 0.2)
+	LongWindow   int          // Gradient2 samples in the long RTT average (0 = 600)
+}
+
+// LimitSample is the limit at a point in time.
+type LimitSample struct {
+	Time  Milliseconds
+	Limit int
+}
+
+// LimitSeries is one limiter's limit over the run.
+type LimitSeries struct {
+	Name      string // instance, or caller->endpoint
+	Algorithm LimitAlgorithm
+	Calls     int
+	Rejected  int
+	Samples   []LimitSample
+}
+
+// adaptiveLimiter is one concurrency limit.
+type adaptiveLimiter struct {
+	mu        sync.Mutex
+	conf      *AdaptiveLimitConf
+	limit     float64
+	inFlight  int
+	rttNoLoad float64
+	longRTT   float64
+	samples   int
+
+	calls    int
+	rejected int
+	series   []LimitSample
+}
+
+// newAdaptiveLimiter returns a limiter for the config, or nil for none.
+func newAdaptiveLimiter(conf *AdaptiveLimitConf, now Milliseconds) *adaptiveLimiter {
+	if conf == nil {
+		return nil
+	}
+
+	al := &adaptiveLimiter{conf: conf, limit: initialLimit(conf)}
+	al.series = []LimitSample{{Time: now, Limit: int(al.limit)}}
+
+	return al
+}
+
+// initialLimit is the configured initial limit.
+func initialLimit(conf *AdaptiveLimitConf) float64 {
+	if conf.InitialLimit > 0 {
+		return float64(conf.InitialLimit)
+	}
+
+	return defaultInitialLimit
+}
+
+// clear drops the calls in flight and starts the limit over, as when
+// the container restarts.  The RTT history and counts are kept.
+func (al *adaptiveLimiter) clear(now Milliseconds) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	al.inFlight = 0
+
+	if int(al.limit) != int(initialLimit(al.conf)) {
+		al.limit = initialLimit(al.conf)
+		al.series = append(al.series, LimitSample{Time: now, Limit: int(al.limit)})
+	}
+}
+
+// acquire takes a slot if the call is under the limit.
+func (al *adaptiveLimiter) acquire() bool {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.inFlight >= int(al.limit) {
+		al.rejected++
+
+		return false
+	}
+
+	al.inFlight++
+	al.calls++
+
+	return true
+}
+
+// release frees a slot and moves the limit on the call's RTT.
+func (al *adaptiveLimiter) release(now Milliseconds, rtt float64, drop bool) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	inFlight := al.inFlight
+	al.inFlight = max(al.inFlight-1, 0) // slots held across a restart
+
+	before := int(al.limit)
+	al.limit = al.clamp(al.update(rtt, drop, inFlight))
+
+	if int(al.limit) != before {
+		al.series = append(al.series, LimitSample{Time: now, Limit: int(al.limit)})
+	}
+}
+
+// free gives back a slot without moving the limit, for a call whose
+// RTT says nothing about the endpoint.
+func (al *adaptiveLimiter) free() {
+	al.mu.Lock()
+	al.inFlight = max(al.inFlight-1, 0)
+	al.mu.Unlock()
+}
+
+// clamp keeps a limit within the configured bounds.
+func (al *adaptiveLimiter) clamp(limit float64) float64 {
+	minLimit := max(1, al.conf.MinLimit)
+
+	maxLimit := al.conf.MaxLimit
+	if maxLimit <= 0 {
+		maxLimit = defaultMaxLimit
+	}
+
+	return math.Max(float64(minLimit), math.Min(float64(maxLimit), limit))
+}
+
+// update returns the new limit after a call with the given RTT
+// finished while inFlight calls were running.  Caller holds al.mu.
+func (al *adaptiveLimiter) update(rtt float64, drop bool, inFlight int) float64 {
+	rtt = math.Max(rtt, 1) // the sim's clock ticks in whole ms
+
+	if al.rttNoLoad == 0 || rtt < al.rttNoLoad {
+		al.rttNoLoad = rtt
+	}
+
+	// don't grow a limit that isn't being used
+	appLimited := float64(inFlight)*2 < al.limit
+
+	switch al.conf.Algorithm {
+	case LimitFixed:
+		return al.limit
+	case LimitAIMD:
+		if drop || (al.conf.Timeout > 0 && rtt > float64(al.conf.Timeout)) {
+			backoff := al.conf.BackoffRatio
+			if backoff <= 0 {
+				backoff = defaultBackoff
+			}
+
+			return al.limit * backoff
+		}
+
+		if appLimited {
+			return al.limit
+		}
+
+		return al.limit + 1
+	case LimitVegas:
+		step := math.Max(1, math.Log10(al.limit))
+		if drop {
+			return al.limit - step
+		}
+
+		if appLimited {
+			return al.limit
+		}
+
+		queue := math.Ceil(al.limit * (1 - al.rttNoLoad/rtt))
+		alpha, beta := 3*step, 6*step //nolint:mnd
+
+		switch {
+		case queue <= step:
+			return al.limit + beta
+		case queue < alpha:
+			return al.limit + step
+		case queue > beta:
+			return al.limit - step
+		}
+
+		return al.limit
+	case LimitGradient2:
+		return al.gradient2(rtt, appLimited)
+	}
+
+	return al.limit
+}
+
+// gradient2 is Netflix's Gradient2Limit.  Caller holds al.mu.
+func (al *adaptiveLimiter) gradient2(rtt float64, appLimited bool) float64 {
+	window := al.conf.LongWindow
+	if window <= 0 {
+		window = defaultLongWindow
+	}
+
+	tolerance := al.conf.Tolerance
+	if tolerance <= 0 {
+		tolerance = defaultTolerance
+	}
+
+	smoothing := al.conf.Smoothing
+	if smoothing <= 0 {
+		smoothing = defaultSmoothing
+	}
+
+	// the long RTT is a simple average until the window fills, then
+	// an exponential one
+	al.samples++
+	if al.samples <= window {
+		al.longRTT += (rtt - al.longRTT) / float64(al.samples)
+	} else {
+		al.longRTT += (rtt - al.longRTT) * 2 / float64(window+1)
+	}
+
+	// recover faster once a spike in latency passes
+	if al.longRTT/rtt > 2 { //nolint:mnd
+		al.longRTT *= longRTTDecay
+	}
+
+	if appLimited {
+		return al.limit
+	}
+
+	gradient := math.Max(0.5, math.Min(1, tolerance*al.longRTT/rtt)) //nolint:mnd
+	newLimit := al.limit*gradient + gradientQueueSize
+
+	return al.limit*(1-smoothing) + newLimit*smoothing
+}
+
+// current is the limit now.
+func (al *adaptiveLimiter) current() int {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	return int(al.limit)
+}
+
+// adaptiveAdmit checks the instance's concurrency limit, replying 503
+// if the call is over it.  It returns false if the call was rejected.
+func (n *node) adaptiveAdmit(c *Call) bool {
+	if n.adaptive == nil {
+		return true
+	}
+
+	if !n.adaptive.acquire() {
+		count.IncrSyncSuffix("node_concurrency_limited", n.name)
+		n.sendErrorReply(c, "Concurrency limit")
+		n.releaseLimit(c)
+
+		return false
+	}
+
+	c.adaptiveSince = Milliseconds(n.loop.GetTime())
+
+	return true
+}
+
+// adaptiveRelease frees the call's slot in the instance's limit, once.
+func (n *node) adaptiveRelease(c *Call) {
+	n.adaptiveFree(c, false)
+}
+
+// adaptiveDrop frees the slot of a call the instance then turned away,
+// counting it as a drop.
+func (n *node) adaptiveDrop(c *Call) {
+	n.adaptiveFree(c, true)
+}
+
+// adaptiveFree frees the call's slot, moving the limit on its RTT.
+func (n *node) adaptiveFree(c *Call, drop bool) {
+	if n.adaptive == nil || c.adaptiveSince == 0 {
+		return
+	}
+
+	now := Milliseconds(n.loop.GetTime())
+	since := c.adaptiveSince
+	c.adaptiveSince = 0
+
+	n.adaptive.release(now, float64(now-since), drop)
+	count.MarkDistributionSuffix("concurrency_limit", float64(n.adaptive.current()), n.name)
+}
+
+// callerLimiter returns the caller's limit for an endpoint.
+func (n *node) callerLimiter(rc *RemoteCall) *adaptiveLimiter {
+	n.callerLimitsMu.Lock()
+	defer n.callerLimitsMu.Unlock()
+
+	if n.callerLimits == nil {
+		n.callerLimits = make(map[string]*adaptiveLimiter)
+	}
+
+	al, ok := n.callerLimits[rc.Endpoint]
+	if !ok {
+		al = newAdaptiveLimiter(rc.ConcurrencyLimit, Milliseconds(n.loop.GetTime()))
+		n.callerLimits[rc.Endpoint] = al
+	}
+
+	return al
+}
+
+// callerLimitAllow checks the caller's limit for the endpoint, failing
+// the call with a 503 if it is over.  It returns the reply handler to
+// send the call with, which feeds the RTT back to the limit.
+func (n *node) callerLimitAllow(rc *RemoteCall, c *Call, f handleReply) (handleReply, bool) {
+	al := n.callerLimiter(rc)
+
+	if !al.acquire() {
+		count.IncrSyncSuffix("caller_concurrency_limited", n.name)
+		f(n, &Reply{reqID: c.ReqID, status: http.StatusServiceUnavailable, call: c, local: true})
+
+		return nil, false
+	}
+
+	sentAt := Milliseconds(n.loop.GetTime())
+
+	return func(n *node, r *Reply) {
+		now := Milliseconds(n.loop.GetTime())
+
+		// a call the caller cancelled never finished
+		if r.status == statusClientClosed {
+			al.free()
+		} else {
+			al.release(now, float64(now-sentAt), r.status != 0)
+		}
+
+		f(n, r)
+	}, true
+}
+
+// ConcurrencyLimits returns each adaptive limiter's limit over the run.
+func (l *Loop) ConcurrencyLimits() []LimitSeries {
+	var res []LimitSeries
+
+	add := func(name string, al *adaptiveLimiter) {
+		al.mu.Lock()
+		defer al.mu.Unlock()
+
+		res = append(res, LimitSeries{
+			Name:      name,
+			Algorithm: al.conf.Algorithm,
+			Calls:     al.calls,
+			Rejected:  al.rejected,
+			Samples:   append([]LimitSample(nil), al.series...),
+		})
+	}
+
+	for _, n := range l.nodes {
+		if n.adaptive != nil && n.callCB == nil {
+			add(n.name, n.adaptive)
+		}
+
+		n.callerLimitsMu.Lock()
+
+		for endpoint, al := range n.callerLimits {
+			add(n.name+"->"+endpoint, al)
+		}
+
+		n.callerLimitsMu.Unlock()
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res
+}
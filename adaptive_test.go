@@ -0,0 +1,182 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+)
+
+// driveLimiter fills the limiter then releases every call with the
+// given RTT, n times.
+func driveLimiter(al *adaptiveLimiter, n int, rtt float64, drop bool) {
+	for range n {
+		for al.acquire() {
+		}
+
+		for al.inFlight > 0 {
+			al.release(0, rtt, drop)
+		}
+	}
+}
+
+// TestLimitAlgorithms checks each algorithm grows at steady low
+// latency and shrinks when latency or failures rise.
+func TestLimitAlgorithms(t *testing.T) {
+	for _, alg := range []LimitAlgorithm{LimitAIMD, LimitVegas, LimitGradient2} {
+		conf := &AdaptiveLimitConf{Algorithm: alg, InitialLimit: 20, Timeout: 20, MaxLimit: 100}
+		al := newAdaptiveLimiter(conf, 0)
+
+		driveLimiter(al, 20, 5, false)
+		grown := al.current()
+
+		if grown <= 20 {
+			t.Errorf("%s: expected the limit to grow at low latency, got %d", alg, grown)
+		}
+
+		if alg == LimitAIMD {
+			driveLimiter(al, 5, 5, true)
+		} else {
+			driveLimiter(al, 5, 50, false)
+		}
+
+		if al.current() >= grown {
+			t.Errorf("%s: expected the limit to shrink from %d, got %d", alg, grown, al.current())
+		}
+
+		if len(al.series) < 2 {
+			t.Errorf("%s: expected the limit series to record changes", alg)
+		}
+	}
+
+	fixed := newAdaptiveLimiter(&AdaptiveLimitConf{InitialLimit: 3}, 0)
+	driveLimiter(fixed, 10, 50, true)
+
+	if fixed.current() != 3 || fixed.rejected == 0 {
+		t.Errorf("Expected a fixed limit of 3 that rejects: %d %d", fixed.current(), fixed.rejected)
+	}
+}
+
+// TestConcurrencyLimitOverload checks an adaptive limit on an
+// overloaded instance sheds calls and comes down from where it started.
+func TestConcurrencyLimitOverload(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+
+	res := lightResourceConfig()
+	res.Cores = 1
+
+	appConf := AppConf{
+		Name:      "limited",
+		Size:      1,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(4, 6)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: res,
+		ConcurrencyLimit: &AdaptiveLimitConf{
+			Algorithm:    LimitVegas,
+			InitialLimit: 50,
+		},
+	}
+
+	MakeLB(&LbConf{Name: "limited", App: &appConf}, loop)
+
+	sourceConf := makeTestSourceConf("limitedSource", 0.4, "limited", 1000.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.Run(600)
+
+	series := loop.ConcurrencyLimits()
+	if len(series) != 1 {
+		t.Fatalf("Expected one limiter, got %+v", series)
+	}
+
+	s := series[0]
+	last := s.Samples[len(s.Samples)-1]
+
+	t.Logf("calls=%d rejected=%d samples=%d last=%+v", s.Calls, s.Rejected, len(s.Samples), last)
+
+	if s.Rejected == 0 || last.Limit >= 50 {
+		t.Errorf("Expected the limit to come down and shed: %d rejected, limit %d", s.Rejected, last.Limit)
+	}
+}
+
+// TestRejectReleasesAdaptive checks calls turned away after taking a
+// concurrency limit slot give it and their rate limit slot back.
+func TestRejectReleasesAdaptive(t *testing.T) {
+	inFlight := func(limit int) (int, int) {
+		initTest()
+
+		loop := NewLoop()
+		loop.time = loopStartMs // slots are timed from it
+
+		appConf := AppConf{
+			Name:             "adaptiveServer",
+			Size:             1,
+			Stages:           []*StageConf{{LocalWork: UniformCDF(1, 2)}},
+			ReplyLen:         UniformCDF(100, 200),
+			Workers:          1,
+			RateLimit:        &RateLimitConf{MaxInFlight: 10},
+			ConcurrencyLimit: &AdaptiveLimitConf{Algorithm: LimitFixed, InitialLimit: limit},
+		}
+
+		lb := MakeLB(&LbConf{Name: "adaptiveServer", App: &appConf}, loop)
+		n := lb.appInstances[0]
+
+		caller := &node{name: "adaptiveSource", loop: loop}
+		caller.initCallMap()
+
+		for range 4 {
+			n.handleCall(&Call{ReqID: IncrCallNumber(), caller: caller, origin: caller.name})
+		}
+
+		return n.adaptive.inFlight, n.limiter.limits[""].inFlight
+	}
+
+	// a full accept queue turns away calls the limit let in
+	if adaptive, rate := inFlight(10); adaptive != 1 || rate != 1 {
+		t.Errorf("Expected only the working call to hold slots, got %d/%d", adaptive, rate)
+	}
+
+	// the concurrency limit turns away calls the rate limit let in
+	if adaptive, rate := inFlight(1); adaptive != 1 || rate != 1 {
+		t.Errorf("Expected only the working call to hold slots, got %d/%d", adaptive, rate)
+	}
+}
+
+// TestCallerLimitReleases checks a cancelled call frees the caller's
+// slot without moving its limit and a restart frees the rest.
+func TestCallerLimitReleases(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+	loop.time = loopStartMs
+
+	caller := &node{name: "callerLimitSource", loop: loop}
+	caller.initCallMap()
+
+	rc := &RemoteCall{Endpoint: "callerLimitServer", ConcurrencyLimit: &AdaptiveLimitConf{Algorithm: LimitAIMD, InitialLimit: 4}}
+	al := caller.callerLimiter(rc)
+
+	var handlers []handleReply
+
+	for range 3 {
+		f, ok := caller.callerLimitAllow(rc, &Call{ReqID: IncrCallNumber(), caller: caller}, func(*node, *Reply) {})
+		if !ok {
+			t.Fatal("Expected the call under the limit")
+		}
+
+		handlers = append(handlers, f)
+	}
+
+	handlers[0](caller, &Reply{status: statusClientClosed})
+
+	if al.inFlight != 2 || al.current() != 4 {
+		t.Errorf("Expected a cancelled call to free its slot only, got %d in flight limit %d", al.inFlight, al.current())
+	}
+
+	caller.fullOOMCleanup()
+
+	if al.inFlight != 0 {
+		t.Errorf("Expected a restart to free the slots, got %d", al.inFlight)
+	}
+}
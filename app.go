@@ -5,21 +5,30 @@
 package sim
 
 import (
+	"math/rand"
+
 	count "github.com/jayalane/go-counter"
 )
 
 const (
-	networkDelayConst = 5.0 // later better method here
+	networkDelayConst = 5.0 // per call hop when the loop has no NetworkConf
 )
 
 // RemoteCall is an endpoint and params.
 type RemoteCall struct {
-	Endpoint    string
-	Params      map[string]string
-	Retry       *RetryPolicy // Optional retry policy for this call
-	CPUCost     ModelCdf     // Per-call CPU cost CDF (optional)
-	MemoryCost  ModelCdf     // Per-call memory cost CDF (optional)
-	NetworkCost ModelCdf     // Per-call network cost CDF (optional)
+	Endpoint         string
+	Params           map[string]string
+	Priority         int                // Optional priority, 0 keeps the caller's
+	Retry            *RetryPolicy       // Optional retry policy for this call
+	Breaker          *BreakerConf       // Optional circuit breaker per caller instance
+	ConcurrencyLimit *AdaptiveLimitConf // Optional adaptive limit per caller instance
+	Hedge            *HedgeConf         // Optional hedged requests
+	Bulkhead         *BulkheadConf      // Optional partition of the caller's outbound calls
+	TimeoutMs        Milliseconds       // Optional wait for the reply before a local 504 (0 = never)
+	RequestLen       ModelCdf           // Optional request size in bytes
+	CPUCost          ModelCdf           // Per-call CPU cost CDF (optional)
+	MemoryCost       ModelCdf           // Per-call memory cost CDF (optional)
+	NetworkCost      ModelCdf           // Per-call network cost CDF (optional)
 }
 
 // RemoteCallFuncType is a callback to filter out remote calls based on params.
@@ -30,6 +39,14 @@ type StageConf struct {
 	LocalWork   ModelCdf
 	FilterCall  RemoteCallFuncType
 	RemoteCalls []*RemoteCall
+	DiskReads   int      // Optional disk reads per call
+	DiskWrites  int      // Optional disk writes per call
+	IOBytes     ModelCdf // bytes per read or write (nil = 4096)
+
+	// AwaitReplies holds the call's reply until this stage's remote
+	// calls have answered, and until every stage is done.  Without it
+	// remote calls are fire and forget and the last stage replies.
+	AwaitReplies bool
 }
 
 // AppConf is the configuration of an application.
@@ -39,22 +56,43 @@ type AppConf struct {
 	ReplyLen  ModelCdf
 	Stages    []*StageConf
 	Resources *ResourceConfig // Optional resource configuration
+	Zones     []string        // Optional zones to spread instances across
+
+	Connections      *PoolConf          // Optional connection pool to each endpoint called
+	Workers          int                // Optional calls worked on at once per instance (0 = unlimited)
+	AcceptQueue      int                // calls that may wait for a worker before rejecting
+	Queue            *QueueConf         // Optional accept queue discipline (default FIFO), needs Workers and AcceptQueue
+	RateLimit        *RateLimitConf     // Optional rate limit per instance
+	ConcurrencyLimit *AdaptiveLimitConf // Optional adaptive concurrency limit per instance
+	RetryBudget      *RetryBudgetConf   // Optional cap on each instance's retries
+	Shed             *ShedConf          // Optional priority load shedding per instance
+	Cancellation     *CancelConf        // Optional dropping of work for cancelled calls
 }
 
 // MakeApp takes and lb config and a loop
 // integrates the new node into that loop. LB config
 // is needed so name is per pool not per app.
 func MakeApp(lb *LbConf, l *Loop, suffix string) {
-	_ = makeApp(lb, l, suffix)
+	_ = makeApp(lb, l, suffix, "")
 }
 
 // makeApp takes and lb config and a loop and returns a
-// node integrated into that loop.
-func makeApp(lb *LbConf, l *Loop, suffix string) *node {
+// node in the given zone integrated into that loop.
+func makeApp(lb *LbConf, l *Loop, suffix string, zone string) *node {
 	n := node{}
 
 	n.App = lb.App
 	n.name = lb.Name + suffix
+	n.pool = lb.Name
+	n.zone = zone
+	n.limiter = newRateLimiter(lb.App.RateLimit)
+	n.adaptive = newAdaptiveLimiter(lb.App.ConcurrencyLimit, Milliseconds(l.GetTime()))
+	n.retryBudget = newRetryBudget(lb.App.RetryBudget)
+	n.shedder = newShedder(lb.App.Shed)
+
+	if lb.App.Queue != nil && (lb.App.Workers <= 0 || lb.App.AcceptQueue <= 0) {
+		ml.La(n.name + ": Queue discipline ignored without Workers and AcceptQueue")
+	}
 
 	// Initialize resources with app configuration
 	n.initResources(lb.App.Resources)
@@ -65,6 +103,17 @@ func makeApp(lb *LbConf, l *Loop, suffix string) *node {
 	return &n
 }
 
+// awaitsReplies is whether any stage waits on its remote calls.
+func (a *AppConf) awaitsReplies() bool {
+	for _, h := range a.Stages {
+		if h.AwaitReplies {
+			return true
+		}
+	}
+
+	return false
+}
+
 // MakeCall generates the call from an old call.
 func (r *RemoteCall) MakeCall(n *node, oldC *Call) *Call {
 	count.IncrSyncSuffix("remote_call_generated", n.name)
@@ -73,8 +122,18 @@ func (r *RemoteCall) MakeCall(n *node, oldC *Call) *Call {
 	c.ReqID = IncrCallNumber()
 	c.caller = n
 	c.TimeoutMs = 90.0
-	c.Wakeup = Milliseconds(n.loop.GetTime() + networkDelayConst) // nolint:gomnd //TBD
+	c.Wakeup = Milliseconds(n.loop.GetTime()) + n.loop.callDelay(n.zone, n.zone)
 	c.Endpoint = r.Endpoint
+	c.fromZone = n.zone
+	c.origin = n.App.Name
+	c.Priority = oldC.Priority
+	c.replyTimeout = r.TimeoutMs
+	c.cancel = n.childToken(oldC)
+	c.trace = oldC.span.context()
+
+	if r.Priority != 0 {
+		c.Priority = r.Priority
+	}
 
 	if oldC.Params != nil {
 		c.Params = oldC.Params
@@ -82,6 +141,10 @@ func (r *RemoteCall) MakeCall(n *node, oldC *Call) *Call {
 		c.Params = r.Params
 	}
 
+	if r.RequestLen != nil {
+		c.length = uint64(r.RequestLen(rand.Float64())) //nolint:gosec
+	}
+
 	// Propagate per-call cost CDFs
 	c.cpuCost = r.CPUCost
 	c.memoryCost = r.MemoryCost
@@ -0,0 +1,359 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	defaultBreakerWindow = 1000.0 // ms
+	defaultBreakerOpen   = 5000.0 // ms
+)
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets calls through and counts their outcomes.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails calls fast without sending them.
+	BreakerOpen
+	// BreakerHalfOpen lets a few probe calls through to see if the
+	// endpoint has recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+
+	return "unknown"
+}
+
+// BreakerConf configures a circuit breaker on a RemoteCall.  Each
+// caller instance keeps its own breaker per endpoint.  It trips on
+// ConsecutiveFailures or on ErrorRate over the rolling Window,
+// whichever is set.  A half open probe with no reply within OpenMs
+// counts as failed.
+type BreakerConf struct {
+	ConsecutiveFailures int          // trip after this many failures in a row (0 = off)
+	ErrorRate           float64      // trip when the window's error rate reaches this (0 = off)
+	MinRequests         int          // calls in the window before ErrorRate applies
+	Window              Milliseconds // rolling window for ErrorRate (0 = 1s)
+	OpenMs              Milliseconds // how long to stay open (0 = 5s)
+	HalfOpenProbes      int          // probes allowed half open, all must succeed (0 = 1)
+}
+
+// outcome is one finished call in a breaker's window.
+type outcome struct {
+	at     Milliseconds
+	failed bool
+}
+
+// breaker is one caller's circuit breaker for one endpoint.
+type breaker struct {
+	mu          sync.Mutex
+	conf        *BreakerConf
+	state       BreakerState
+	window      []outcome
+	consecutive int
+	openedAt    Milliseconds
+	halfOpenAt  Milliseconds
+	round       int // half open spells, so a late reply isn't taken for a probe
+	probes      int // in flight while half open
+	successes   int // probe successes while half open
+
+	calls    int
+	rejected int
+	opens    int
+}
+
+// BreakerStats sums up one app's breakers for one endpoint.
+type BreakerStats struct {
+	App      string
+	Endpoint string
+	Calls    int // let through
+	Rejected int // failed fast while open
+	Opens    int
+	Open     int // instances whose breaker is open at the end of the run
+}
+
+func (b *breaker) windowMs() Milliseconds {
+	if b.conf.Window <= 0 {
+		return defaultBreakerWindow
+	}
+
+	return b.conf.Window
+}
+
+func (b *breaker) openMs() Milliseconds {
+	if b.conf.OpenMs <= 0 {
+		return defaultBreakerOpen
+	}
+
+	return b.conf.OpenMs
+}
+
+func (b *breaker) maxProbes() int {
+	if b.conf.HalfOpenProbes <= 0 {
+		return 1
+	}
+
+	return b.conf.HalfOpenProbes
+}
+
+// allow decides if a call may be sent, returning the state it moved
+// to if that changed.  Probes with no reply after the open time are
+// taken as failed.  Caller must hold b.mu.
+func (b *breaker) allow(now Milliseconds) (bool, *BreakerState) {
+	var moved *BreakerState
+
+	if b.state == BreakerOpen && now-b.openedAt >= b.openMs() {
+		b.state = BreakerHalfOpen
+		b.halfOpenAt = now
+		b.round++
+		b.probes = 0
+		b.successes = 0
+		moved = &b.state
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		b.rejected++
+
+		return false, moved
+	case BreakerHalfOpen:
+		if b.probes >= b.maxProbes() {
+			if now-b.halfOpenAt >= b.openMs() {
+				moved = b.trip(now)
+			}
+
+			b.rejected++
+
+			return false, moved
+		}
+
+		b.probes++
+	case BreakerClosed:
+	}
+
+	b.calls++
+
+	return true, moved
+}
+
+// record counts a call's outcome, returning the state it moved to if
+// that changed.  Caller must hold b.mu.
+func (b *breaker) record(now Milliseconds, failed bool) *BreakerState {
+	switch b.state {
+	case BreakerHalfOpen:
+		b.probes--
+
+		if failed {
+			return b.trip(now)
+		}
+
+		b.successes++
+		if b.successes < b.maxProbes() {
+			return nil
+		}
+
+		b.state = BreakerClosed
+		b.window = nil
+		b.consecutive = 0
+
+		return &b.state
+	case BreakerOpen:
+		// a call sent before the breaker opened
+		return nil
+	case BreakerClosed:
+	}
+
+	b.window = append(b.window, outcome{at: now, failed: failed})
+
+	start := 0
+	for start < len(b.window) && now-b.window[start].at > b.windowMs() {
+		start++
+	}
+
+	b.window = b.window[start:]
+
+	if failed {
+		b.consecutive++
+	} else {
+		b.consecutive = 0
+	}
+
+	if b.conf.ConsecutiveFailures > 0 && b.consecutive >= b.conf.ConsecutiveFailures {
+		return b.trip(now)
+	}
+
+	if b.conf.ErrorRate > 0 && len(b.window) >= max(1, b.conf.MinRequests) {
+		failures := 0
+
+		for _, o := range b.window {
+			if o.failed {
+				failures++
+			}
+		}
+
+		if float64(failures)/float64(len(b.window)) >= b.conf.ErrorRate {
+			return b.trip(now)
+		}
+	}
+
+	return nil
+}
+
+// settle feeds a reply to a call let through in round back to the
+// breaker.  A call the caller cancelled only frees its probe, and a
+// reply from before the breaker went half open doesn't count at all.
+// Caller must hold b.mu.
+func (b *breaker) settle(now Milliseconds, round int, r *Reply) *BreakerState {
+	if b.state == BreakerHalfOpen && round != b.round {
+		return nil
+	}
+
+	if r.status != statusClientClosed {
+		return b.record(now, r.status != 0)
+	}
+
+	if b.state == BreakerHalfOpen {
+		b.probes--
+	}
+
+	return nil
+}
+
+// trip opens the breaker.  Caller must hold b.mu.
+func (b *breaker) trip(now Milliseconds) *BreakerState {
+	b.state = BreakerOpen
+	b.openedAt = now
+	b.window = nil
+	b.consecutive = 0
+	b.opens++
+
+	return &b.state
+}
+
+// breaker returns the caller's breaker for an endpoint.
+func (n *node) breaker(rc *RemoteCall) *breaker {
+	n.breakersMu.Lock()
+	defer n.breakersMu.Unlock()
+
+	if n.breakers == nil {
+		n.breakers = make(map[string]*breaker)
+	}
+
+	b, ok := n.breakers[rc.Endpoint]
+	if !ok {
+		b = &breaker{conf: rc.Breaker}
+		n.breakers[rc.Endpoint] = b
+	}
+
+	return b
+}
+
+// breakerAllow checks the call's breaker, failing the call with a 503
+// if it is open.  It returns the reply handler to send the call with,
+// which feeds the outcome back to the breaker.
+func (n *node) breakerAllow(rc *RemoteCall, c *Call, f handleReply) (handleReply, bool) {
+	b := n.breaker(rc)
+	now := Milliseconds(n.loop.GetTime())
+
+	b.mu.Lock()
+	ok, moved := b.allow(now)
+	round := b.round
+	b.mu.Unlock()
+
+	n.breakerMoved(rc.Endpoint, moved)
+
+	if !ok {
+		count.IncrSyncSuffix("breaker_reject", n.name)
+		f(n, &Reply{reqID: c.ReqID, status: http.StatusServiceUnavailable, call: c, local: true})
+
+		return nil, false
+	}
+
+	return func(n *node, r *Reply) {
+		b.mu.Lock()
+		moved := b.settle(Milliseconds(n.loop.GetTime()), round, r)
+		b.mu.Unlock()
+
+		n.breakerMoved(rc.Endpoint, moved)
+		f(n, r)
+	}, true
+}
+
+// breakerMoved records a breaker state change.
+func (n *node) breakerMoved(endpoint string, moved *BreakerState) {
+	if moved == nil {
+		return
+	}
+
+	count.IncrSyncSuffix("breaker_"+moved.String(), n.name)
+	n.loop.recordEvent("breaker_"+moved.String(), n.name, fmt.Sprintf("to %s", endpoint))
+}
+
+// BreakerStats returns circuit breaker stats summed per app and
+// endpoint across instances.
+func (l *Loop) BreakerStats() []BreakerStats {
+	type key struct{ app, endpoint string }
+
+	byKey := map[key]*BreakerStats{}
+
+	for _, n := range l.nodes {
+		n.breakersMu.Lock()
+
+		for endpoint, b := range n.breakers {
+			k := key{n.App.Name, endpoint}
+
+			s, ok := byKey[k]
+			if !ok {
+				s = &BreakerStats{App: n.App.Name, Endpoint: endpoint}
+				byKey[k] = s
+			}
+
+			b.mu.Lock()
+			s.Calls += b.calls
+			s.Rejected += b.rejected
+			s.Opens += b.opens
+
+			if b.state == BreakerOpen {
+				s.Open++
+			}
+			b.mu.Unlock()
+		}
+
+		n.breakersMu.Unlock()
+	}
+
+	res := make([]BreakerStats, 0, len(byKey))
+	for _, s := range byKey {
+		res = append(res, *s)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].App != res[j].App {
+			return res[i].App < res[j].App
+		}
+
+		return res[i].Endpoint < res[j].Endpoint
+	})
+
+	return res
+}
@@ -0,0 +1,158 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+
+	count "github.com/jayalane/go-counter"
+)
+
+// TestBreakerStates walks a breaker through open, half open and closed.
+func TestBreakerStates(t *testing.T) {
+	b := &breaker{conf: &BreakerConf{ConsecutiveFailures: 3, OpenMs: 10, HalfOpenProbes: 2}}
+
+	for i := range 3 {
+		if ok, _ := b.allow(Milliseconds(i)); !ok {
+			t.Fatal("Expected a closed breaker to allow calls")
+		}
+
+		b.record(Milliseconds(i), true)
+	}
+
+	if b.state != BreakerOpen {
+		t.Fatalf("Expected 3 failures in a row to open, got %v", b.state)
+	}
+
+	if ok, _ := b.allow(5); ok {
+		t.Error("Expected an open breaker to fail fast")
+	}
+
+	ok1, moved := b.allow(12)
+	ok2, _ := b.allow(12)
+	ok3, _ := b.allow(12)
+
+	if !ok1 || !ok2 || ok3 || moved == nil || *moved != BreakerHalfOpen {
+		t.Errorf("Expected 2 probes half open, got %v %v %v", ok1, ok2, ok3)
+	}
+
+	b.record(13, false)
+
+	if moved := b.record(13, false); moved == nil || *moved != BreakerClosed {
+		t.Errorf("Expected good probes to close, got %v", b.state)
+	}
+
+	lost := &breaker{conf: &BreakerConf{ConsecutiveFailures: 1, OpenMs: 10}}
+	lost.allow(0)
+	lost.record(0, true)
+
+	if ok, _ := lost.allow(10); !ok {
+		t.Error("Expected a probe half open")
+	}
+
+	if ok, moved := lost.allow(19); ok || moved != nil {
+		t.Error("Expected no second probe while the first is out")
+	}
+
+	if ok, moved := lost.allow(20); ok || moved == nil || *moved != BreakerOpen {
+		t.Errorf("Expected a probe with no reply to open again, got %v", lost.state)
+	}
+
+	if ok, _ := lost.allow(30); !ok {
+		t.Error("Expected a new probe after the open time")
+	}
+
+	// the lost probe's late reply isn't the new probe's
+	if lost.settle(31, 1, &Reply{}); lost.probes != 1 {
+		t.Errorf("Expected the late reply ignored, got %d probes", lost.probes)
+	}
+
+	rate := &breaker{conf: &BreakerConf{ErrorRate: 0.5, MinRequests: 4, Window: 100}}
+
+	for i, failed := range []bool{true, false, true, false} {
+		rate.allow(Milliseconds(i))
+		rate.record(Milliseconds(i), failed)
+	}
+
+	if rate.state != BreakerOpen {
+		t.Errorf("Expected a 50%% error rate to open, got %v", rate.state)
+	}
+}
+
+// runBreaker sends a frontend's calls to a backend that is down for
+// the first 400ms and returns the retries it made and its breakers.
+func runBreaker(t *testing.T, conf *BreakerConf) (int, []BreakerStats, []Event) {
+	t.Helper()
+	initTest()
+
+	loop := NewLoop()
+
+	backendConf := AppConf{
+		Name:      "breakerBackend",
+		Size:      2,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 2)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "breakerBackend", App: &backendConf}, loop)
+
+	frontendConf := AppConf{
+		Name: "breakerFrontend",
+		Size: 1,
+		Stages: []*StageConf{{
+			LocalWork: UniformCDF(1, 2),
+			RemoteCalls: []*RemoteCall{{
+				Endpoint:  "breakerBackend",
+				Retry:     &RetryPolicy{MaxRetries: 3, InitialDelay: 5, BackoffFactor: 2, MaxDelay: 50},
+				Breaker:   conf,
+				TimeoutMs: 90,
+			}},
+		}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "breakerFrontend", App: &frontendConf}, loop)
+
+	sourceConf := makeTestSourceConf("breakerSource", 0.5, "breakerFrontend", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.AddFault(&Fault{Kind: FaultKill, Target: "breakerBackend", Fraction: 1, Start: 0, Duration: 400})
+
+	retriesBefore := count.ReadSync("outbound_retry")
+
+	loop.Run(700)
+
+	retries := int(count.ReadSync("outbound_retry") - retriesBefore)
+	t.Logf("retries=%d breakers=%+v", retries, loop.BreakerStats())
+
+	return retries, loop.BreakerStats(), loop.Events()
+}
+
+// TestBreakerStopsRetryStorm checks a breaker cuts the retries sent to
+// a dead backend and closes again once it is back.
+func TestBreakerStopsRetryStorm(t *testing.T) {
+	stormRetries, _, _ := runBreaker(t, nil)
+
+	retries, stats, events := runBreaker(t, &BreakerConf{ConsecutiveFailures: 5, OpenMs: 50})
+
+	if retries >= stormRetries/2 {
+		t.Errorf("Expected the breaker to cut retries: %d vs %d", retries, stormRetries)
+	}
+
+	if len(stats) != 1 || stats[0].Opens == 0 || stats[0].Rejected == 0 || stats[0].Open != 0 {
+		t.Errorf("Expected the breaker to open, fail fast and close again: %+v", stats)
+	}
+
+	kinds := map[string]bool{}
+	for _, e := range events {
+		kinds[e.Kind] = true
+	}
+
+	for _, kind := range []string{"breaker_open", "breaker_half-open", "breaker_closed"} {
+		if !kinds[kind] {
+			t.Errorf("Expected a %s event, got %v", kind, kinds)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	count "github.com/jayalane/go-counter"
+)
+
+// BulkheadConf partitions a caller instance's outbound calls so each
+// endpoint gets its own share: calls over MaxConcurrent wait for a
+// slot, and calls that can't wait fail at once with a 503.  A call
+// waiting in the outbound queue for its callee holds its slot, so one
+// stuck endpoint can't fill the queue and starve the others.
+type BulkheadConf struct {
+	MaxConcurrent int          // calls in flight to the endpoint at once
+	MaxQueued     int          // calls that may wait for a slot (0 = none)
+	MaxWait       Milliseconds // longest wait for a slot (0 = the RemoteCall's TimeoutMs, if set)
+}
+
+// bulkheadWaiter is a call waiting for a slot.
+type bulkheadWaiter struct {
+	call  *Call
+	since Milliseconds
+	send  func()
+	fail  func(status uint64)
+}
+
+// bulkhead is one caller instance's partition for one endpoint.
+type bulkhead struct {
+	mu      sync.Mutex
+	conf    *BulkheadConf
+	active  int
+	waiting []*bulkheadWaiter
+
+	admitted  int
+	queued    int
+	rejected  int
+	timedOut  int
+	ticks     int
+	activeSum int
+	fullTicks int
+}
+
+// BulkheadStats sums up an app's bulkhead for one endpoint.
+type BulkheadStats struct {
+	App           string
+	Endpoint      string
+	MaxConcurrent int
+	Admitted      int     // calls that got a slot
+	Queued        int     // of which had to wait
+	Rejected      int     // calls failed with no slot or room to wait
+	TimedOut      int     // calls that waited past MaxWait
+	MeanActive    float64 // mean calls in flight per instance
+	Saturation    float64 // share of time every slot was taken
+}
+
+// Utilization returns the mean share of the slots in use.
+func (s BulkheadStats) Utilization() float64 {
+	if s.MaxConcurrent <= 0 {
+		return 0
+	}
+
+	return s.MeanActive / float64(s.MaxConcurrent)
+}
+
+// full is whether every slot is taken.  Caller holds b.mu.
+func (b *bulkhead) full() bool {
+	return b.conf.MaxConcurrent > 0 && b.active >= b.conf.MaxConcurrent
+}
+
+// bulkheadFor returns the caller's bulkhead for an endpoint.
+func (n *node) bulkheadFor(rc *RemoteCall) *bulkhead {
+	n.bulkheadsMu.Lock()
+	defer n.bulkheadsMu.Unlock()
+
+	if n.bulkheads == nil {
+		n.bulkheads = make(map[string]*bulkhead)
+	}
+
+	b, ok := n.bulkheads[rc.Endpoint]
+	if !ok {
+		b = &bulkhead{conf: rc.Bulkhead}
+		n.bulkheads[rc.Endpoint] = b
+	}
+
+	return b
+}
+
+// bulkheadAttempt runs send with a slot in the endpoint's bulkhead,
+// now or once one frees up, or fails the call to f.  The slot is
+// freed when the reply reaches the handler send is given.
+func (n *node) bulkheadAttempt(rc *RemoteCall, c *Call, f handleReply, send func(handleReply)) {
+	b := n.bulkheadFor(rc)
+
+	released := func(n *node, r *Reply) {
+		b.mu.Lock()
+		b.active--
+		b.mu.Unlock()
+
+		f(n, r)
+	}
+
+	fail := func(status uint64) {
+		f(n, &Reply{reqID: c.ReqID, status: status, call: c, local: true})
+	}
+
+	b.mu.Lock()
+
+	if !b.full() && len(b.waiting) == 0 {
+		b.active++
+		b.admitted++
+		b.mu.Unlock()
+
+		send(released)
+
+		return
+	}
+
+	if len(b.waiting) < b.conf.MaxQueued {
+		b.queued++
+		b.waiting = append(b.waiting, &bulkheadWaiter{
+			call:  c,
+			since: Milliseconds(n.loop.GetTime()),
+			send:  func() { send(released) },
+			fail:  fail,
+		})
+		b.mu.Unlock()
+
+		return
+	}
+
+	b.rejected++
+	b.mu.Unlock()
+
+	count.IncrSyncSuffix("bulkhead_reject", n.name)
+	fail(http.StatusServiceUnavailable)
+}
+
+// tickBulkheads gives freed slots to waiting calls, times out calls
+// that have waited too long and samples how full each bulkhead is.
+func (n *node) tickBulkheads() {
+	n.bulkheadsMu.Lock()
+	bulkheads := make([]*bulkhead, 0, len(n.bulkheads))
+
+	for _, b := range n.bulkheads {
+		bulkheads = append(bulkheads, b)
+	}
+
+	n.bulkheadsMu.Unlock()
+
+	now := Milliseconds(n.loop.GetTime())
+
+	for _, b := range bulkheads {
+		var ready, expired []*bulkheadWaiter
+
+		b.mu.Lock()
+
+		for len(b.waiting) > 0 {
+			w := b.waiting[0]
+
+			maxWait := b.conf.MaxWait
+			if maxWait <= 0 {
+				maxWait = w.call.replyTimeout
+			}
+
+			if maxWait > 0 && now-w.since > maxWait {
+				b.waiting = b.waiting[1:]
+				b.timedOut++
+				expired = append(expired, w)
+
+				continue
+			}
+
+			if b.full() {
+				break
+			}
+
+			b.waiting = b.waiting[1:]
+			b.active++
+			b.admitted++
+			ready = append(ready, w)
+		}
+
+		b.ticks++
+		b.activeSum += b.active
+
+		if b.full() {
+			b.fullTicks++
+		}
+
+		b.mu.Unlock()
+
+		for _, w := range expired {
+			count.IncrSyncSuffix("bulkhead_wait_timeout", n.name)
+			w.fail(http.StatusGatewayTimeout)
+		}
+
+		for _, w := range ready {
+			w.send()
+		}
+	}
+}
+
+// resetBulkheads frees every slot and fails the waiting calls, as
+// when the container restarts.
+func (n *node) resetBulkheads() {
+	n.bulkheadsMu.Lock()
+	bulkheads := n.bulkheads
+	n.bulkheads = nil
+	n.bulkheadsMu.Unlock()
+
+	for _, b := range bulkheads {
+		b.mu.Lock()
+		waiting := b.waiting
+		b.waiting = nil
+		b.mu.Unlock()
+
+		for _, w := range waiting {
+			w.fail(http.StatusServiceUnavailable)
+		}
+	}
+}
+
+// BulkheadStats returns each app's bulkheads per endpoint, summed
+// across the app's instances.
+func (l *Loop) BulkheadStats() []BulkheadStats {
+	type sum struct {
+		stats     BulkheadStats
+		ticks     int
+		activeSum int
+		fullTicks int
+	}
+
+	sums := make(map[[2]string]*sum)
+
+	for _, n := range l.nodes {
+		n.bulkheadsMu.Lock()
+
+		for endpoint, b := range n.bulkheads {
+			key := [2]string{n.App.Name, endpoint}
+
+			s, ok := sums[key]
+			if !ok {
+				s = &sum{stats: BulkheadStats{App: n.App.Name, Endpoint: endpoint, MaxConcurrent: b.conf.MaxConcurrent}}
+				sums[key] = s
+			}
+
+			b.mu.Lock()
+			s.stats.Admitted += b.admitted
+			s.stats.Queued += b.queued
+			s.stats.Rejected += b.rejected
+			s.stats.TimedOut += b.timedOut
+			s.ticks += b.ticks
+			s.activeSum += b.activeSum
+			s.fullTicks += b.fullTicks
+			b.mu.Unlock()
+		}
+
+		n.bulkheadsMu.Unlock()
+	}
+
+	res := make([]BulkheadStats, 0, len(sums))
+
+	for _, s := range sums {
+		if s.ticks > 0 {
+			s.stats.MeanActive = float64(s.activeSum) / float64(s.ticks)
+			s.stats.Saturation = float64(s.fullTicks) / float64(s.ticks)
+		}
+
+		res = append(res, s.stats)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].App != res[j].App {
+			return res[i].App < res[j].App
+		}
+
+		return res[i].Endpoint < res[j].Endpoint
+	})
+
+	return res
+}
@@ -0,0 +1,109 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+)
+
+// TestBulkheadIsolation checks a stuck endpoint fills only its own
+// bulkhead and calls to a healthy endpoint from the same caller go
+// through.
+func TestBulkheadIsolation(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+
+	for _, name := range []string{"dbWallet", "dbBin"} {
+		dbConf := AppConf{
+			Name:      name,
+			Size:      2,
+			Stages:    []*StageConf{{LocalWork: UniformCDF(1, 2)}},
+			ReplyLen:  UniformCDF(100, 200),
+			Resources: lightResourceConfig(),
+		}
+
+		MakeLB(&LbConf{Name: name, App: &dbConf}, loop)
+	}
+
+	bulkhead := &BulkheadConf{MaxConcurrent: 15, MaxQueued: 5}
+
+	walletConf := AppConf{
+		Name: "walletserv",
+		Size: 2,
+		Stages: []*StageConf{{
+			LocalWork: UniformCDF(1, 2),
+			RemoteCalls: []*RemoteCall{
+				{Endpoint: "dbWallet", Bulkhead: bulkhead},
+				{Endpoint: "dbBin", Bulkhead: bulkhead},
+			},
+		}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "walletserv", App: &walletConf}, loop)
+
+	sourceConf := makeTestSourceConf("walletSource", 0.5, "walletserv", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	// dbWallet answers late, so its calls hold their slots a long time
+	loop.AddFault(&Fault{Kind: FaultLatency, Target: "dbWallet", Start: 0, Latency: 200})
+
+	loop.Run(500)
+
+	stats := map[string]BulkheadStats{}
+
+	for _, s := range loop.BulkheadStats() {
+		t.Logf("%+v utilization %.2f", s, s.Utilization())
+		stats[s.Endpoint] = s
+	}
+
+	wallet, bin := stats["dbWallet"], stats["dbBin"]
+
+	if wallet.Saturation < 0.5 || wallet.Rejected == 0 {
+		t.Errorf("Expected the stuck endpoint's bulkhead saturated: %+v", wallet)
+	}
+
+	if bin.Rejected != 0 || bin.Saturation > 0.05 || bin.Admitted < wallet.Admitted {
+		t.Errorf("Expected the healthy endpoint unaffected: %+v", bin)
+	}
+}
+
+// TestBulkheadWaiters checks a waiting call times out after its reply
+// timeout when MaxWait isn't set, waits on without one and fails when
+// the caller restarts.
+func TestBulkheadWaiters(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+	loop.time = loopStartMs
+
+	caller := &node{name: "bulkheadCaller", loop: loop}
+	caller.initCallMap()
+
+	rc := &RemoteCall{Endpoint: "bulkheadServer", Bulkhead: &BulkheadConf{MaxConcurrent: 1, MaxQueued: 2}}
+	statuses := map[int]uint64{}
+
+	for i, timeout := range []Milliseconds{0, 10, 0} {
+		c := &Call{ReqID: i, caller: caller, replyTimeout: timeout}
+		caller.bulkheadAttempt(rc, c, func(_ *node, r *Reply) { statuses[i] = r.status }, func(handleReply) {})
+	}
+
+	loop.time += 20
+	caller.tickBulkheads()
+
+	if _, ok := statuses[2]; ok || statuses[1] != 504 {
+		t.Errorf("Expected only the call with a timeout to give up waiting, got %v", statuses)
+	}
+
+	caller.resetBulkheads()
+
+	if statuses[2] != 503 {
+		t.Errorf("Expected a restart to fail the waiting call, got %v", statuses)
+	}
+
+	if _, ok := statuses[0]; ok {
+		t.Errorf("Expected the call with the slot to be left to its reply, got %v", statuses)
+	}
+}
@@ -5,7 +5,10 @@
 package sim
 
 import (
+	"net/http"
 	"sync"
+
+	count "github.com/jayalane/go-counter"
 )
 
 // HandleReply type is a callback to process the reply from a call.
@@ -18,15 +21,39 @@ type Call struct {
 	Endpoint  string
 	TimeoutMs float64
 	ReqID     int
-	//	length     uint64
+	Priority  int    // higher is served first by QueuePriority
+	length    uint64 // request size in bytes
 	//	id1        uint64
 	// id2        uint64
 	Params map[string]string
 	// connection *Connection
-	caller      *node
-	cpuCost     ModelCdf // Per-call CPU cost CDF (nil = use node default)
-	memoryCost  ModelCdf // Per-call memory cost CDF (nil = use node default)
-	networkCost ModelCdf // Per-call network cost CDF (nil = use node default)
+	caller        *node
+	cpuCost       ModelCdf     // Per-call CPU cost CDF (nil = use node default)
+	memoryCost    ModelCdf     // Per-call memory cost CDF (nil = use node default)
+	networkCost   ModelCdf     // Per-call network cost CDF (nil = use node default)
+	fromZone      string       // zone of the app instance or source that made the call
+	origin        string       // app or source that made the call
+	queueTag      float64      // WFQ finish tag
+	heapBytes     float64      // live heap the call holds on the callee
+	heldLimit     *limitState  // rate limiter in-flight slot it holds
+	adaptiveSince Milliseconds // when it took a concurrency limit slot (0 = none)
+	queuedAt      Milliseconds // when it reached the worker pool
+	startedAt     Milliseconds // when a worker picked it up
+	finished      bool         // worker freed, guarded by workerPool.mu
+	hedge         *hedgeGroup  // the call and its hedges, if hedging
+	hedged        bool         // a duplicate sent by hedging
+	cancel        *cancelToken // set when the caller gives up on the call
+	attempt       int          // retries before this one
+	trace         *spanContext // span the callee's spans go under, if traced
+	traceParent   *spanContext // span the call was made under
+	span          *Span        // the callee's span handling the call
+	awaits        bool         // reply waits for every stage and awaited reply
+	outstanding   int32        // stages and awaited replies still to come, used atomically
+	childStatus   uint64       // first failed awaited reply's status, used atomically
+	replyTimeout  Milliseconds // give up on the reply after this long (0 = never)
+	running       int32        // counted in the callee's inFlight, used atomically
+	replied       int32        // its reply or a stage's failure was sent, used atomically
+	failed        int32        // a stage failed, the others are dropped, used atomically
 }
 
 var (
@@ -47,31 +74,77 @@ func IncrCallNumber() int {
 // sendCall sends the call to the callee node channel.
 // On failure to deliver, the call is queued at the sender for retry.
 func (c *Call) sendCall(callee *node, f handleReply) {
+	if c.cancel == nil {
+		c.cancel = &cancelToken{}
+	}
+
+	f = c.traceClient(f)
 	reqID := IncrCallNumber()
 	c.ReqID = reqID
 	c.caller.pendingCallMapMu.Lock()
-	c.caller.pendingCallMap[c.ReqID] = &pendingCall{reply: nil, call: c, f: f}
+	c.caller.pendingCallMap[c.ReqID] = &pendingCall{reply: nil, call: c, callee: callee, f: f, sentAt: Milliseconds(c.caller.loop.GetTime())}
 	c.caller.pendingCallMapMu.Unlock()
 
-	if !callee.tryAcceptCall(c) {
-		oc := &OutboundCall{
-			call:     c,
-			callee:   callee,
-			callback: f,
-			queuedAt: Milliseconds(c.caller.loop.GetTime()),
-		}
-		c.caller.queueOutbound(oc)
-	}
+	c.transmit(callee, f, nil)
 }
 
 // sendCallWithRetry sends the call with an existing retry state.
 func (c *Call) sendCallWithRetry(callee *node, f handleReply, rs *RetryState) {
+	if c.cancel == nil {
+		c.cancel = &cancelToken{}
+	}
+
+	f = c.traceClient(f)
 	reqID := IncrCallNumber()
 	c.ReqID = reqID
 	c.caller.pendingCallMapMu.Lock()
-	c.caller.pendingCallMap[c.ReqID] = &pendingCall{reply: nil, call: c, f: f}
+	c.caller.pendingCallMap[c.ReqID] = &pendingCall{reply: nil, call: c, callee: callee, f: f, sentAt: Milliseconds(c.caller.loop.GetTime())}
 	c.caller.pendingCallMapMu.Unlock()
 
+	c.transmit(callee, f, rs)
+}
+
+// transmit moves the request body across the network, if it has one
+// and the path has a bandwidth limit, and then delivers the call.
+func (c *Call) transmit(callee *node, f handleReply, rs *RetryState) {
+	landing := callee.callCB == nil
+
+	// the hop to an LB is part of the hop to the instance, so loss is
+	// drawn once, on landing
+	if landing {
+		penalty, lost := c.caller.loop.lossPenalty(c.fromZone, callee.zone)
+		if lost {
+			// never arrives; the caller gives up unless its timeout fires first
+			count.IncrSyncSuffix("network_call_lost", c.caller.name)
+			ml.La(c.caller.name+": Call lost in the network", c.ReqID)
+			c.caller.deliverReply(c.lostReply(c.ReqID), penalty)
+
+			return
+		}
+
+		c.Wakeup += penalty
+	}
+
+	if c.caller.loop.startTransfer(c.caller, callee, c.fromZone, callee.zone, landing, c.length,
+		func(elapsed Milliseconds) {
+			c.Wakeup += elapsed
+			c.deliver(callee, f, rs)
+		}) {
+		return
+	}
+
+	c.deliver(callee, f, rs)
+}
+
+// lostReply is the local 504 a caller gets when it gives up on a call
+// or reply lost in the network.
+func (c *Call) lostReply(reqID int) *Reply {
+	return &Reply{reqID: reqID, status: http.StatusGatewayTimeout, call: c, local: true}
+}
+
+// deliver hands the call to the callee or, if it has no room, queues
+// it at the sender for retry.
+func (c *Call) deliver(callee *node, f handleReply, rs *RetryState) {
 	if !callee.tryAcceptCall(c) {
 		oc := &OutboundCall{
 			call:       c,
@@ -0,0 +1,290 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	count "github.com/jayalane/go-counter"
+)
+
+// statusClientClosed answers a call dropped as cancelled, as nginx
+// does when the client went away, so the caller frees what it holds.
+const statusClientClosed = 499
+
+// CancelConf turns on cancellation support in an app.  A call is
+// cancelled when its caller times out on it or a hedge of it wins;
+// the callee then drops the call's tasks that haven't run yet.  The
+// signal reaches the callee at once, as if sent out of band.
+type CancelConf struct {
+	AbortInProgress bool // also stop stages already using the CPU (with Cores)
+	CancelChildren  bool // cancel the calls the call has made in turn
+}
+
+// cancelToken is shared by a call and the copies the LB makes of it,
+// and links to the calls made while serving it.  A call is abandoned
+// once anyone above it has given up, which is what wasted work is
+// measured by, but only cancelled if the signal reached it: the
+// caller gave up on it, or on a parent with CancelChildren.
+type cancelToken struct {
+	cancelled atomic.Bool
+	abandoned atomic.Bool
+	signal    bool // parent's cancel signals this token
+	mu        sync.Mutex
+	parent    *cancelToken
+	children  []*cancelToken
+}
+
+// cancelCounts is a node's cancellation bookkeeping.
+type cancelCounts struct {
+	mu           sync.Mutex
+	droppedCalls int
+	dropped      int
+	aborted      int
+	savedMs      float64
+	wastedTasks  int
+	wastedMs     float64
+}
+
+// CancelStats sums up an app's work on cancelled calls.
+type CancelStats struct {
+	App          string
+	DroppedCalls int     // calls dropped before they started
+	DroppedTasks int     // tasks dropped before they ran
+	AbortedTasks int     // tasks stopped part way through their CPU
+	SavedMs      float64 // work the drops and aborts didn't do
+	WastedTasks  int     // tasks run for calls already cancelled
+	WastedMs     float64 // work done for calls already cancelled
+}
+
+// child returns a token under t, or a fresh one if t is nil.  With
+// signal, cancelling t cancels it; otherwise it is only abandoned.
+func (t *cancelToken) child(signal bool) *cancelToken {
+	c := &cancelToken{parent: t, signal: signal}
+	if t == nil {
+		return c
+	}
+
+	t.mu.Lock()
+	t.children = append(t.children, c)
+	t.mu.Unlock()
+
+	switch {
+	case signal && t.isCancelled():
+		c.cancel()
+	case t.isAbandoned():
+		c.abandon()
+	}
+
+	return c
+}
+
+// sibling returns a token for another attempt of the same call.
+func (t *cancelToken) sibling() *cancelToken {
+	if t == nil {
+		return &cancelToken{}
+	}
+
+	return t.parent.child(t.signal)
+}
+
+// cancel cancels the token, and its children as they are linked.
+func (t *cancelToken) cancel() {
+	if t == nil || t.cancelled.Swap(true) {
+		return
+	}
+
+	t.abandoned.Store(true)
+
+	for _, c := range t.childTokens() {
+		if c.signal {
+			c.cancel()
+		} else {
+			c.abandon()
+		}
+	}
+}
+
+// abandon marks the token and all below it abandoned.
+func (t *cancelToken) abandon() {
+	if t == nil || t.abandoned.Swap(true) {
+		return
+	}
+
+	for _, c := range t.childTokens() {
+		c.abandon()
+	}
+}
+
+func (t *cancelToken) childTokens() []*cancelToken {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]*cancelToken(nil), t.children...)
+}
+
+func (t *cancelToken) isCancelled() bool {
+	return t != nil && t.cancelled.Load()
+}
+
+func (t *cancelToken) isAbandoned() bool {
+	return t != nil && t.abandoned.Load()
+}
+
+// childToken returns the token for a call made while serving parent.
+func (n *node) childToken(parent *Call) *cancelToken {
+	signal := n.App != nil && n.App.Cancellation != nil && n.App.Cancellation.CancelChildren
+
+	return parent.cancel.child(signal)
+}
+
+// honorsCancel is whether the node drops work for the cancelled call.
+func (n *node) honorsCancel(c *Call) bool {
+	return n.App != nil && n.App.Cancellation != nil && c.cancel.isCancelled()
+}
+
+// dropCancelledTask drops the task if its call is cancelled and the
+// node supports it, finishing the call with its last task.  Otherwise
+// it notes work done for a call that was abandoned.  It returns true
+// if the task was dropped.
+func (n *node) dropCancelledTask(t *Task) bool {
+	if !t.call.cancel.isAbandoned() {
+		return false
+	}
+
+	honored := n.honorsCancel(t.call)
+
+	n.cancels.mu.Lock()
+
+	if honored {
+		n.cancels.dropped++
+		n.cancels.savedMs += t.work
+	} else {
+		n.cancels.wastedTasks++
+		n.cancels.wastedMs += t.work
+	}
+
+	n.cancels.mu.Unlock()
+
+	if !honored {
+		return false
+	}
+
+	count.IncrSyncSuffix("node_task_cancelled", n.name)
+
+	switch {
+	case t.call.awaits:
+		n.awaitDone(t.call)
+	case t.nextTask == nil:
+		n.dropCall(t.call)
+	}
+
+	return true
+}
+
+// dropCancelledCall drops a call cancelled before it started, if the
+// node supports it.  It returns true if the call was dropped.
+func (n *node) dropCancelledCall(c *Call) bool {
+	if !n.honorsCancel(c) {
+		return false
+	}
+
+	n.cancels.mu.Lock()
+	n.cancels.droppedCalls++
+	n.cancels.mu.Unlock()
+
+	count.IncrSyncSuffix("node_call_cancelled", n.name)
+	n.dropCall(c)
+
+	return true
+}
+
+// dropCall finishes a cancelled call, answering it so the caller's
+// pending call and the slots it holds for it are freed.
+func (n *node) dropCall(c *Call) {
+	n.sendStatusReply(c, statusClientClosed, "Cancelled")
+	n.finishCall(c)
+}
+
+// abortCancelledJobs takes the CPU jobs of cancelled calls off the
+// cores, if the app aborts stages in progress.
+func (n *node) abortCancelledJobs() {
+	if n.cores == nil || n.App == nil || n.App.Cancellation == nil || !n.App.Cancellation.AbortInProgress {
+		return
+	}
+
+	n.cores.mu.Lock()
+
+	var aborted []*cpuJob
+
+	running := n.cores.jobs[:0]
+
+	for _, job := range n.cores.jobs {
+		if job.task != nil && job.task.call.cancel.isCancelled() {
+			aborted = append(aborted, job)
+
+			continue
+		}
+
+		running = append(running, job)
+	}
+
+	n.cores.jobs = running
+	n.cores.mu.Unlock()
+
+	for _, job := range aborted {
+		n.cancels.mu.Lock()
+		n.cancels.aborted++
+		n.cancels.savedMs += job.remaining
+		n.cancels.mu.Unlock()
+
+		count.IncrSyncSuffix("node_task_aborted", n.name)
+
+		switch {
+		case job.task.call.awaits:
+			n.awaitDone(job.task.call)
+		case job.task.nextTask == nil:
+			n.dropCall(job.task.call)
+		}
+	}
+}
+
+// CancelStats returns work dropped for and wasted on cancelled calls
+// per app, summed across the app's instances.
+func (l *Loop) CancelStats() []CancelStats {
+	sums := make(map[string]*CancelStats)
+
+	for _, n := range l.nodes {
+		if n.callCB != nil || n.App == nil {
+			continue
+		}
+
+		s, ok := sums[n.App.Name]
+		if !ok {
+			s = &CancelStats{App: n.App.Name}
+			sums[n.App.Name] = s
+		}
+
+		n.cancels.mu.Lock()
+		s.DroppedCalls += n.cancels.droppedCalls
+		s.DroppedTasks += n.cancels.dropped
+		s.AbortedTasks += n.cancels.aborted
+		s.SavedMs += n.cancels.savedMs
+		s.WastedTasks += n.cancels.wastedTasks
+		s.WastedMs += n.cancels.wastedMs
+		n.cancels.mu.Unlock()
+	}
+
+	res := make([]CancelStats, 0, len(sums))
+	for _, s := range sums {
+		res = append(res, *s)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].App < res[j].App })
+
+	return res
+}
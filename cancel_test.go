@@ -0,0 +1,144 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+)
+
+// TestCancelToken checks a cancel signals linked children and only
+// abandons the rest.
+func TestCancelToken(t *testing.T) {
+	root := (*cancelToken)(nil).child(false)
+	signalled := root.child(true)
+	unsignalled := root.child(false)
+	grandchild := signalled.child(true)
+
+	root.cancel()
+
+	if !signalled.isCancelled() || !grandchild.isCancelled() {
+		t.Error("Expected the signal to reach linked children")
+	}
+
+	if unsignalled.isCancelled() || !unsignalled.isAbandoned() {
+		t.Error("Expected an unlinked child only abandoned")
+	}
+
+	if late := signalled.child(true); !late.isCancelled() {
+		t.Error("Expected a child of a cancelled call born cancelled")
+	}
+
+	if retry := signalled.sibling(); !retry.isCancelled() {
+		t.Error("Expected another attempt under a cancelled parent cancelled")
+	}
+}
+
+// runCancelChain sends a source with a short timeout through a front
+// app to a slow back app and returns the cancel stats per app.
+func runCancelChain(t *testing.T, suffix string, front, back *CancelConf) map[string]CancelStats {
+	t.Helper()
+	initTest()
+
+	loop := NewLoop()
+
+	backConf := AppConf{
+		Name:         "cancelBack" + suffix,
+		Size:         2,
+		Stages:       []*StageConf{{LocalWork: UniformCDF(30, 40)}},
+		ReplyLen:     UniformCDF(100, 200),
+		Resources:    lightResourceConfig(),
+		Cancellation: back,
+	}
+
+	MakeLB(&LbConf{Name: backConf.Name, App: &backConf}, loop)
+
+	frontConf := AppConf{
+		Name: "cancelFront" + suffix,
+		Size: 2,
+		Stages: []*StageConf{
+			{LocalWork: UniformCDF(1, 2), RemoteCalls: []*RemoteCall{{Endpoint: backConf.Name}}},
+			{LocalWork: UniformCDF(40, 50)},
+		},
+		ReplyLen:     UniformCDF(100, 200),
+		Resources:    lightResourceConfig(),
+		Cancellation: front,
+	}
+
+	MakeLB(&LbConf{Name: frontConf.Name, App: &frontConf}, loop)
+
+	// the source gives up long before the front's second stage is done
+	sourceConf := makeTestSourceConf("cancelSource"+suffix, 0.2, frontConf.Name, 30.0)
+	sourceConf.ReplyTimeoutMs = 30
+	MakeSource(&sourceConf, loop)
+
+	loop.Run(400)
+
+	res := map[string]CancelStats{}
+
+	for _, s := range loop.CancelStats() {
+		t.Logf("%s: %+v", suffix, s)
+		res[s.App[:len(s.App)-len(suffix)]] = s
+	}
+
+	return res
+}
+
+// TestCancelPropagation checks that without cancellation the work for
+// timed out calls is wasted all down the tree, and with it the work
+// is dropped.
+func TestCancelPropagation(t *testing.T) {
+	none := runCancelChain(t, "None", nil, nil)
+
+	if none["cancelFront"].WastedTasks == 0 || none["cancelBack"].WastedTasks == 0 {
+		t.Errorf("Expected wasted work at both tiers without cancellation: %+v", none)
+	}
+
+	full := runCancelChain(t, "Full", &CancelConf{CancelChildren: true}, &CancelConf{})
+
+	for _, app := range []string{"cancelFront", "cancelBack"} {
+		s := full[app]
+		dropped := s.DroppedCalls + s.DroppedTasks
+		if dropped == 0 || s.WastedTasks > dropped/10 {
+			t.Errorf("Expected %s to drop the cancelled work: %+v", app, s)
+		}
+	}
+
+	if full["cancelBack"].SavedMs < none["cancelBack"].WastedMs/2 {
+		t.Errorf("Expected the back to save most of the work it wasted before")
+	}
+}
+
+// TestCancelAbortsCPU checks a cancelled call's stage comes off the
+// cores part way through with AbortInProgress.
+func TestCancelAbortsCPU(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+
+	res := lightResourceConfig()
+	res.Cores = 1
+
+	appConf := AppConf{
+		Name:         "abortServer",
+		Size:         1,
+		Stages:       []*StageConf{{LocalWork: UniformCDF(30, 40)}},
+		ReplyLen:     UniformCDF(100, 200),
+		Resources:    res,
+		Cancellation: &CancelConf{AbortInProgress: true},
+	}
+
+	MakeLB(&LbConf{Name: "abortServer", App: &appConf}, loop)
+
+	sourceConf := makeTestSourceConf("abortSource", 0.02, "abortServer", 20.0)
+	sourceConf.ReplyTimeoutMs = 20
+	MakeSource(&sourceConf, loop)
+
+	loop.Run(400)
+
+	stats := loop.CancelStats()
+	t.Logf("%+v", stats)
+
+	if len(stats) != 1 || stats[0].AbortedTasks == 0 || stats[0].SavedMs == 0 {
+		t.Errorf("Expected stages aborted on the cores: %+v", stats)
+	}
+}
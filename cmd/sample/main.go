@@ -6,6 +6,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	_ "net/http/pprof" //nolint:gosec // for profiling
 	"os"
@@ -17,9 +18,6 @@ import (
 
 // Simulation parameters - easy to tweak for experiments.
 const (
-	// CPU scaling factor - baseline CPUs for CPU-per-work calculations.
-	baselineCPUs = 2.0
-
 	// Duration and load.
 	simDurationMs = 5000 // 5 seconds of simulated time
 	loginLambda   = 5.0  // requests per second to /login (reduced)
@@ -30,55 +28,54 @@ const (
 	// Latencies in milliseconds (halved).
 	dbReadMinMs  = 0.5
 	dbReadMaxMs  = 1.5
-	dbWriteMinMs = 9.0
-	dbWriteMaxMs = 11.0
+	dbWriteMinMs = 0.5 // CPU side of a write; the disk adds the rest
+	dbWriteMaxMs = 1.0
+
+	// Database disks: each write is a WAL append and a page write, so
+	// two ~5ms fsyncs give the old 9-11ms when the disk is idle.
+	dbWritesPerCall   = 2
+	dbDiskIOPS        = 2000.0
+	dbDiskBandwidth   = 200000.0 // bytes per ms
+	dbDiskWriteMinMs  = 4.5
+	dbDiskWriteMaxMs  = 5.5
+	dbWriteIOBytesMin = 4096
+	dbWriteIOBytesMax = 16384
+	dbCPUs            = 8.0
 
 	// Pool sizes (number of containers per service).
 	defaultPoolSize = 80 // doubled from 40
 
-	// Web tier: 2 CPU containers, can handle ~3 overlapping transactions.
-	// With 2 CPUs, each request uses ~33% of container CPU.
+	// Web tier: 2 CPU containers; local work is CPU ms shared by the
+	// transactions running on them.
 	webCPUs           = 2.0 // CPUs per container
-	webMaxConcurrent  = 3.0 // max overlapping transactions per container
-	webCPULimit       = 1.0 / webMaxConcurrent
 	webMemoryLimit    = 0.40
 	webNetworkLimit   = 0.95 // high limit
 	webLocalWorkMin   = 2.0
 	webLocalWorkMax   = 5.0
-	webCPUPerWork     = 0.05 * (baselineCPUs / webCPUs) // scales with CPU count
 	webMemoryPerCall  = 0.10
 	webNetworkPerCall = 0.01 // reduced for high fanout
 
-	// Service tier: 16 CPU containers, can handle ~50 overlapping transactions.
-	// With 16 CPUs, each request uses ~2% of container CPU.
+	// Service tier: 16 CPU containers.
 	svcCPUs           = 16.0
-	svcMaxConcurrent  = 50.0
-	svcCPULimit       = 1.0 / svcMaxConcurrent
 	svcMemoryLimit    = 0.05
 	svcNetworkLimit   = 0.95 // high limit
 	svcLocalWorkMin   = 1.0
 	svcLocalWorkMax   = 3.0
-	svcCPUPerWork     = 0.01 * (baselineCPUs / svcCPUs) // scales with CPU count
 	svcMemoryPerCall  = 0.005
 	svcNetworkPerCall = 0.001 // reduced for high fanout
 
-	// DB Proxy tier: 16 CPU containers, can handle ~500 overlapping transactions.
+	// DB Proxy tier: 16 CPU containers.
 	// Mostly I/O bound, very low CPU per request.
 	dbProxyCPUs           = 16.0
-	dbProxyMaxConcurrent  = 500.0
-	dbProxyCPULimit       = 1.0 / dbProxyMaxConcurrent
 	dbProxyMemoryLimit    = 0.005
 	dbProxyNetworkLimit   = 0.95 // high limit
 	dbProxyLocalWorkMin   = 0.5
 	dbProxyLocalWorkMax   = 1.0
-	dbProxyCPUPerWork     = 0.001 * (baselineCPUs / dbProxyCPUs) // scales with CPU count
 	dbProxyMemoryPerCall  = 0.0005
 	dbProxyNetworkPerCall = 0.0001 // reduced for high fanout
 
 	// Recovery and decay settings.
 	memoryRecoveryMs = 10000 // 10 seconds to restart after OOM
-	cpuDelayFactor   = 2.0   // 2x delay when CPU saturated
-	cpuDecayRate     = 0.10  // 10% decay per ms
 	memoryDecayRate  = 0.02  // 2% decay per ms (slower)
 	networkDecayRate = 0.50  // 50% decay per ms (fast for high throughput)
 
@@ -99,11 +96,6 @@ const (
 	dbProxyQueuedMemMin = 0.001
 	dbProxyQueuedMemMax = 0.002
 
-	// CPU reject limits.
-	webCPURejectLimit     = 0.95
-	svcCPURejectLimit     = 0.90
-	dbProxyCPURejectLimit = 0.85
-
 	// Database pool size.
 	dbPoolSize = 4
 
@@ -121,8 +113,40 @@ const (
 
 	// Network delay for wakeup.
 	networkDelayMs = 1.0 // reduced from 5.0
+
+	// Chaos schedule: db-wallet-read gets slower for a while.
+	faultStartMs    = 2000
+	faultDurationMs = 1000
+	faultLatencyMs  = 200
+
+	// Zone latency matrix.
+	sameZoneMinMs  = 0.5
+	sameZoneMaxMs  = 1.0
+	crossZoneMinMs = 1.0
+	crossZoneMaxMs = 2.0
+
+	// Share of requests traced, written as Jaeger JSON to traceFile.
+	traceSampleRate = 0.01
+	traceFile       = "traces.json"
+
+	// Metrics sampled every metricsIntervalMs, written to metricsFile
+	// as CSV and Parquet.
+	metricsIntervalMs = 100
+	metricsFile       = "metrics"
+
+	// HTML report of the run.
+	reportFile = "report.html"
+
+	// Service graph written as Graphviz DOT and Mermaid.
+	topologyFile = "topology"
+
+	// Prometheus /metrics served here while the simulation runs.
+	promAddr = "localhost:9464"
 )
 
+// Availability zones every pool is spread across.
+var zones = []string{"us-east-1a", "us-east-1b", "us-east-1c"}
+
 func main() {
 	// Start pprof server for profiling.
 	go func() {
@@ -136,6 +160,13 @@ func main() {
 	sim.Init()
 
 	loop := sim.NewLoop()
+	loop.SetTracing(&sim.TraceConf{SampleRate: traceSampleRate})
+	loop.SetMetrics(&sim.MetricsConf{IntervalMs: metricsIntervalMs})
+
+	if err := loop.SetPrometheus(&sim.PromConf{Addr: promAddr}); err != nil {
+		fmt.Println("Can't serve Prometheus metrics:", err)
+	}
+	buildNetwork(loop)
 
 	// Build the data center from bottom up.
 	buildDatabases(loop)
@@ -143,6 +174,7 @@ func main() {
 	buildMiddleTierServices(loop)
 	buildWebFrontends(loop)
 	buildTrafficSources(loop)
+	buildFaults(loop)
 
 	fmt.Println("=== Data Center Simulation ===")
 	fmt.Println("Web Frontends: loginweb, checkoutweb, planweb, payweb (2 containers each)")
@@ -155,79 +187,166 @@ func main() {
 	loop.Run(simDurationMs)
 	loop.Stats()
 	count.LogCounters()
+	writeTraces(loop)
+	writeMetrics(loop)
+	writeReport(loop)
+	writeTopology(loop)
 
 	fmt.Println("\n=== Simulation Complete ===")
 }
 
-// webResourceConfig returns resource config for web tier (2 CPU, 3 concurrent).
+// writeTraces saves the sampled traces for loading into Jaeger.
+func writeTraces(loop *sim.Loop) {
+	f, err := os.Create(traceFile)
+	if err != nil {
+		fmt.Println("Can't write traces:", err)
+
+		return
+	}
+	defer f.Close()
+
+	if err := loop.WriteJaegerJSON(f); err != nil {
+		fmt.Println("Can't write traces:", err)
+
+		return
+	}
+
+	fmt.Println("Traces written to", traceFile)
+}
+
+// writeMetrics saves the sampled time series for notebooks.
+func writeMetrics(loop *sim.Loop) {
+	for ext, write := range map[string]func(io.Writer) error{
+		".csv":     loop.WriteMetricsCSV,
+		".parquet": loop.WriteMetricsParquet,
+	} {
+		f, err := os.Create(metricsFile + ext)
+		if err != nil {
+			fmt.Println("Can't write metrics:", err)
+
+			continue
+		}
+
+		if err := write(f); err != nil {
+			fmt.Println("Can't write metrics:", err)
+		}
+
+		f.Close()
+	}
+
+	fmt.Println("Metrics written to", metricsFile+".csv and", metricsFile+".parquet")
+}
+
+// writeReport saves the HTML run report.
+func writeReport(loop *sim.Loop) {
+	f, err := os.Create(reportFile)
+	if err != nil {
+		fmt.Println("Can't write report:", err)
+
+		return
+	}
+	defer f.Close()
+
+	if err := loop.WriteHTMLReport(f); err != nil {
+		fmt.Println("Can't write report:", err)
+
+		return
+	}
+
+	fmt.Println("Report written to", reportFile)
+}
+
+// writeTopology saves the service graph for design docs.
+func writeTopology(loop *sim.Loop) {
+	for ext, write := range map[string]func(io.Writer) error{
+		".dot": loop.WriteTopologyDOT,
+		".mmd": loop.WriteTopologyMermaid,
+	} {
+		f, err := os.Create(topologyFile + ext)
+		if err != nil {
+			fmt.Println("Can't write topology:", err)
+
+			continue
+		}
+
+		if err := write(f); err != nil {
+			fmt.Println("Can't write topology:", err)
+		}
+
+		f.Close()
+	}
+
+	fmt.Println("Topology written to", topologyFile+".dot and", topologyFile+".mmd")
+}
+
+// webResourceConfig returns resource config for web tier (2 CPU).
 func webResourceConfig() *sim.ResourceConfig {
 	return &sim.ResourceConfig{
-		CPUPerLocalWork:     sim.UniformCDF(webCPUPerWork*lowMultiplier, webCPUPerWork*highMultiplier),
 		MemoryPerCall:       sim.UniformCDF(webMemoryPerCall*lowMultiplier, webMemoryPerCall*highMultiplier),
 		NetworkPerCall:      sim.UniformCDF(webNetworkPerCall*lowMultiplier, webNetworkPerCall*highMultiplier),
 		NetworkPerReply:     sim.UniformCDF(webNetworkPerCall*replyLow, webNetworkPerCall*replyHigh),
 		MemoryPerQueuedCall: sim.UniformCDF(webQueuedMemMin, webQueuedMemMax),
 
-		CPULimit:     webCPULimit,
+		Cores:        webCPUs,
 		MemoryLimit:  webMemoryLimit,
 		NetworkLimit: webNetworkLimit,
 
 		MemoryRecoveryMs: memoryRecoveryMs,
-		CPUDelayFactor:   cpuDelayFactor,
-		CPURejectLimit:   webCPURejectLimit,
-
-		CPUDecayRate:     cpuDecayRate,
 		MemoryDecayRate:  memoryDecayRate,
 		NetworkDecayRate: networkDecayRate,
 	}
 }
 
-// svcResourceConfig returns resource config for service tier (16 CPU, 50 concurrent).
+// svcResourceConfig returns resource config for service tier (16 CPU).
 func svcResourceConfig() *sim.ResourceConfig {
 	return &sim.ResourceConfig{
-		CPUPerLocalWork:     sim.UniformCDF(svcCPUPerWork*lowMultiplier, svcCPUPerWork*highMultiplier),
 		MemoryPerCall:       sim.UniformCDF(svcMemoryPerCall*lowMultiplier, svcMemoryPerCall*highMultiplier),
 		NetworkPerCall:      sim.UniformCDF(svcNetworkPerCall*lowMultiplier, svcNetworkPerCall*highMultiplier),
 		NetworkPerReply:     sim.UniformCDF(svcNetworkPerCall*replyLow, svcNetworkPerCall*replyHigh),
 		MemoryPerQueuedCall: sim.UniformCDF(svcQueuedMemMin, svcQueuedMemMax),
 
-		CPULimit:     svcCPULimit,
+		Cores:        svcCPUs,
 		MemoryLimit:  svcMemoryLimit,
 		NetworkLimit: svcNetworkLimit,
 
 		MemoryRecoveryMs: memoryRecoveryMs,
-		CPUDelayFactor:   cpuDelayFactor,
-		CPURejectLimit:   svcCPURejectLimit,
-
-		CPUDecayRate:     cpuDecayRate,
 		MemoryDecayRate:  memoryDecayRate,
 		NetworkDecayRate: networkDecayRate,
 	}
 }
 
-// dbProxyResourceConfig returns resource config for db proxy tier (16 CPU, 500 concurrent).
+// dbProxyResourceConfig returns resource config for db proxy tier (16 CPU).
 func dbProxyResourceConfig() *sim.ResourceConfig {
 	return &sim.ResourceConfig{
-		CPUPerLocalWork:     sim.UniformCDF(dbProxyCPUPerWork*lowMultiplier, dbProxyCPUPerWork*highMultiplier),
 		MemoryPerCall:       sim.UniformCDF(dbProxyMemoryPerCall*lowMultiplier, dbProxyMemoryPerCall*highMultiplier),
 		NetworkPerCall:      sim.UniformCDF(dbProxyNetworkPerCall*lowMultiplier, dbProxyNetworkPerCall*highMultiplier),
 		NetworkPerReply:     sim.UniformCDF(dbProxyNetworkPerCall*replyLow, dbProxyNetworkPerCall*replyHigh),
 		MemoryPerQueuedCall: sim.UniformCDF(dbProxyQueuedMemMin, dbProxyQueuedMemMax),
 
-		CPULimit:     dbProxyCPULimit,
+		Cores:        dbProxyCPUs,
 		MemoryLimit:  dbProxyMemoryLimit,
 		NetworkLimit: dbProxyNetworkLimit,
 
 		MemoryRecoveryMs: memoryRecoveryMs,
-		CPUDelayFactor:   cpuDelayFactor,
-		CPURejectLimit:   dbProxyCPURejectLimit,
-
-		CPUDecayRate:     cpuDecayRate,
 		MemoryDecayRate:  memoryDecayRate,
 		NetworkDecayRate: networkDecayRate,
 	}
 }
 
+// dbWriteResourceConfig returns resource config for the write
+// databases, whose latency comes from contention on their disk.
+func dbWriteResourceConfig() *sim.ResourceConfig {
+	rc := dbProxyResourceConfig()
+	rc.Cores = dbCPUs
+	rc.Disk = &sim.DiskConf{
+		IOPS:      dbDiskIOPS,
+		Bandwidth: dbDiskBandwidth,
+		WriteMs:   sim.UniformCDF(dbDiskWriteMinMs, dbDiskWriteMaxMs),
+	}
+
+	return rc
+}
+
 // Database names - each service has its own DB.
 var databases = []string{
 	"db-userdata",
@@ -250,15 +369,22 @@ func buildDatabases(loop *sim.Loop) {
 			Size:     dbPoolSize,
 			Stages:   []*sim.StageConf{{LocalWork: sim.UniformCDF(dbReadMinMs, dbReadMaxMs)}},
 			ReplyLen: sim.UniformCDF(dbReadReplyMin, dbReadReplyMax),
+			Zones:    zones,
 		}
 		sim.MakeLB(&sim.LbConf{Name: dbName + "-read", App: readApp}, loop)
 
 		// Write endpoint.
 		writeApp := &sim.AppConf{
-			Name:     dbName + "-write",
-			Size:     dbPoolSize,
-			Stages:   []*sim.StageConf{{LocalWork: sim.UniformCDF(dbWriteMinMs, dbWriteMaxMs)}},
-			ReplyLen: sim.UniformCDF(dbWriteReplyMin, dbWriteReplyMax),
+			Name: dbName + "-write",
+			Size: dbPoolSize,
+			Stages: []*sim.StageConf{{
+				LocalWork:  sim.UniformCDF(dbWriteMinMs, dbWriteMaxMs),
+				DiskWrites: dbWritesPerCall,
+				IOBytes:    sim.UniformCDF(dbWriteIOBytesMin, dbWriteIOBytesMax),
+			}},
+			ReplyLen:  sim.UniformCDF(dbWriteReplyMin, dbWriteReplyMax),
+			Resources: dbWriteResourceConfig(),
+			Zones:     zones,
 		}
 		sim.MakeLB(&sim.LbConf{Name: dbName + "-write", App: writeApp}, loop)
 	}
@@ -287,6 +413,7 @@ func buildDBProxies(loop *sim.Loop) {
 			Size:      defaultPoolSize,
 			Resources: dbProxyResourceConfig(),
 			ReplyLen:  sim.UniformCDF(dbProxyReplyMin, dbProxyReplyMax),
+			Zones:     zones,
 			Stages: []*sim.StageConf{
 				{
 					LocalWork: sim.UniformCDF(dbProxyLocalWorkMin, dbProxyLocalWorkMax),
@@ -328,6 +455,7 @@ func buildMiddleTierServices(loop *sim.Loop) {
 			Size:      defaultPoolSize,
 			Resources: svcResourceConfig(),
 			ReplyLen:  sim.UniformCDF(svcReplyMin, svcReplyMax),
+			Zones:     zones,
 			Stages: []*sim.StageConf{
 				{
 					LocalWork:   sim.UniformCDF(svcLocalWorkMin, svcLocalWorkMax),
@@ -363,6 +491,7 @@ func buildWebFrontends(loop *sim.Loop) {
 			Size:      defaultPoolSize,
 			Resources: webResourceConfig(),
 			ReplyLen:  sim.UniformCDF(webReplyMin, webReplyMax),
+			Zones:     zones,
 			Stages: []*sim.StageConf{
 				{
 					LocalWork:   sim.UniformCDF(webLocalWorkMin, webLocalWorkMax),
@@ -388,11 +517,13 @@ var trafficSources = []struct {
 
 // buildTrafficSources creates the external traffic generators.
 func buildTrafficSources(loop *sim.Loop) {
-	for _, src := range trafficSources {
+	for i, src := range trafficSources {
 		endpoint := src.endpoint // Capture for closure.
 		sourceConf := sim.SourceConf{
-			Name:   src.name,
-			Lambda: src.lambda,
+			Name:           src.name,
+			Lambda:         src.lambda,
+			Zone:           zones[i%len(zones)],
+			ReplyTimeoutMs: defaultTimeoutMs,
 			MakeCall: func(s *sim.Source) *sim.Call {
 				c := sim.Call{}
 				c.ReqID = sim.IncrCallNumber()
@@ -406,3 +537,31 @@ func buildTrafficSources(loop *sim.Loop) {
 		sim.MakeSource(&sourceConf, loop)
 	}
 }
+
+// buildFaults adds the chaos schedule to rehearse a slow dependency.
+func buildFaults(loop *sim.Loop) {
+	loop.AddFault(&sim.Fault{
+		Kind:     sim.FaultLatency,
+		Target:   "db-wallet-read",
+		Start:    faultStartMs,
+		Duration: faultDurationMs,
+		Latency:  faultLatencyMs,
+	})
+}
+
+// buildNetwork sets the zone to zone latency matrix.
+func buildNetwork(loop *sim.Loop) {
+	crossZone := &sim.LinkConf{Latency: sim.UniformCDF(crossZoneMinMs, crossZoneMaxMs)}
+	links := map[sim.ZonePair]*sim.LinkConf{}
+
+	for i, a := range zones {
+		for _, b := range zones[i+1:] {
+			links[sim.ZonePair{From: a, To: b}] = crossZone
+		}
+	}
+
+	loop.SetNetwork(&sim.NetworkConf{
+		Default: &sim.LinkConf{Latency: sim.UniformCDF(sameZoneMinMs, sameZoneMaxMs)},
+		Links:   links,
+	})
+}
@@ -4,11 +4,423 @@
 // discrete event simulation and then run it to generate statistics
 package sim
 
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	defaultMaxStreams = 100
+	defaultPoolSize   = 1
+)
+
+// PoolConf configures the connection pool an app keeps to each
+// endpoint it calls.
+type PoolConf struct {
+	MaxSize       int          // connections per destination (0 = 1)
+	ConnectMs     ModelCdf     // TCP handshake latency
+	TLS           bool         // whether connections also do a TLS handshake
+	TLSMs         ModelCdf     // TLS handshake latency
+	TLSCPU        ModelCdf     // CPU a TLS handshake costs the caller: utilization (0.0 to 1.0), or CPU ms with Cores
+	IdleTimeoutMs Milliseconds // close connections idle this long (0 = never)
+	Multiplexed   bool         // HTTP/2 style, many calls per connection
+	MaxStreams    int          // calls per connection when multiplexed (0 = 100)
+	WaitTimeoutMs Milliseconds // give up waiting for a connection (0 = never)
+	MaxWaiters    int          // reject when this many calls wait (0 = unbounded)
+}
+
 // Connection is a TCP connection (pooled or not)
-/* type Connection struct {
-	maxSize     uint64
-	currSize    uint64
+type Connection struct {
 	ssl         bool
 	multiplexed bool
 	owned       *Call // only if !multiplexed
-}*/
+	streams     int   // calls in flight on it
+	readyAt     Milliseconds
+	lastUsed    Milliseconds
+}
+
+// connWaiter is a call waiting for a free connection.
+type connWaiter struct {
+	since Milliseconds
+	c     *Call
+	send  func(conn *Connection)
+	fail  func()
+}
+
+// connPool is one caller's connections to one endpoint.
+type connPool struct {
+	mu      sync.Mutex
+	conf    *PoolConf
+	conns   []*Connection
+	waiters []*connWaiter
+
+	connects   int
+	handshakes int
+	waited     int
+	timeouts   int
+	rejected   int
+	maxWaiters int
+	waitMs     latencyStats
+}
+
+// ConnPoolStats sums up the pools from one app to one endpoint.
+type ConnPoolStats struct {
+	App          string
+	Endpoint     string
+	Connections  int // open at the end of the run
+	Connects     int
+	TLSHandshake int
+	Waited       int // calls that had to wait for a connection
+	WaitTimeouts int
+	Rejected     int // calls refused because too many were waiting
+	MaxWaiters   int // longest wait queue seen on any one instance
+	WaitMs       LatencySummary
+}
+
+// connPool returns the caller's pool for an endpoint.
+func (n *node) connPool(endpoint string) *connPool {
+	n.poolsMu.Lock()
+	defer n.poolsMu.Unlock()
+
+	if n.pools == nil {
+		n.pools = make(map[string]*connPool)
+	}
+
+	pool, ok := n.pools[endpoint]
+	if !ok {
+		pool = &connPool{conf: n.App.Connections}
+		n.pools[endpoint] = pool
+	}
+
+	return pool
+}
+
+// sendPooled gets a connection for the call, waiting if the pool is
+// exhausted, sends it, and frees the connection on the reply.
+func (n *node) sendPooled(rc *RemoteCall, c *Call, lb *LB, f handleReply) {
+	pool := n.connPool(rc.Endpoint)
+	delay := c.Wakeup - Milliseconds(n.loop.GetTime())
+
+	send := func(conn *Connection) {
+		// the call leaves now, which is later if it waited for a connection
+		now := Milliseconds(n.loop.GetTime())
+		c.Wakeup = now + delay
+
+		// wait out the handshake if the connection is still being set up
+		if wait := conn.readyAt - now; wait > 0 {
+			c.Wakeup += wait
+		}
+
+		var once sync.Once
+
+		n.sendDirect(rc, c, lb, func(n *node, r *Reply) {
+			once.Do(func() { n.releaseConnection(pool, conn) })
+			f(n, r)
+		})
+	}
+
+	fail := func() {
+		f(n, &Reply{reqID: c.ReqID, status: http.StatusServiceUnavailable, call: c, local: true})
+	}
+
+	pool.mu.Lock()
+
+	if conn := pool.freeConnection(); conn != nil {
+		pool.use(conn, c, Milliseconds(n.loop.GetTime()))
+		pool.mu.Unlock()
+		send(conn)
+
+		return
+	}
+
+	if len(pool.conns) < pool.maxSize() {
+		conn, tlsCPU := pool.open(Milliseconds(n.loop.GetTime()))
+		pool.use(conn, c, Milliseconds(n.loop.GetTime()))
+		pool.mu.Unlock()
+
+		count.IncrSyncSuffix("pool_connect", n.name)
+
+		if tlsCPU > 0 {
+			n.chargeHandshake(tlsCPU)
+		}
+
+		send(conn)
+
+		return
+	}
+
+	count.IncrSyncSuffix("pool_exhausted", n.name)
+
+	if pool.conf.MaxWaiters > 0 && len(pool.waiters) >= pool.conf.MaxWaiters {
+		pool.rejected++
+		pool.mu.Unlock()
+
+		count.IncrSyncSuffix("pool_wait_rejected", n.name)
+		fail()
+
+		return
+	}
+
+	pool.waiters = append(pool.waiters, &connWaiter{
+		since: Milliseconds(n.loop.GetTime()),
+		c:     c,
+		send:  send,
+		fail:  fail,
+	})
+	pool.waited++
+	pool.maxWaiters = max(pool.maxWaiters, len(pool.waiters))
+	pool.mu.Unlock()
+
+	ml.La(n.name+": Waiting for a connection to", rc.Endpoint)
+}
+
+// chargeHandshake puts a TLS handshake's CPU on the caller, as a job
+// sharing its cores or as CPU utilization.
+func (n *node) chargeHandshake(tlsCPU float64) {
+	switch {
+	case n.cores != nil:
+		n.cores.run(&cpuJob{remaining: tlsCPU})
+	case n.resources != nil:
+		if err := n.consumeResources(cpu, tlsCPU); err != nil {
+			ml.La(n.name+": CPU error on TLS handshake:", err.Error())
+		}
+	}
+}
+
+// maxSize is the most connections the pool opens.
+func (pool *connPool) maxSize() int {
+	if pool.conf.MaxSize <= 0 {
+		return defaultPoolSize
+	}
+
+	return pool.conf.MaxSize
+}
+
+// freeConnection returns a connection with room for another call.
+// Caller must hold pool.mu.
+func (pool *connPool) freeConnection() *Connection {
+	maxStreams := pool.conf.MaxStreams
+	if maxStreams <= 0 {
+		maxStreams = defaultMaxStreams
+	}
+
+	for _, conn := range pool.conns {
+		if conn.streams == 0 || (conn.multiplexed && conn.streams < maxStreams) {
+			return conn
+		}
+	}
+
+	return nil
+}
+
+// open starts a new connection, returning it and the TLS CPU cost.
+// Caller must hold pool.mu.
+func (pool *connPool) open(now Milliseconds) (*Connection, float64) {
+	setup := 0.0
+	tlsCPU := 0.0
+
+	if pool.conf.ConnectMs != nil {
+		setup += pool.conf.ConnectMs(rand.Float64()) //nolint:gosec
+	}
+
+	if pool.conf.TLS {
+		if pool.conf.TLSMs != nil {
+			setup += pool.conf.TLSMs(rand.Float64()) //nolint:gosec
+		}
+
+		if pool.conf.TLSCPU != nil {
+			tlsCPU = pool.conf.TLSCPU(rand.Float64()) //nolint:gosec
+		}
+
+		pool.handshakes++
+	}
+
+	conn := &Connection{
+		ssl:         pool.conf.TLS,
+		multiplexed: pool.conf.Multiplexed,
+		readyAt:     now + Milliseconds(setup),
+	}
+
+	pool.conns = append(pool.conns, conn)
+	pool.connects++
+
+	return conn, tlsCPU
+}
+
+// use puts a call on a connection.  Caller must hold pool.mu.
+func (pool *connPool) use(conn *Connection, c *Call, now Milliseconds) {
+	conn.streams++
+	conn.lastUsed = now
+
+	if !conn.multiplexed {
+		conn.owned = c
+	}
+}
+
+// releaseConnection frees a call's connection, handing it straight to
+// the longest waiting call if there is one.
+func (n *node) releaseConnection(pool *connPool, conn *Connection) {
+	now := Milliseconds(n.loop.GetTime())
+
+	pool.mu.Lock()
+
+	conn.streams--
+	conn.owned = nil
+	conn.lastUsed = now
+
+	if len(pool.waiters) == 0 {
+		pool.mu.Unlock()
+
+		return
+	}
+
+	w := pool.waiters[0]
+	pool.waiters = pool.waiters[1:]
+	pool.use(conn, w.c, now)
+	pool.waitMs.add(float64(now-w.since), false)
+	pool.mu.Unlock()
+
+	count.MarkDistributionSuffix("pool_wait_ms", float64(now-w.since), n.name)
+	w.send(conn)
+}
+
+// resetPools closes every connection and fails the calls waiting for
+// one, as when the container restarts.
+func (n *node) resetPools() {
+	n.poolsMu.Lock()
+	pools := n.pools
+	n.pools = nil
+	n.poolsMu.Unlock()
+
+	for _, pool := range pools {
+		pool.mu.Lock()
+		waiters := pool.waiters
+		pool.waiters = nil
+		pool.mu.Unlock()
+
+		for _, w := range waiters {
+			w.fail()
+		}
+	}
+}
+
+// tickConnPools times out waiting calls and closes idle connections.
+func (n *node) tickConnPools() {
+	now := Milliseconds(n.loop.GetTime())
+
+	n.poolsMu.Lock()
+	pools := make([]*connPool, 0, len(n.pools))
+
+	for _, pool := range n.pools {
+		pools = append(pools, pool)
+	}
+
+	n.poolsMu.Unlock()
+
+	for _, pool := range pools {
+		var expired []*connWaiter
+
+		pool.mu.Lock()
+
+		if pool.conf.WaitTimeoutMs > 0 {
+			waiting := pool.waiters[:0]
+
+			for _, w := range pool.waiters {
+				if now-w.since > pool.conf.WaitTimeoutMs {
+					expired = append(expired, w)
+					pool.waitMs.add(float64(now-w.since), true)
+
+					continue
+				}
+
+				waiting = append(waiting, w)
+			}
+
+			pool.waiters = waiting
+			pool.timeouts += len(expired)
+		}
+
+		if pool.conf.IdleTimeoutMs > 0 {
+			open := pool.conns[:0]
+
+			for _, conn := range pool.conns {
+				if conn.streams == 0 && now-conn.lastUsed > pool.conf.IdleTimeoutMs {
+					count.IncrSyncSuffix("pool_idle_close", n.name)
+
+					continue
+				}
+
+				open = append(open, conn)
+			}
+
+			pool.conns = open
+		}
+
+		count.MarkDistributionSuffix("pool_waiters", float64(len(pool.waiters)), n.name)
+		pool.mu.Unlock()
+
+		for _, w := range expired {
+			count.IncrSyncSuffix("pool_wait_timeout", n.name)
+			w.fail()
+		}
+	}
+}
+
+// ConnPoolStats returns connection pool stats summed per app and
+// endpoint across instances.
+func (l *Loop) ConnPoolStats() []ConnPoolStats {
+	type key struct{ app, endpoint string }
+
+	byKey := map[key]*ConnPoolStats{}
+	waits := map[key]*latencyStats{}
+
+	for _, n := range l.nodes {
+		n.poolsMu.Lock()
+
+		for endpoint, pool := range n.pools {
+			k := key{n.App.Name, endpoint}
+
+			s, ok := byKey[k]
+			if !ok {
+				s = &ConnPoolStats{App: n.App.Name, Endpoint: endpoint}
+				byKey[k] = s
+				waits[k] = &latencyStats{}
+			}
+
+			pool.mu.Lock()
+			s.Connections += len(pool.conns)
+			s.Connects += pool.connects
+			s.TLSHandshake += pool.handshakes
+			s.Waited += pool.waited
+			s.WaitTimeouts += pool.timeouts
+			s.Rejected += pool.rejected
+			s.MaxWaiters = max(s.MaxWaiters, pool.maxWaiters)
+
+			waits[k].merge(&pool.waitMs)
+			pool.mu.Unlock()
+		}
+
+		n.poolsMu.Unlock()
+	}
+
+	res := make([]ConnPoolStats, 0, len(byKey))
+
+	for k, s := range byKey {
+		s.WaitMs = waits[k].summary()
+		res = append(res, *s)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].App != res[j].App {
+			return res[i].App < res[j].App
+		}
+
+		return res[i].Endpoint < res[j].Endpoint
+	})
+
+	return res
+}
@@ -0,0 +1,139 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+)
+
+// runPooled runs a frontend whose instances keep a pool of pool.MaxSize
+// connections to a slow backend and returns the pool stats.
+func runPooled(t *testing.T, pool *PoolConf) ConnPoolStats {
+	t.Helper()
+	initTest()
+
+	loop := NewLoop()
+
+	backendConf := AppConf{
+		Name:      "poolBackend",
+		Size:      2,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(5, 8)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "poolBackend", App: &backendConf}, loop)
+
+	frontendConf := AppConf{
+		Name: "poolFrontend",
+		Size: 1,
+		Stages: []*StageConf{{
+			LocalWork:   UniformCDF(1, 2),
+			RemoteCalls: []*RemoteCall{{Endpoint: "poolBackend"}},
+		}},
+		ReplyLen:    UniformCDF(100, 200),
+		Resources:   lightResourceConfig(),
+		Connections: pool,
+	}
+
+	MakeLB(&LbConf{Name: "poolFrontend", App: &frontendConf}, loop)
+
+	sourceConf := makeTestSourceConf("poolSource", 1, "poolFrontend", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.Run(150)
+
+	stats := loop.ConnPoolStats()
+	if len(stats) != 1 {
+		t.Fatalf("Expected one pool, got %v", stats)
+	}
+
+	t.Logf("%+v", stats[0])
+
+	return stats[0]
+}
+
+// TestConnectionPoolExhaustion checks a small pool makes calls wait and
+// time out, while a multiplexed pool of the same size does not.
+func TestConnectionPoolExhaustion(t *testing.T) {
+	small := runPooled(t, &PoolConf{
+		MaxSize:       2,
+		ConnectMs:     UniformCDF(1, 2),
+		TLS:           true,
+		TLSMs:         UniformCDF(2, 3),
+		TLSCPU:        UniformCDF(0.01, 0.02),
+		WaitTimeoutMs: 20,
+	})
+
+	if small.Connects != 2 || small.TLSHandshake != 2 {
+		t.Errorf("Expected 2 connections each with a handshake, got %d/%d", small.Connects, small.TLSHandshake)
+	}
+
+	if small.Waited == 0 || small.WaitTimeouts == 0 {
+		t.Errorf("Expected waits and wait timeouts, got %d/%d", small.Waited, small.WaitTimeouts)
+	}
+
+	muxed := runPooled(t, &PoolConf{
+		MaxSize:     2,
+		ConnectMs:   UniformCDF(1, 2),
+		Multiplexed: true,
+	})
+
+	if muxed.Waited != 0 {
+		t.Errorf("Expected no waits on a multiplexed pool, got %d", muxed.Waited)
+	}
+}
+
+// TestConnectionPoolDefaultSize checks a pool with no MaxSize still
+// opens a connection rather than making every call wait.
+func TestConnectionPoolDefaultSize(t *testing.T) {
+	stats := runPooled(t, &PoolConf{Multiplexed: true})
+
+	if stats.Connects != defaultPoolSize || stats.WaitTimeouts != 0 {
+		t.Errorf("Expected one connection and no wait timeouts, got %+v", stats)
+	}
+}
+
+// TestConnPoolRestart checks a TLS handshake's CPU goes on the cores
+// when the caller has them and a restart fails the calls waiting for a
+// connection.
+func TestConnPoolRestart(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+	loop.time = loopStartMs
+
+	backendConf := AppConf{
+		Name:     "restartBackend",
+		Size:     1,
+		Stages:   []*StageConf{{LocalWork: UniformCDF(1, 2)}},
+		ReplyLen: UniformCDF(100, 200),
+	}
+
+	lb := MakeLB(&LbConf{Name: "restartBackend", App: &backendConf}, loop)
+
+	caller := &node{name: "restartCaller", loop: loop, App: &AppConf{
+		Name:        "restartCaller",
+		Connections: &PoolConf{TLS: true, TLSCPU: UniformCDF(2, 2)},
+	}}
+	caller.cores = newPSCPU(1)
+	caller.initCallMap()
+
+	rc := &RemoteCall{Endpoint: "restartBackend"}
+	statuses := []uint64{}
+
+	for range 2 {
+		c := &Call{caller: caller, Wakeup: loopStartMs}
+		caller.sendPooled(rc, c, lb, func(_ *node, r *Reply) { statuses = append(statuses, r.status) })
+	}
+
+	if caller.cores.runQueue() != 1 {
+		t.Errorf("Expected the handshake on the cores, got %d jobs", caller.cores.runQueue())
+	}
+
+	caller.fullOOMCleanup()
+
+	if len(statuses) != 1 || statuses[0] != 503 {
+		t.Errorf("Expected the waiting call failed by the restart, got %v", statuses)
+	}
+}
@@ -0,0 +1,127 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"math"
+	"sync"
+
+	count "github.com/jayalane/go-counter"
+)
+
+const cpuEpsilon = 1e-9 // CPU ms left that counts as done
+
+// cpuJob is one task's CPU demand still to be served.
+type cpuJob struct {
+	remaining float64      // CPU ms left
+	extra     Milliseconds // added wait once the CPU work is done
+	task      *Task        // nil for work that isn't a task's, like a TLS handshake
+}
+
+// psCPU is a processor sharing CPU: the running jobs share the cores
+// evenly, no job getting more than one core.
+type psCPU struct {
+	mu    sync.Mutex
+	cores float64
+	jobs  []*cpuJob
+	busy  float64 // cores used in the last ms
+}
+
+// newPSCPU returns a CPU with the given cores, or nil for none.
+func newPSCPU(cores float64) *psCPU {
+	if cores <= 0 {
+		return nil
+	}
+
+	return &psCPU{cores: cores}
+}
+
+// run adds a job to share the cores.
+func (c *psCPU) run(job *cpuJob) {
+	c.mu.Lock()
+	c.jobs = append(c.jobs, job)
+	c.mu.Unlock()
+}
+
+// advance serves dt ms of CPU and returns the jobs that finished.
+func (c *psCPU) advance(dt float64) []*cpuJob {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.jobs) == 0 {
+		c.busy = 0
+
+		return nil
+	}
+
+	share := math.Min(1, c.cores/float64(len(c.jobs))) * dt
+	c.busy = math.Min(c.cores, float64(len(c.jobs)))
+
+	var done []*cpuJob
+
+	running := c.jobs[:0]
+
+	for _, job := range c.jobs {
+		job.remaining -= share
+		if job.remaining <= cpuEpsilon {
+			done = append(done, job)
+
+			continue
+		}
+
+		running = append(running, job)
+	}
+
+	c.jobs = running
+
+	return done
+}
+
+// utilization is the fraction of cores busy in the last ms.
+func (c *psCPU) utilization() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.busy / c.cores
+}
+
+// runQueue is the number of jobs sharing the cores.
+func (c *psCPU) runQueue() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.jobs)
+}
+
+// clear drops all jobs, as when the container restarts.
+func (c *psCPU) clear() {
+	c.mu.Lock()
+	c.jobs = nil
+	c.busy = 0
+	c.mu.Unlock()
+}
+
+// advanceCPU serves the node's CPU for this ms and readies the tasks
+// whose work is done.
+func (n *node) advanceCPU() {
+	if n.cores == nil || n.isFrozen() {
+		return
+	}
+
+	now := Milliseconds(n.loop.GetTime())
+
+	n.abortCancelledJobs()
+
+	for _, job := range n.cores.advance(1) {
+		if job.task == nil {
+			continue
+		}
+
+		job.task.wakeup = now + job.extra
+		n.addTask(job.task)
+	}
+
+	count.MarkDistributionSuffix("node_cpu_run_queue", float64(n.cores.runQueue()), n.name)
+}
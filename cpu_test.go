@@ -0,0 +1,86 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+)
+
+// TestProcessorSharing checks jobs beyond the cores share them.
+func TestProcessorSharing(t *testing.T) {
+	cpu := newPSCPU(2)
+
+	finished := map[int]int{}
+
+	for i := range 4 {
+		cpu.run(&cpuJob{remaining: 2, task: &Task{reqID: i}})
+	}
+
+	for tick := 1; tick <= 5; tick++ {
+		for _, job := range cpu.advance(1) {
+			finished[job.task.reqID] = tick
+		}
+
+		if tick == 1 && cpu.utilization() != 1 {
+			t.Errorf("Expected both cores busy, got %f", cpu.utilization())
+		}
+	}
+
+	// 4 jobs on 2 cores each get half a core, so 2ms of work takes 4ms
+	for i := range 4 {
+		if finished[i] != 4 {
+			t.Errorf("Expected job %d done at 4ms, got %v", i, finished)
+		}
+	}
+
+	cpu.run(&cpuJob{remaining: 2, task: &Task{}})
+
+	if len(cpu.advance(1)) != 0 || len(cpu.advance(1)) != 1 || cpu.utilization() != 0.5 {
+		t.Error("Expected a lone job to get a whole core")
+	}
+}
+
+// TestCoresContention feeds the same jobs to one core and to eight
+// and checks the times against processor sharing worked out by hand:
+// 4 jobs of 5ms arriving a ms apart.  Eight cores run each in 5ms;
+// one core can't finish the 20ms of work before 20ms (a little later,
+// as a job done mid ms leaves the rest of its share idle), and
+// sharing it stretches every job past its 5ms.
+func TestCoresContention(t *testing.T) {
+	sojourns := func(cores float64) (map[int]int, int) {
+		cpu := newPSCPU(cores)
+		done := map[int]int{}
+		last := 0
+
+		for tick := 0; len(done) < 4 && tick < 100; tick++ {
+			if tick < 4 {
+				cpu.run(&cpuJob{remaining: 5, task: &Task{reqID: tick}})
+			}
+
+			for _, job := range cpu.advance(1) {
+				done[job.task.reqID] = tick + 1 - job.task.reqID
+				last = tick + 1
+			}
+		}
+
+		return done, last
+	}
+
+	eight, _ := sojourns(8)
+	for i := range 4 {
+		if eight[i] != 5 {
+			t.Errorf("Expected each job to take 5ms on eight cores, got %v", eight)
+		}
+	}
+
+	one, last := sojourns(1)
+	if last < 20 || last > 22 {
+		t.Errorf("Expected one core to finish all 20ms of work at about 20ms, got %d", last)
+	}
+
+	for i := range 4 {
+		if one[i] <= 5 {
+			t.Errorf("Expected every job to be stretched on one core, got %v", one)
+		}
+	}
+}
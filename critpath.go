@@ -0,0 +1,302 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// critical path analysis of the traced requests: what each service
+// adds to end-to-end latency, walked back from the end of each trace.
+
+// critBuckets are the latency percentile ranges reported.
+var critBuckets = []struct {
+	name   string
+	lo, hi float64
+}{
+	{"p0-50", 0, 0.5},     //nolint:mnd
+	{"p50-90", 0.5, 0.9},  //nolint:mnd
+	{"p90-99", 0.9, 0.99}, //nolint:mnd
+	{"p99+", 0.99, 1},     //nolint:mnd
+}
+
+// ServicePathTime is one service's share of the critical path, mean
+// ms per request.  Work, Queue and Network add up across services to
+// the end-to-end latency; Children is the service's wait on its
+// critical downstream calls, which is those services' time again.
+type ServicePathTime struct {
+	Service  string
+	Work     float64 // local work, stages and handling
+	Queue    float64 // waiting for a worker
+	Network  float64 // getting the call to the service and the reply back
+	Children float64 // waiting on downstream calls
+}
+
+// Total is the service's own time on the critical path.
+func (s ServicePathTime) Total() float64 {
+	return s.Work + s.Queue + s.Network
+}
+
+// CriticalPathBucket is the critical path for the requests in one
+// range of latency percentiles.
+type CriticalPathBucket struct {
+	Name     string // e.g. "p90-99"
+	Traces   int
+	MeanMs   float64 // mean end-to-end latency
+	Services []ServicePathTime
+}
+
+// CriticalPathReport is the critical path of the traced requests from
+// one source to its endpoint.
+type CriticalPathReport struct {
+	Source   string
+	Endpoint string
+	Traces   int
+	Buckets  []CriticalPathBucket
+}
+
+// pathTrace is one trace's critical path.
+type pathTrace struct {
+	latency  float64
+	services map[string]*ServicePathTime
+}
+
+func (p *pathTrace) service(name string) *ServicePathTime {
+	s, ok := p.services[name]
+	if !ok {
+		s = &ServicePathTime{Service: name}
+		p.services[name] = s
+	}
+
+	return s
+}
+
+// spanTree indexes one trace's spans by parent.
+type spanTree struct {
+	children map[uint64][]*Span
+}
+
+// walk attributes span from start to end, backwards from end, taking
+// at each point the child finishing last before it.
+func (p *pathTrace) walk(tree *spanTree, s *Span, start, end Milliseconds) {
+	kids := tree.children[s.SpanID]
+	t := end
+
+	for i := len(kids) - 1; i >= 0 && t > start; i-- {
+		k := kids[i]
+		if k.End > t || k.End <= start {
+			continue
+		}
+
+		p.self(s, float64(t-k.End))
+
+		kStart := Milliseconds(math.Max(float64(k.Start), float64(start)))
+		if s.Tags["span.kind"] == "server" && k.Tags["span.kind"] == "client" {
+			p.service(s.Service).Children += float64(k.End - kStart)
+		}
+
+		p.walk(tree, k, kStart, k.End)
+		t = kStart
+	}
+
+	p.self(s, float64(t-start))
+}
+
+// self attributes ms of a span's own time: a client span's to the
+// network of the service called (an LB's calls go to instances of its
+// app), a queue span's to queueing and the rest to work.
+func (p *pathTrace) self(s *Span, ms float64) {
+	if ms <= 0 {
+		return
+	}
+
+	switch {
+	case s.Tags["span.kind"] == "client" && strings.HasSuffix(s.Service, "-lb"):
+		p.service(strings.TrimSuffix(s.Service, "-lb")).Network += ms
+	case s.Tags["span.kind"] == "client":
+		p.service(s.Tags["peer.service"]).Network += ms
+	case s.Operation == "queue":
+		p.service(s.Service).Queue += ms
+	default:
+		p.service(s.Service).Work += ms
+	}
+}
+
+// CriticalPath returns the critical path of the finished traced
+// requests per source and endpoint, by latency percentile.
+func (l *Loop) CriticalPath() []CriticalPathReport {
+	byTrace := map[uint64][]*Span{}
+
+	spans := l.Spans()
+	for i := range spans {
+		s := &spans[i]
+		if !s.ended {
+			continue
+		}
+
+		byTrace[s.TraceID] = append(byTrace[s.TraceID], s)
+	}
+
+	type key struct{ source, endpoint string }
+
+	traces := map[key][]*pathTrace{}
+
+	for _, ss := range byTrace {
+		tree := &spanTree{children: map[uint64][]*Span{}}
+		for _, s := range ss {
+			tree.children[s.ParentID] = append(tree.children[s.ParentID], s)
+		}
+
+		roots := tree.children[0]
+		if len(roots) == 0 {
+			continue
+		}
+
+		// retries at the source are more roots; the request runs from
+		// the first start to the last end
+		root := &Span{Service: roots[0].Service, Start: roots[0].Start, End: roots[0].End,
+			Tags: map[string]string{"span.kind": "client", "peer.service": roots[0].Tags["peer.service"]}}
+
+		for _, r := range roots {
+			root.Start = Milliseconds(math.Min(float64(root.Start), float64(r.Start)))
+			root.End = Milliseconds(math.Max(float64(root.End), float64(r.End)))
+		}
+
+		for _, kids := range tree.children {
+			sort.Slice(kids, func(i, j int) bool {
+				if kids[i].End != kids[j].End {
+					return kids[i].End < kids[j].End
+				}
+
+				return kids[i].SpanID < kids[j].SpanID
+			})
+		}
+
+		p := &pathTrace{latency: float64(root.End - root.Start), services: map[string]*ServicePathTime{}}
+		p.walk(tree, root, root.Start, root.End)
+
+		k := key{root.Service, root.Tags["peer.service"]}
+		traces[k] = append(traces[k], p)
+	}
+
+	res := make([]CriticalPathReport, 0, len(traces))
+
+	for k, ts := range traces {
+		sort.Slice(ts, func(i, j int) bool { return ts[i].latency < ts[j].latency })
+
+		rep := CriticalPathReport{Source: k.source, Endpoint: k.endpoint, Traces: len(ts)}
+
+		for _, b := range critBuckets {
+			lo := int(math.Floor(b.lo * float64(len(ts))))
+			hi := int(math.Floor(b.hi * float64(len(ts))))
+
+			if b.hi >= 1 {
+				hi = len(ts)
+			}
+
+			if hi <= lo {
+				continue
+			}
+
+			rep.Buckets = append(rep.Buckets, critBucket(b.name, ts[lo:hi]))
+		}
+
+		res = append(res, rep)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Source != res[j].Source {
+			return res[i].Source < res[j].Source
+		}
+
+		return res[i].Endpoint < res[j].Endpoint
+	})
+
+	return res
+}
+
+// critBucket averages the critical paths of ts.
+func critBucket(name string, ts []*pathTrace) CriticalPathBucket {
+	b := CriticalPathBucket{Name: name, Traces: len(ts)}
+	sums := map[string]*ServicePathTime{}
+
+	for _, t := range ts {
+		b.MeanMs += t.latency
+
+		for name, s := range t.services {
+			sum, ok := sums[name]
+			if !ok {
+				sum = &ServicePathTime{Service: name}
+				sums[name] = sum
+			}
+
+			sum.Work += s.Work
+			sum.Queue += s.Queue
+			sum.Network += s.Network
+			sum.Children += s.Children
+		}
+	}
+
+	n := float64(len(ts))
+	b.MeanMs /= n
+
+	for _, s := range sums {
+		b.Services = append(b.Services, ServicePathTime{
+			Service:  s.Service,
+			Work:     s.Work / n,
+			Queue:    s.Queue / n,
+			Network:  s.Network / n,
+			Children: s.Children / n,
+		})
+	}
+
+	sort.Slice(b.Services, func(i, j int) bool {
+		if b.Services[i].Total() != b.Services[j].Total() {
+			return b.Services[i].Total() > b.Services[j].Total()
+		}
+
+		return b.Services[i].Service < b.Services[j].Service
+	})
+
+	return b
+}
+
+// WriteCriticalPathReport writes the critical path per source and
+// endpoint, the services adding most to each percentile range first.
+func (l *Loop) WriteCriticalPathReport(w io.Writer) {
+	for _, rep := range l.CriticalPath() {
+		fmt.Fprintf(w, "critical path %s -> %s: %d traces\n", rep.Source, rep.Endpoint, rep.Traces)
+
+		for _, b := range rep.Buckets {
+			fmt.Fprintf(w, "  %s: n=%d mean=%.1fms\n", b.Name, b.Traces, b.MeanMs)
+
+			width := critNameWidth(b.Services)
+
+			for _, s := range b.Services {
+				share := 0.0
+				if b.MeanMs > 0 {
+					share = 100 * s.Total() / b.MeanMs //nolint:mnd
+				}
+
+				fmt.Fprintf(w, "    %-*s %6.1fms (%4.1f%%) work=%.1f queue=%.1f network=%.1f children=%.1f\n",
+					width, s.Service, s.Total(), share, s.Work, s.Queue, s.Network, s.Children)
+			}
+		}
+	}
+}
+
+// critNameWidth is the width to line up the service names in.
+func critNameWidth(ss []ServicePathTime) int {
+	w := 0
+	for _, s := range ss {
+		w = max(w, len(s.Service))
+	}
+
+	return w
+}
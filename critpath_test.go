@@ -0,0 +1,97 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+// TestCriticalPath has a front await a slow back and checks the back
+// is what the critical path blames, with the parts adding up to the
+// end-to-end latency.
+func TestCriticalPath(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+	loop.SetTracing(&TraceConf{SampleRate: 1})
+
+	backConf := AppConf{
+		Name:      "critBack",
+		Size:      2,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(20, 30)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "critBack", App: &backConf}, loop)
+
+	frontConf := AppConf{
+		Name: "critFront",
+		Size: 2,
+		Stages: []*StageConf{{
+			LocalWork:    UniformCDF(1, 2),
+			RemoteCalls:  []*RemoteCall{{Endpoint: "critBack"}},
+			AwaitReplies: true,
+		}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "critFront", App: &frontConf}, loop)
+
+	sourceConf := makeTestSourceConf("critSource", 0.05, "critFront", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.Run(400)
+
+	reps := loop.CriticalPath()
+	if len(reps) != 1 || reps[0].Endpoint != "critFront" || reps[0].Source != "critSource" {
+		t.Fatalf("Expected one report for critSource -> critFront, got %+v", reps)
+	}
+
+	rep := reps[0]
+	if rep.Traces < 5 || len(rep.Buckets) == 0 {
+		t.Fatalf("Expected a few traces in buckets, got %+v", rep)
+	}
+
+	for _, b := range rep.Buckets {
+		if b.MeanMs < 20 {
+			t.Errorf("%s: expected the front to wait on the back, mean %.1fms", b.Name, b.MeanMs)
+		}
+
+		if b.Services[0].Service != "critBack" || b.Services[0].Work < 20 {
+			t.Errorf("%s: expected critBack's work to lead the critical path, got %+v", b.Name, b.Services)
+		}
+
+		sum := 0.0
+		children := 0.0
+
+		for _, s := range b.Services {
+			sum += s.Total()
+
+			if s.Service == "critFront" {
+				children = s.Children
+			}
+		}
+
+		if math.Abs(sum-b.MeanMs) > 0.01 {
+			t.Errorf("%s: expected the parts to add up to %.2fms, got %.2fms", b.Name, b.MeanMs, sum)
+		}
+
+		if children < b.Services[0].Work {
+			t.Errorf("%s: expected critFront to wait at least critBack's work, got %.1fms", b.Name, children)
+		}
+	}
+
+	var buf bytes.Buffer
+
+	loop.WriteCriticalPathReport(&buf)
+	t.Log(buf.String())
+
+	if !strings.Contains(buf.String(), "critical path critSource -> critFront") {
+		t.Errorf("Expected the report to name the path, got %s", buf.String())
+	}
+}
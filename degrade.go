@@ -0,0 +1,94 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"fmt"
+)
+
+// Degradation makes an instance slow-but-alive instead of dead.
+// Multipliers of 0 are treated as 1.
+type Degradation struct {
+	WorkMultiplier float64 // multiplier on each stage's LocalWork
+	CPUMultiplier  float64 // multiplier on CPU consumed per local work
+	ErrorRate      float64 // 0.0 to 1.0, extra chance of a 503
+}
+
+// String describes the degradation for the event log.
+func (d *Degradation) String() string {
+	return fmt.Sprintf("work x%.1f cpu x%.1f err %.2f",
+		multiplierOrOne(d.WorkMultiplier), multiplierOrOne(d.CPUMultiplier), d.ErrorRate)
+}
+
+// multiplierOrOne treats an unset multiplier as no change.
+func multiplierOrOne(m float64) float64 {
+	if m <= 0 {
+		return 1
+	}
+
+	return m
+}
+
+// Degrade statically degrades one instance of the LB's pool.
+// Pass nil to clear it.
+func (lb *LB) Degrade(instance int, d *Degradation) {
+	if instance < 0 || instance >= len(lb.appInstances) {
+		ml.La(lb.n.name+": No instance to degrade", instance)
+
+		return
+	}
+
+	n := lb.appInstances[instance]
+
+	n.faultsMu.Lock()
+	n.degradation = d
+	n.faultsMu.Unlock()
+}
+
+// degradations returns the static degradation plus any scheduled
+// FaultDegrade ones.  Caller must hold faultsMu.
+func (n *node) degradations() []*Degradation {
+	var res []*Degradation
+
+	if n.degradation != nil {
+		res = append(res, n.degradation)
+	}
+
+	for _, f := range n.activeFaults {
+		if f.Kind == FaultDegrade && f.Degradation != nil {
+			res = append(res, f.Degradation)
+		}
+	}
+
+	return res
+}
+
+// workMultiplier returns the combined LocalWork multiplier.
+func (n *node) workMultiplier() float64 {
+	n.faultsMu.RLock()
+	defer n.faultsMu.RUnlock()
+
+	m := 1.0
+
+	for _, d := range n.degradations() {
+		m *= multiplierOrOne(d.WorkMultiplier)
+	}
+
+	return m
+}
+
+// cpuMultiplier returns the combined CPU cost multiplier.
+func (n *node) cpuMultiplier() float64 {
+	n.faultsMu.RLock()
+	defer n.faultsMu.RUnlock()
+
+	m := 1.0
+
+	for _, d := range n.degradations() {
+		m *= multiplierOrOne(d.CPUMultiplier)
+	}
+
+	return m
+}
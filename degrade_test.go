@@ -0,0 +1,111 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"os"
+	"testing"
+)
+
+// runGrayFailure runs a pool with one instance 10x slower and returns
+// the share of calls the LB sent to the slow instance.
+func runGrayFailure(t *testing.T, strategy LbStrategy) float64 {
+	t.Helper()
+
+	initTest()
+
+	loop := NewLoop()
+
+	appConf := AppConf{
+		Name:      "grayServer",
+		Size:      4,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 3)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	lbConf := LbConf{Name: "grayServer", App: &appConf, Strategy: strategy}
+	lb := MakeLB(&lbConf, loop)
+	lb.Degrade(0, &Degradation{WorkMultiplier: 10})
+	lb.Degrade(int(appConf.Size), &Degradation{WorkMultiplier: 10}) // no such instance
+
+	sourceConf := makeTestSourceConf("graySource", 1, "grayServer", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.Run(200)
+	loop.WriteInstanceReport(os.Stdout)
+
+	total := 0
+	stats := lb.InstanceStats()
+
+	for _, is := range stats {
+		total += is.Sent
+	}
+
+	if !stats[0].Degraded {
+		t.Error("Expected instance 0 to report as degraded")
+	}
+
+	if total == 0 {
+		t.Fatal("Expected the LB to send calls")
+	}
+
+	return float64(stats[0].Sent) / float64(total)
+}
+
+// TestGrayFailureStrategies checks least-outstanding routes around a
+// slow instance that round robin keeps feeding.
+func TestGrayFailureStrategies(t *testing.T) {
+	rr := runGrayFailure(t, LbRoundRobin)
+	lo := runGrayFailure(t, LbLeastOutstanding)
+
+	t.Logf("slow instance share round_robin=%.3f least_outstanding=%.3f", rr, lo)
+
+	if lo >= rr {
+		t.Errorf("Expected least_outstanding to send less to the slow instance (%.3f >= %.3f)", lo, rr)
+	}
+}
+
+// TestKillLeastOutstanding checks the calls lost with a killed
+// instance don't stay outstanding, so least-outstanding sends to it
+// again once it is back.
+func TestKillLeastOutstanding(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+
+	appConf := AppConf{
+		Name:      "killLeast",
+		Size:      2,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 3)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	lb := MakeLB(&LbConf{Name: "killLeast", App: &appConf, Strategy: LbLeastOutstanding}, loop)
+
+	sourceConf := makeTestSourceConf("killLeastSource", 1, "killLeast", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.AddFault(&Fault{Kind: FaultKill, Target: "killLeast-0", Start: 20, Duration: 20})
+	loop.Run(400)
+
+	stats := lb.InstanceStats()
+	t.Logf("instance stats %+v", stats)
+
+	if stats[0].Sent*3 < stats[1].Sent {
+		t.Errorf("Expected the recovered instance to get its share, got %d vs %d", stats[0].Sent, stats[1].Sent)
+	}
+
+	waiting := map[string]int64{}
+
+	for _, pc := range lb.n.pendingCallMap {
+		waiting[pc.callee.name]++
+	}
+
+	for _, is := range stats {
+		if is.Outstanding != waiting[is.Name] {
+			t.Errorf("Expected only the calls still out outstanding, got %d for %d", is.Outstanding, waiting[is.Name])
+		}
+	}
+}
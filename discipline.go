@@ -0,0 +1,257 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"math"
+)
+
+const (
+	defaultCoDelTarget   = 5.0   // ms
+	defaultCoDelInterval = 100.0 // ms
+)
+
+// QueueDiscipline is the order calls leave a node's accept queue in.
+type QueueDiscipline int
+
+const (
+	// QueueFIFO serves the oldest call first (the default).
+	QueueFIFO QueueDiscipline = iota
+	// QueueLIFO serves the newest call first, so under overload some
+	// calls still finish before their callers give up.
+	QueueLIFO
+	// QueuePriority serves the highest Call.Priority first, FIFO
+	// within a priority.
+	QueuePriority
+	// QueueWFQ shares the workers across calling apps and sources in
+	// proportion to QueueConf.Weights.
+	QueueWFQ
+	// QueueCoDel serves FIFO but sheds calls once the time spent
+	// queued has stayed above Target for an Interval.
+	QueueCoDel
+	// QueueAdaptiveLIFO serves FIFO until the queue has not been empty
+	// for an Interval, then switches to LIFO and sheds calls queued
+	// longer than Target.
+	QueueAdaptiveLIFO
+)
+
+func (d QueueDiscipline) String() string {
+	switch d {
+	case QueueFIFO:
+		return "fifo"
+	case QueueLIFO:
+		return "lifo"
+	case QueuePriority:
+		return "priority"
+	case QueueWFQ:
+		return "wfq"
+	case QueueCoDel:
+		return "codel"
+	case QueueAdaptiveLIFO:
+		return "adaptive-lifo"
+	}
+
+	return "unknown"
+}
+
+// QueueConf configures the accept queue in front of an app's workers.
+// It only applies when the app has Workers and an AcceptQueue; with
+// no worker pool calls are not queued for admission at all.
+type QueueConf struct {
+	Discipline QueueDiscipline
+	Target     Milliseconds       // CoDel target / adaptive LIFO timeout when overloaded (0 = 5ms)
+	Interval   Milliseconds       // CoDel interval / adaptive LIFO overload window and timeout (0 = 100ms)
+	Weights    map[string]float64 // WFQ weight per calling app or source (missing = 1)
+}
+
+// admissionQueue holds the calls waiting for a worker.
+type admissionQueue struct {
+	conf  *QueueConf
+	calls []*Call
+
+	virtual float64            // WFQ virtual time
+	lastTag map[string]float64 // WFQ last finish tag per caller
+
+	firstAbove Milliseconds // CoDel: when sojourn first stayed above target
+	dropping   bool
+	drops      int
+	dropNext   Milliseconds
+
+	lastEmpty Milliseconds // adaptive LIFO: when the queue was last empty
+}
+
+func (q *admissionQueue) len() int {
+	return len(q.calls)
+}
+
+func (q *admissionQueue) discipline() QueueDiscipline {
+	if q.conf == nil {
+		return QueueFIFO
+	}
+
+	return q.conf.Discipline
+}
+
+func (q *admissionQueue) target() Milliseconds {
+	if q.conf == nil || q.conf.Target <= 0 {
+		return defaultCoDelTarget
+	}
+
+	return q.conf.Target
+}
+
+func (q *admissionQueue) interval() Milliseconds {
+	if q.conf == nil || q.conf.Interval <= 0 {
+		return defaultCoDelInterval
+	}
+
+	return q.conf.Interval
+}
+
+// push adds a call that reached the queue at now.
+func (q *admissionQueue) push(c *Call, now Milliseconds) {
+	if len(q.calls) == 0 {
+		q.lastEmpty = now
+	}
+
+	if q.discipline() == QueueWFQ {
+		weight := 1.0
+		if w, ok := q.conf.Weights[c.origin]; ok && w > 0 {
+			weight = w
+		}
+
+		if q.lastTag == nil {
+			q.lastTag = make(map[string]float64)
+		}
+
+		c.queueTag = math.Max(q.virtual, q.lastTag[c.origin]) + 1/weight
+		q.lastTag[c.origin] = c.queueTag
+	}
+
+	q.calls = append(q.calls, c)
+}
+
+// pop returns the next call to give a worker, or nil, along with any
+// calls the discipline shed on the way.
+func (q *admissionQueue) pop(now Milliseconds) (*Call, []*Call) {
+	var shed []*Call
+
+	for len(q.calls) > 0 {
+		overloaded := now-q.lastEmpty > q.interval()
+		i := q.next(overloaded)
+		c := q.calls[i]
+		q.calls = append(q.calls[:i], q.calls[i+1:]...)
+
+		if len(q.calls) == 0 {
+			q.lastEmpty = now
+		}
+
+		sojourn := now - c.queuedAt
+
+		switch q.discipline() {
+		case QueueCoDel:
+			if q.codelDrop(sojourn, now) {
+				shed = append(shed, c)
+
+				continue
+			}
+		case QueueAdaptiveLIFO:
+			limit := q.interval()
+			if overloaded {
+				limit = q.target()
+			}
+
+			if sojourn > limit {
+				shed = append(shed, c)
+
+				continue
+			}
+		case QueueWFQ:
+			q.virtual = c.queueTag
+		case QueueFIFO, QueueLIFO, QueuePriority:
+		}
+
+		return c, shed
+	}
+
+	q.dropping = false
+	q.firstAbove = 0
+
+	return nil, shed
+}
+
+// next picks the index of the call to serve.
+func (q *admissionQueue) next(overloaded bool) int {
+	best := 0
+
+	switch q.discipline() {
+	case QueueLIFO:
+		best = len(q.calls) - 1
+	case QueueAdaptiveLIFO:
+		if overloaded {
+			best = len(q.calls) - 1
+		}
+	case QueuePriority:
+		for i, c := range q.calls {
+			if c.Priority > q.calls[best].Priority {
+				best = i
+			}
+		}
+	case QueueWFQ:
+		for i, c := range q.calls {
+			if c.queueTag < q.calls[best].queueTag {
+				best = i
+			}
+		}
+	case QueueFIFO, QueueCoDel:
+	}
+
+	return best
+}
+
+// codelDrop is the CoDel control law (RFC 8289) run as a call leaves
+// the queue after waiting sojourn ms.
+func (q *admissionQueue) codelDrop(sojourn Milliseconds, now Milliseconds) bool {
+	if sojourn < q.target() {
+		q.firstAbove = 0
+		q.dropping = false
+
+		return false
+	}
+
+	if q.firstAbove == 0 {
+		q.firstAbove = now + q.interval()
+
+		return false
+	}
+
+	if now < q.firstAbove {
+		return false
+	}
+
+	if !q.dropping {
+		q.dropping = true
+		q.drops = 1
+		q.dropNext = now + q.interval()
+
+		return true
+	}
+
+	if now >= q.dropNext {
+		q.drops++
+		q.dropNext += q.interval() / Milliseconds(math.Sqrt(float64(q.drops)))
+
+		return true
+	}
+
+	return false
+}
+
+// clear drops everything queued.
+func (q *admissionQueue) clear() {
+	q.calls = nil
+	q.dropping = false
+	q.firstAbove = 0
+}
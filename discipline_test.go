@@ -0,0 +1,103 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+)
+
+// runQueued overloads a two worker server with the given sources and
+// returns its worker stats and each source's latency.
+func runQueued(t *testing.T, queue *QueueConf, sources map[string]SourceConf) (WorkerStats, map[string]LatencySummary) {
+	t.Helper()
+	initTest()
+
+	loop := NewLoop()
+
+	appConf := AppConf{
+		Name:        "queueServer",
+		Size:        1,
+		Stages:      []*StageConf{{LocalWork: UniformCDF(8, 12)}},
+		ReplyLen:    UniformCDF(100, 200),
+		Resources:   lightResourceConfig(),
+		Workers:     2,
+		AcceptQueue: 50,
+		Queue:       queue,
+	}
+
+	MakeLB(&LbConf{Name: "queueServer", App: &appConf}, loop)
+
+	made := map[string]*Source{}
+
+	for name, conf := range sources {
+		made[name] = MakeSource(&conf, loop)
+	}
+
+	loop.Run(600)
+
+	latency := map[string]LatencySummary{}
+	for name, s := range made {
+		latency[name] = s.Latency()
+	}
+
+	stats := loop.WorkerStats()
+	if len(stats) != 1 {
+		t.Fatalf("Expected one worker pool, got %v", stats)
+	}
+
+	t.Logf("%v: shed=%d rejected=%d wait=%+v latency=%+v", queue.Discipline, stats[0].Shed,
+		stats[0].Rejected, stats[0].QueueWait, latency)
+
+	return stats[0], latency
+}
+
+// TestQueueDisciplines checks LIFO serves fresher calls than FIFO
+// under overload and the shedding disciplines shed.
+func TestQueueDisciplines(t *testing.T) {
+	sources := map[string]SourceConf{
+		"queueSource": makeTestSourceConf("queueSource", 0.4, "queueServer", 150.0),
+	}
+
+	fifo, _ := runQueued(t, &QueueConf{Discipline: QueueFIFO}, sources)
+	lifo, _ := runQueued(t, &QueueConf{Discipline: QueueLIFO}, sources)
+	codel, _ := runQueued(t, &QueueConf{Discipline: QueueCoDel, Target: 5, Interval: 20}, sources)
+	adaptive, _ := runQueued(t, &QueueConf{Discipline: QueueAdaptiveLIFO, Target: 10, Interval: 50}, sources)
+
+	if fifo.Shed != 0 || lifo.Shed != 0 {
+		t.Errorf("Expected FIFO and LIFO not to shed, got %d/%d", fifo.Shed, lifo.Shed)
+	}
+
+	if lifo.QueueWait.P50 >= fifo.QueueWait.P50 {
+		t.Errorf("Expected LIFO median wait below FIFO: %.1f vs %.1f", lifo.QueueWait.P50, fifo.QueueWait.P50)
+	}
+
+	if codel.Shed == 0 || adaptive.Shed == 0 {
+		t.Errorf("Expected CoDel and adaptive LIFO to shed, got %d/%d", codel.Shed, adaptive.Shed)
+	}
+}
+
+// TestQueueFairness checks priority and weighted fair queuing protect
+// a light caller from a heavy one.
+func TestQueueFairness(t *testing.T) {
+	light := makeTestSourceConf("lightSource", 0.05, "queueServer", 500.0)
+	heavy := makeTestSourceConf("heavySource", 0.4, "queueServer", 500.0)
+
+	_, fifo := runQueued(t, &QueueConf{Discipline: QueueFIFO},
+		map[string]SourceConf{"light": light, "heavy": heavy})
+
+	light.Priority = 1
+
+	_, prio := runQueued(t, &QueueConf{Discipline: QueuePriority},
+		map[string]SourceConf{"light": light, "heavy": heavy})
+
+	light.Priority = 0
+
+	_, wfq := runQueued(t, &QueueConf{Discipline: QueueWFQ},
+		map[string]SourceConf{"light": light, "heavy": heavy})
+
+	for name, latency := range map[string]map[string]LatencySummary{"priority": prio, "wfq": wfq} {
+		if latency["light"].Mean >= latency["heavy"].Mean || latency["light"].Mean >= fifo["light"].Mean {
+			t.Errorf("Expected %s to favour the light source: %+v vs fifo %+v", name, latency, fifo)
+		}
+	}
+}
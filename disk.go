@@ -0,0 +1,293 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+
+	count "github.com/jayalane/go-counter"
+)
+
+const defaultIOBytes = 4096.0
+
+// DiskConf configures a node's disk.  An I/O waits in the device
+// queue for a free slot and an IOPS token, then takes its latency
+// while its bytes share the device bandwidth.
+type DiskConf struct {
+	IOPS        float64  // operations started per second (0 = unlimited)
+	Bandwidth   float64  // bytes per ms shared by I/Os in flight (0 = unlimited)
+	Concurrency int      // I/Os in flight at once (0 = 1)
+	ReadMs      ModelCdf // device latency of a read
+	WriteMs     ModelCdf // device latency of a write (fsync included)
+	QueueLimit  int      // reject calls when this many I/Os wait (0 = unbounded)
+}
+
+// diskIO is one read or write.
+type diskIO struct {
+	write    bool
+	bytes    float64 // left to move
+	latency  Milliseconds
+	queuedAt Milliseconds
+	doneAt   Milliseconds // latency elapsed
+	done     func()
+}
+
+// diskState is a node's disk.
+type diskState struct {
+	mu       sync.Mutex
+	conf     *DiskConf
+	queue    []*diskIO
+	inFlight []*diskIO
+	tokens   float64
+	busy     float64 // utilization in the last ms
+
+	reads    int
+	writes   int
+	bytes    float64
+	rejected int
+	maxQueue int
+	wait     latencyStats
+	service  latencyStats
+}
+
+// DiskStats sums up the disks of one app across instances.
+type DiskStats struct {
+	App      string
+	Reads    int
+	Writes   int
+	Bytes    float64
+	Rejected int // calls refused with the disk queue full
+	MaxQueue int // longest device queue seen on any one instance
+	Wait     LatencySummary
+	Service  LatencySummary
+}
+
+// newDisk returns a disk for the config, or nil for none.
+func newDisk(conf *DiskConf) *diskState {
+	if conf == nil {
+		return nil
+	}
+
+	return &diskState{conf: conf}
+}
+
+func (d *diskState) concurrency() int {
+	if d.conf.Concurrency <= 0 {
+		return 1
+	}
+
+	return d.conf.Concurrency
+}
+
+// submit queues I/Os, calling done once all have finished.  It
+// returns false without queueing anything if the queue is full.
+func (d *diskState) submit(now Milliseconds, reads int, writes int, size ModelCdf, done func()) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conf.QueueLimit > 0 && len(d.queue)+reads+writes > d.conf.QueueLimit {
+		d.rejected++
+
+		return false
+	}
+
+	left := reads + writes
+	finish := func() {
+		left--
+		if left == 0 {
+			done()
+		}
+	}
+
+	for i := range reads + writes {
+		io := &diskIO{write: i >= reads, bytes: defaultIOBytes, queuedAt: now, done: finish}
+
+		if size != nil {
+			io.bytes = size(rand.Float64()) //nolint:gosec
+		}
+
+		latency := d.conf.ReadMs
+		if io.write {
+			latency = d.conf.WriteMs
+		}
+
+		if latency != nil {
+			io.latency = Milliseconds(latency(rand.Float64())) //nolint:gosec
+		}
+
+		d.queue = append(d.queue, io)
+	}
+
+	d.maxQueue = max(d.maxQueue, len(d.queue))
+
+	return true
+}
+
+// advance runs the device for dt ms and returns the callbacks of
+// calls whose I/O all finished.
+func (d *diskState) advance(now Milliseconds, dt float64) []func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// start queued I/Os while there are slots and IOPS tokens
+	if d.conf.IOPS > 0 {
+		perMs := d.conf.IOPS / msInSec
+		d.tokens = math.Min(d.tokens+perMs*dt, math.Max(1, perMs))
+	}
+
+	for len(d.queue) > 0 && len(d.inFlight) < d.concurrency() {
+		if d.conf.IOPS > 0 {
+			if d.tokens < 1 {
+				break
+			}
+
+			d.tokens--
+		}
+
+		io := d.queue[0]
+		d.queue = d.queue[1:]
+		io.doneAt = now + io.latency
+		d.inFlight = append(d.inFlight, io)
+		d.wait.add(float64(now-io.queuedAt), false)
+
+		if io.write {
+			d.writes++
+		} else {
+			d.reads++
+		}
+
+		d.bytes += io.bytes
+	}
+
+	d.busy = float64(len(d.inFlight)) / float64(d.concurrency())
+
+	// the I/Os in flight share the bandwidth evenly
+	share := math.Inf(1)
+	if d.conf.Bandwidth > 0 && len(d.inFlight) > 0 {
+		share = d.conf.Bandwidth * dt / float64(len(d.inFlight))
+	}
+
+	var done []func()
+
+	running := d.inFlight[:0]
+
+	for _, io := range d.inFlight {
+		io.bytes = math.Max(0, io.bytes-share)
+
+		if io.bytes > 0 || now < io.doneAt {
+			running = append(running, io)
+
+			continue
+		}
+
+		d.service.add(float64(now-io.queuedAt), false)
+		done = append(done, io.done)
+	}
+
+	d.inFlight = running
+
+	return done
+}
+
+// utilization is the share of device slots busy in the last ms.
+func (d *diskState) utilization() float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.busy
+}
+
+// clear drops all I/O, as when the container restarts.
+func (d *diskState) clear() {
+	d.mu.Lock()
+	d.queue = nil
+	d.inFlight = nil
+	d.busy = 0
+	d.mu.Unlock()
+}
+
+// startIO submits the stage's disk I/O for a task whose local work is
+// done, with or without cores, and queues the task again once the I/O
+// has finished.  It returns true if the task is not to run yet.
+func (n *node) startIO(t *Task) bool {
+	if n.disk == nil || t.ioDone || t.stage == nil || t.stage.DiskReads+t.stage.DiskWrites == 0 {
+		return false
+	}
+
+	t.ioDone = true
+
+	ok := n.disk.submit(Milliseconds(n.loop.GetTime()), t.stage.DiskReads, t.stage.DiskWrites, t.stage.IOBytes,
+		func() {
+			t.wakeup = Milliseconds(math.Max(float64(t.wakeup), n.loop.GetTime()))
+			n.addTask(t)
+		})
+	if ok {
+		return true
+	}
+
+	count.IncrSyncSuffix("node_disk_queue_full", n.name)
+	n.failCall(t.call, "Disk queue full")
+
+	return true
+}
+
+// advanceDisk runs the node's disk for this ms.
+func (n *node) advanceDisk() {
+	if n.disk == nil {
+		return
+	}
+
+	for _, done := range n.disk.advance(Milliseconds(n.loop.GetTime()), 1) {
+		done()
+	}
+}
+
+// DiskStats returns disk stats for each app with a disk.
+func (l *Loop) DiskStats() []DiskStats {
+	byApp := map[string]*DiskStats{}
+	waits := map[string]*latencyStats{}
+	services := map[string]*latencyStats{}
+
+	for _, n := range l.nodes {
+		if n.disk == nil {
+			continue
+		}
+
+		s, ok := byApp[n.App.Name]
+		if !ok {
+			s = &DiskStats{App: n.App.Name}
+			byApp[n.App.Name] = s
+			waits[n.App.Name] = &latencyStats{}
+			services[n.App.Name] = &latencyStats{}
+		}
+
+		d := n.disk
+
+		d.mu.Lock()
+		s.Reads += d.reads
+		s.Writes += d.writes
+		s.Bytes += d.bytes
+		s.Rejected += d.rejected
+		s.MaxQueue = max(s.MaxQueue, d.maxQueue)
+		waits[n.App.Name].merge(&d.wait)
+		services[n.App.Name].merge(&d.service)
+		d.mu.Unlock()
+	}
+
+	res := make([]DiskStats, 0, len(byApp))
+
+	for name, s := range byApp {
+		s.Wait = waits[name].summary()
+		s.Service = services[name].summary()
+		res = append(res, *s)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].App < res[j].App })
+
+	return res
+}
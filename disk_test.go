@@ -0,0 +1,181 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+)
+
+// TestDiskLimits checks the IOPS, bandwidth and queue limits.
+func TestDiskLimits(t *testing.T) {
+	iops := newDisk(&DiskConf{IOPS: 1000, Concurrency: 4})
+	finished := 0
+
+	iops.submit(0, 4, 0, nil, func() { finished = 1 })
+
+	for now := 1; now <= 3; now++ {
+		for _, done := range iops.advance(Milliseconds(now), 1) {
+			done()
+		}
+	}
+
+	if finished != 0 {
+		t.Error("Expected 1000 IOPS to start only 3 I/Os in 3ms")
+	}
+
+	for _, done := range iops.advance(4, 1) {
+		done()
+	}
+
+	if finished != 1 {
+		t.Error("Expected the 4th I/O to finish in the 4th ms")
+	}
+
+	bw := newDisk(&DiskConf{Bandwidth: 1024, QueueLimit: 2})
+
+	if bw.submit(0, 0, 3, nil, func() {}) {
+		t.Error("Expected 3 writes to overflow a queue of 2")
+	}
+
+	bw.submit(0, 0, 1, nil, func() {})
+
+	for now := 1; now <= 4; now++ {
+		if done := bw.advance(Milliseconds(now), 1); len(done) != 0 && now < 4 {
+			t.Errorf("Expected 4096 bytes to take 4ms at 1024 bytes/ms, done at %d", now)
+		}
+	}
+
+	if bw.writes != 1 || bw.rejected != 1 {
+		t.Errorf("Unexpected disk counts %d/%d", bw.writes, bw.rejected)
+	}
+}
+
+// TestDiskContention feeds a disk calls of two 3ms writes on a fixed
+// schedule and checks their times against ones worked out by hand.  A
+// write starts the ms after the one before it finishes, so a call on
+// an idle disk takes 7ms; a call every 4ms asks for 8ms of disk, so
+// the queue grows and calls take ever longer.
+func TestDiskContention(t *testing.T) {
+	sojourns := func(every int) []int {
+		d := newDisk(&DiskConf{IOPS: 2000, WriteMs: UniformCDF(3, 3)})
+		res := []int{}
+		now := 0
+
+		for ; now < 400; now++ {
+			if now%every == 0 && now < 100 {
+				start := now
+
+				d.submit(Milliseconds(now), 0, 2, nil, func() {
+					res = append(res, now-start)
+				})
+			}
+
+			for _, done := range d.advance(Milliseconds(now), 1) {
+				done()
+			}
+		}
+
+		return res
+	}
+
+	idle := sojourns(20)
+	for _, ms := range idle {
+		if ms != 7 {
+			t.Errorf("Expected each call to take 7ms on an idle disk, got %v", idle)
+
+			break
+		}
+	}
+
+	busy := sojourns(4)
+	if len(busy) != 25 {
+		t.Fatalf("Expected all 25 calls done, got %v", busy)
+	}
+
+	// the last call waits for the 24 before it: 25 * 8ms - 1 from 96ms
+	if last := busy[len(busy)-1]; last != 25*8-1-96 {
+		t.Errorf("Expected the last call to take %dms, got %v", 25*8-1-96, busy)
+	}
+}
+
+// TestDiskAfterLocalWork checks a stage's I/O waits for its local work
+// on a node without cores, as it does on one with them.
+func TestDiskAfterLocalWork(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+
+	rc := lightResourceConfig()
+	rc.Disk = &DiskConf{WriteMs: UniformCDF(10, 10)}
+
+	appConf := AppConf{
+		Name:      "diskServer",
+		Size:      1,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(20, 20), DiskWrites: 1}},
+		ReplyLen:  UniformCDF(50, 100),
+		Resources: rc,
+	}
+
+	MakeLB(&LbConf{Name: "diskServer", App: &appConf}, loop)
+
+	sourceConf := makeTestSourceConf("diskSource", 0.02, "diskServer", 500.0)
+	source := MakeSource(&sourceConf, loop)
+
+	loop.Run(1000)
+
+	lat := source.Latency()
+	t.Logf("latency=%+v disk=%+v", lat, loop.DiskStats())
+
+	// calls spend about 12ms getting there and back besides
+	if lat.Count == 0 || lat.P50 < 20+10+10 {
+		t.Errorf("Expected 20ms of work then 10ms of I/O, got %+v", lat)
+	}
+}
+
+// TestDiskRejectRepliesOnce checks a call whose first stage's I/O is
+// rejected is answered once, and its later stage does not reply too.
+func TestDiskRejectRepliesOnce(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+	loop.time = loopStartMs
+
+	rc := lightResourceConfig()
+	rc.Disk = &DiskConf{WriteMs: UniformCDF(10, 10), QueueLimit: 2}
+
+	appConf := AppConf{
+		Name: "rejectServer",
+		Size: 1,
+		Stages: []*StageConf{
+			{LocalWork: UniformCDF(1, 1), DiskWrites: 3},
+			{LocalWork: UniformCDF(5, 5)},
+		},
+		ReplyLen:  UniformCDF(50, 100),
+		Resources: rc,
+	}
+
+	lb := MakeLB(&LbConf{Name: "rejectServer", App: &appConf}, loop)
+	n := lb.appInstances[0]
+
+	// no reply loop, so the replies stay where they land
+	caller := &node{name: "rejectSource", loop: loop, replyCh: make(chan *Reply, 2)}
+
+	n.startCall(&Call{ReqID: IncrCallNumber(), caller: caller, origin: caller.name})
+
+	for _, now := range []float64{2, 10} {
+		loop.time = loopStartMs + now
+		n.handleTasks()
+	}
+
+	caller.arriving.mu.Lock()
+	replies := caller.arriving.replies.Len() + len(caller.replyCh)
+	caller.arriving.mu.Unlock()
+
+	if replies != 1 {
+		t.Errorf("Expected one reply for the rejected call, got %d", replies)
+	}
+
+	if n.inFlight.Load() != 0 {
+		t.Errorf("Expected the call finished, %d in flight", n.inFlight.Load())
+	}
+}
@@ -0,0 +1,38 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+// Event is a notable state change during a run (a fault starting or
+// ending, etc.) kept so a run can be laid out on a timeline.
+type Event struct {
+	Time   Milliseconds // sim time the event happened
+	Kind   string
+	Node   string
+	Detail string
+}
+
+// recordEvent appends an event at the current sim time.
+func (l *Loop) recordEvent(kind string, nodeName string, detail string) {
+	e := Event{
+		Time:   Milliseconds(l.GetTime()),
+		Kind:   kind,
+		Node:   nodeName,
+		Detail: detail,
+	}
+
+	l.eventsMu.Lock()
+	l.events = append(l.events, e)
+	l.eventsMu.Unlock()
+
+	ml.La("Event", e.Time, kind, nodeName, detail)
+}
+
+// Events returns a copy of the events recorded so far, in time order.
+func (l *Loop) Events() []Event {
+	l.eventsMu.Lock()
+	defer l.eventsMu.Unlock()
+
+	return append([]Event(nil), l.events...)
+}
@@ -0,0 +1,311 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	count "github.com/jayalane/go-counter"
+)
+
+// FaultKind is the type of failure a Fault injects.
+type FaultKind int
+
+const (
+	// FaultKill takes the node down (like an OOM kill) until the fault ends.
+	FaultKill FaultKind = iota
+	// FaultErrorRate makes the node answer a fraction of calls with a 503.
+	FaultErrorRate
+	// FaultLatency adds a fixed latency to every stage the node runs.
+	FaultLatency
+	// FaultFreeze stops the node processing calls and tasks without failing them.
+	FaultFreeze
+	// FaultDegrade applies a Degradation (slow-but-alive) to the node.
+	FaultDegrade
+	// FaultZoneOutage kills every app node in the zone named by Target.
+	FaultZoneOutage
+)
+
+// String returns a readable name for the fault kind.
+func (k FaultKind) String() string {
+	switch k {
+	case FaultKill:
+		return "kill"
+	case FaultErrorRate:
+		return "error_rate"
+	case FaultLatency:
+		return "latency"
+	case FaultFreeze:
+		return "freeze"
+	case FaultDegrade:
+		return "degrade"
+	case FaultZoneOutage:
+		return "zone_outage"
+	}
+
+	return "unknown"
+}
+
+// Fault is one entry in a chaos schedule.  Target is either a pool
+// name (the LbConf.Name, e.g. "db-wallet-read"), a single node name
+// (e.g. "db-wallet-read-2") or, for FaultZoneOutage, a zone.
+type Fault struct {
+	Kind      FaultKind
+	Target    string
+	Fraction  float64      // 0.0 to 1.0 of a pool to hit, 0 = whole pool
+	Start     Milliseconds // sim time after Run starts
+	Duration  Milliseconds // 0 = until the end of the run
+	ErrorRate float64      // 0.0 to 1.0, for FaultErrorRate
+	Latency   Milliseconds // added per stage, for FaultLatency
+
+	Degradation *Degradation // for FaultDegrade
+}
+
+// scheduledFault tracks a Fault through its lifetime in the loop.
+type scheduledFault struct {
+	fault   *Fault
+	nodes   []*node
+	started bool
+	ended   bool
+}
+
+// AddFault adds a fault to the loop's chaos schedule.  Call before Run.
+func (l *Loop) AddFault(f *Fault) {
+	l.faults = append(l.faults, &scheduledFault{fault: f})
+}
+
+// applyFaults starts and ends scheduled faults; called once per ms
+// before any node runs.
+func (l *Loop) applyFaults() {
+	now := Milliseconds(l.GetTime() - loopStartMs)
+
+	for _, sf := range l.faults {
+		if !sf.started && now >= sf.fault.Start {
+			l.startFault(sf)
+
+			continue
+		}
+
+		if sf.started && !sf.ended && sf.fault.Duration > 0 &&
+			now >= sf.fault.Start+sf.fault.Duration {
+			l.endFault(sf)
+		}
+	}
+}
+
+// startFault resolves the fault's targets and applies it to them.
+func (l *Loop) startFault(sf *scheduledFault) {
+	sf.started = true
+	sf.nodes = l.faultTargets(sf.fault)
+
+	if len(sf.nodes) == 0 {
+		ml.La("Fault target not found", sf.fault.Target)
+		count.IncrSyncSuffix("fault_target_unknown", sf.fault.Target)
+
+		return
+	}
+
+	for _, n := range sf.nodes {
+		n.startFault(sf.fault)
+		l.recordEvent("fault_start", n.name, sf.fault.describe())
+	}
+}
+
+// endFault removes the fault from its targets.
+func (l *Loop) endFault(sf *scheduledFault) {
+	sf.ended = true
+
+	for _, n := range sf.nodes {
+		n.endFault(sf.fault)
+		l.recordEvent("fault_end", n.name, sf.fault.describe())
+	}
+}
+
+// faultTargets returns the nodes a fault applies to.
+func (l *Loop) faultTargets(f *Fault) []*node {
+	if f.Kind == FaultZoneOutage {
+		return l.nodesInZone(f.Target)
+	}
+
+	if lb := l.GetLB(f.Target + lbSuffix); lb != nil {
+		pool := lb.appInstances
+		if f.Fraction <= 0 || f.Fraction >= 1 {
+			return append([]*node(nil), pool...)
+		}
+
+		k := int(math.Ceil(f.Fraction * float64(len(pool))))
+		res := make([]*node, 0, k)
+
+		for _, i := range rand.Perm(len(pool))[:k] {
+			res = append(res, pool[i])
+		}
+
+		return res
+	}
+
+	for _, n := range l.nodes {
+		if n.name == f.Target {
+			return []*node{n}
+		}
+	}
+
+	return nil
+}
+
+// describe returns a short description for the event log.
+func (f *Fault) describe() string {
+	switch f.Kind {
+	case FaultErrorRate:
+		return fmt.Sprintf("%s %.2f", f.Kind, f.ErrorRate)
+	case FaultLatency:
+		return fmt.Sprintf("%s +%.0fms", f.Kind, f.Latency)
+	case FaultDegrade:
+		if f.Degradation != nil {
+			return fmt.Sprintf("%s %s", f.Kind, f.Degradation)
+		}
+	case FaultKill, FaultFreeze, FaultZoneOutage:
+	}
+
+	return f.Kind.String()
+}
+
+// startFault applies a fault to this node.
+func (n *node) startFault(f *Fault) {
+	count.IncrSyncSuffix("node_fault_"+f.Kind.String(), n.name)
+	ml.La(n.name+": Fault starting", f.describe())
+
+	n.faultsMu.Lock()
+	n.activeFaults = append(n.activeFaults, f)
+	n.faultsMu.Unlock()
+
+	if f.isKill() {
+		n.killFor(f.Duration)
+	}
+}
+
+// endFault removes a fault from this node.  A killed node comes back
+// through the normal recovery in updateResources, or here if it has
+// no resources.
+func (n *node) endFault(f *Fault) {
+	ml.La(n.name+": Fault ending", f.describe())
+
+	n.faultsMu.Lock()
+
+	for i, af := range n.activeFaults {
+		if af == f {
+			n.activeFaults = append(n.activeFaults[:i], n.activeFaults[i+1:]...)
+
+			break
+		}
+	}
+
+	n.faultsMu.Unlock()
+
+	if f.isKill() && n.resources == nil && !n.isKilled() {
+		n.fullOOMCleanup()
+		count.IncrSyncSuffix("node_recovery", n.name)
+		n.loop.recordEvent("recovered", n.name, "back up")
+	}
+}
+
+// isKill is whether the fault takes its nodes down.
+func (f *Fault) isKill() bool {
+	return f.Kind == FaultKill || f.Kind == FaultZoneOutage
+}
+
+// isKilled returns true if a kill fault has the node down.
+func (n *node) isKilled() bool {
+	n.faultsMu.RLock()
+	defer n.faultsMu.RUnlock()
+
+	for _, f := range n.activeFaults {
+		if f.isKill() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// killFor takes the node down for d ms (0 = forever).  A node without
+// resources stays down while the kill fault is active.
+func (n *node) killFor(d Milliseconds) {
+	if n.resources == nil {
+		n.loop.resetCallsTo(n)
+
+		return
+	}
+
+	until := Milliseconds(math.Inf(1))
+	if d > 0 {
+		until = Milliseconds(n.loop.GetTime()) + d
+	}
+
+	n.resources.mu.Lock()
+	n.resources.isDown = true
+	n.resources.downUntil = until
+	n.resources.pendingWork = nil
+	n.resources.mu.Unlock()
+
+	n.loop.resetCallsTo(n)
+}
+
+// faultErrorRate returns the chance a call should fail due to active
+// faults and degradations.
+func (n *node) faultErrorRate() float64 {
+	n.faultsMu.RLock()
+	defer n.faultsMu.RUnlock()
+
+	ok := 1.0
+
+	for _, f := range n.activeFaults {
+		if f.Kind == FaultErrorRate {
+			ok *= 1 - f.ErrorRate
+		}
+	}
+
+	for _, d := range n.degradations() {
+		ok *= 1 - d.ErrorRate
+	}
+
+	return 1 - ok
+}
+
+// faultLatency returns the latency added to each stage by active faults.
+func (n *node) faultLatency() Milliseconds {
+	n.faultsMu.RLock()
+	defer n.faultsMu.RUnlock()
+
+	var extra Milliseconds
+
+	for _, f := range n.activeFaults {
+		if f.Kind == FaultLatency {
+			extra += f.Latency
+		}
+	}
+
+	return extra
+}
+
+// isFrozen returns true if a freeze fault or a GC pause has the node
+// stopped.
+func (n *node) isFrozen() bool {
+	if n.inGCPause() {
+		return true
+	}
+
+	n.faultsMu.RLock()
+	defer n.faultsMu.RUnlock()
+
+	for _, f := range n.activeFaults {
+		if f.Kind == FaultFreeze {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,187 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+
+	count "github.com/jayalane/go-counter"
+)
+
+// TestFaultSchedule runs a pool through a kill, an error rate, a freeze
+// and a latency fault and checks each one fired and was logged.
+func TestFaultSchedule(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+
+	appConf := AppConf{
+		Name:      "faultServer",
+		Size:      4,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 3)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	lbConf := LbConf{Name: "faultServer", App: &appConf}
+	MakeLB(&lbConf, loop)
+
+	sourceConf := makeTestSourceConf("faultSource", 2, "faultServer", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.AddFault(&Fault{Kind: FaultKill, Target: "faultServer-0", Start: 10, Duration: 20})
+	loop.AddFault(&Fault{Kind: FaultErrorRate, Target: "faultServer", Fraction: 0.5, Start: 20, Duration: 40, ErrorRate: 1.0})
+	loop.AddFault(&Fault{Kind: FaultFreeze, Target: "faultServer-3", Start: 30, Duration: 10})
+	loop.AddFault(&Fault{Kind: FaultLatency, Target: "faultServer", Start: 50, Latency: 20})
+	loop.AddFault(&Fault{Kind: FaultKill, Target: "noSuchServer", Start: 5})
+
+	errorsBefore := count.ReadSync("node_fault_error_reply")
+	frozenBefore := count.ReadSync("node_frozen_ms")
+
+	loop.Run(100)
+	loop.Stats()
+	count.LogCounters()
+
+	if count.ReadSync("node_fault_error_reply") == errorsBefore {
+		t.Error("Expected node_fault_error_reply to increase")
+	}
+
+	if count.ReadSync("node_frozen_ms") == frozenBefore {
+		t.Error("Expected node_frozen_ms to increase")
+	}
+
+	starts := map[string]int{}
+	ends := 0
+
+	for _, e := range loop.Events() {
+		switch e.Kind {
+		case "fault_start":
+			starts[e.Detail]++
+		case "fault_end":
+			ends++
+		}
+	}
+
+	if starts["kill"] != 1 || starts["error_rate 1.00"] != 2 || starts["freeze"] != 1 || starts["latency +20ms"] != 4 {
+		t.Errorf("Unexpected fault starts %v", starts)
+	}
+
+	// kill, 2 error rate, freeze; latency runs to the end
+	if ends != 4 {
+		t.Errorf("Expected 4 fault ends, got %d", ends)
+	}
+}
+
+// runFaultLatency runs a source against a pool, with a latency fault
+// on all of it if extra is set, and returns what the source saw.
+func runFaultLatency(extra Milliseconds) LatencySummary {
+	initTest()
+
+	loop := NewLoop()
+
+	appConf := AppConf{
+		Name:      "slowServer",
+		Size:      2,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 2)}, {LocalWork: UniformCDF(1, 2)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "slowServer", App: &appConf}, loop)
+
+	sourceConf := makeTestSourceConf("slowSource", 0.2, "slowServer", 500.0)
+	source := MakeSource(&sourceConf, loop)
+
+	if extra > 0 {
+		loop.AddFault(&Fault{Kind: FaultLatency, Target: "slowServer", Start: 0, Latency: extra})
+	}
+
+	loop.Run(300)
+
+	return source.Latency()
+}
+
+// TestFaultLatency checks a latency fault adds its latency to every
+// call and fails none.
+func TestFaultLatency(t *testing.T) {
+	base := runFaultLatency(0)
+	slow := runFaultLatency(30)
+
+	t.Logf("latency %+v without the fault, %+v with it", base, slow)
+
+	if slow.Count == 0 || slow.Errors != 0 {
+		t.Fatalf("Expected calls to succeed under a latency fault: %+v", slow)
+	}
+
+	// both stages are delayed but they run at once
+	if slow.P50 < base.P50+25 || slow.P50 > base.P50+40 {
+		t.Errorf("Expected about 30ms more latency, got %.1f vs %.1f", slow.P50, base.P50)
+	}
+}
+
+// TestKillWithoutResources checks a kill fault takes down instances
+// that model no resources and they come back when it ends.
+func TestKillWithoutResources(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+
+	appConf := AppConf{
+		Name:     "plainServer",
+		Size:     2,
+		Stages:   []*StageConf{{LocalWork: UniformCDF(1, 2)}},
+		ReplyLen: UniformCDF(100, 200),
+	}
+
+	MakeLB(&LbConf{Name: "plainServer", App: &appConf}, loop)
+
+	sourceConf := makeTestSourceConf("plainSource", 0.2, "plainServer", 500.0)
+	source := MakeSource(&sourceConf, loop)
+
+	loop.AddFault(&Fault{Kind: FaultKill, Target: "plainServer", Start: 100, Duration: 100})
+	loop.Run(300)
+
+	lat := source.Latency()
+	recovered := 0
+
+	for _, e := range loop.Events() {
+		if e.Kind == "recovered" {
+			recovered++
+		}
+	}
+
+	t.Logf("latency %+v, %d recovered", lat, recovered)
+
+	// about a third of the calls come in while the pool is down
+	if rate := lat.ErrorRate(); rate < 0.2 || rate > 0.5 {
+		t.Errorf("Expected the calls during the kill to fail, error rate %.2f", rate)
+	}
+
+	if recovered != 2 {
+		t.Errorf("Expected both instances to recover, got %d", recovered)
+	}
+}
+
+// lightResourceConfig returns a config cheap enough that nodes never
+// saturate, so only the behavior under test shows up.
+func lightResourceConfig() *ResourceConfig {
+	return &ResourceConfig{
+		CPUPerLocalWork:     UniformCDF(0.01, 0.02),
+		MemoryPerCall:       UniformCDF(0.01, 0.02),
+		NetworkPerCall:      UniformCDF(0.01, 0.02),
+		NetworkPerReply:     UniformCDF(0.01, 0.02),
+		MemoryPerQueuedCall: UniformCDF(0.01, 0.02),
+
+		CPULimit:     0.95,
+		MemoryLimit:  0.95,
+		NetworkLimit: 0.95,
+
+		MemoryRecoveryMs: 50,
+		CPUDelayFactor:   1.0,
+		CPURejectLimit:   0.0,
+
+		CPUDecayRate:     0.1,
+		MemoryDecayRate:  0.05,
+		NetworkDecayRate: 0.15,
+	}
+}
@@ -0,0 +1,317 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	bytesPerMB          = 1 << 20
+	defaultGOGC         = 100.0
+	defaultMinHeap      = 4 * bytesPerMB // Go's minimum GC target
+	defaultPromote      = 0.1
+	defaultOldGenFullAt = 0.9
+)
+
+var errHeapOOM = errors.New("live heap over limit")
+
+// GCMode is the style of garbage collector a heap has.
+type GCMode int
+
+const (
+	// GCGo collects the whole heap when it reaches the GOGC target,
+	// live * (1 + GOGC/100).
+	GCGo GCMode = iota
+	// GCJVM collects the young generation when YoungBytes of garbage
+	// has been allocated, promoting PromoteFraction of it to the old
+	// generation, and does a full collection when the old generation
+	// reaches OldGenFullAt of the limit.
+	GCJVM
+)
+
+func (m GCMode) String() string {
+	switch m {
+	case GCGo:
+		return "go"
+	case GCJVM:
+		return "jvm"
+	}
+
+	return "unknown"
+}
+
+// HeapConf turns on the byte based memory model: the heap grows with
+// in-flight calls and replies, garbage collections pause the node, and
+// it is OOM killed only when live heap exceeds LimitBytes.
+type HeapConf struct {
+	Mode         GCMode
+	LimitBytes   float64
+	BaseBytes    float64  // live heap at idle
+	PerCallBytes ModelCdf // live bytes held by each call in flight
+	AllocPerCall ModelCdf // short lived garbage each call allocates
+
+	GOGC            float64 // GCGo: percent growth before a collection (0 = 100)
+	YoungBytes      float64 // GCJVM: garbage allocated between young collections
+	PromoteFraction float64 // GCJVM: share of young garbage promoted (0 = 0.1)
+	OldGenFullAt    float64 // GCJVM: old gen share of limit for a full GC (0 = 0.9)
+
+	PauseMs      Milliseconds // fixed part of each pause
+	PauseMsPerMB Milliseconds // pause per MB of live heap (young gen for a minor GC)
+}
+
+// heapState is a node's heap.
+type heapState struct {
+	mu          sync.Mutex
+	conf        *HeapConf
+	live        float64
+	garbage     float64 // young gen for GCJVM
+	oldGarbage  float64 // GCJVM tenured garbage
+	nextGC      float64 // GCGo target
+	pausedUntil Milliseconds
+
+	gcs     int
+	fullGCs int
+	ooms    int
+	maxLive float64
+	pauses  latencyStats
+}
+
+// HeapStats sums up the heaps of one app across instances.
+type HeapStats struct {
+	App          string
+	GCs          int
+	FullGCs      int // GCJVM full collections (every GCGo collection is full)
+	OOMs         int
+	MaxLiveBytes float64
+	Pauses       LatencySummary
+}
+
+// newHeap returns a heap for the config, or nil for none.
+func newHeap(conf *HeapConf) *heapState {
+	if conf == nil {
+		return nil
+	}
+
+	h := &heapState{conf: conf}
+	h.reset()
+
+	return h
+}
+
+// reset empties the heap down to its base, as after a restart.
+// Caller must hold h.mu or own h.
+func (h *heapState) reset() {
+	h.live = h.conf.BaseBytes
+	h.garbage = 0
+	h.oldGarbage = 0
+	h.pausedUntil = 0
+	h.nextGC = h.target()
+}
+
+// target is the GCGo heap size that triggers the next collection.
+func (h *heapState) target() float64 {
+	gogc := h.conf.GOGC
+	if gogc <= 0 {
+		gogc = defaultGOGC
+	}
+
+	return math.Max(defaultMinHeap, h.live*(1+gogc/oneHundred))
+}
+
+// used is live plus garbage bytes.
+func (h *heapState) used() float64 {
+	return h.live + h.garbage + h.oldGarbage
+}
+
+// collect runs any collection that is due and returns its pause and
+// whether one ran.  Caller must hold h.mu.
+func (h *heapState) collect(now Milliseconds) (Milliseconds, bool) {
+	if now < h.pausedUntil {
+		return 0, false
+	}
+
+	switch h.conf.Mode {
+	case GCGo:
+		if h.used() < h.nextGC {
+			return 0, false
+		}
+
+		h.garbage = 0
+		h.nextGC = h.target()
+		h.fullGCs++
+
+		return h.pause(h.live), true
+	case GCJVM:
+		fullAt := h.conf.OldGenFullAt
+		if fullAt <= 0 {
+			fullAt = defaultOldGenFullAt
+		}
+
+		if h.live+h.oldGarbage >= fullAt*h.conf.LimitBytes {
+			h.garbage = 0
+			h.oldGarbage = 0
+			h.fullGCs++
+
+			return h.pause(h.live), true
+		}
+
+		if h.conf.YoungBytes <= 0 || h.garbage < h.conf.YoungBytes {
+			return 0, false
+		}
+
+		promote := h.conf.PromoteFraction
+		if promote <= 0 {
+			promote = defaultPromote
+		}
+
+		young := h.garbage
+		h.oldGarbage += young * promote
+		h.garbage = 0
+
+		return h.pause(young * promote), true
+	}
+
+	return 0, false
+}
+
+// pause records a collection that had to trace the given bytes.
+func (h *heapState) pause(traced float64) Milliseconds {
+	h.gcs++
+
+	return h.conf.PauseMs + h.conf.PauseMsPerMB*Milliseconds(traced/bytesPerMB)
+}
+
+// allocCall grows the heap for a call starting, collecting if due.
+// It returns an error if the node was OOM killed.
+func (n *node) allocCall(c *Call) error {
+	h := n.heap
+	now := Milliseconds(n.loop.GetTime())
+
+	h.mu.Lock()
+
+	if h.conf.PerCallBytes != nil {
+		c.heapBytes = h.conf.PerCallBytes(rand.Float64()) //nolint:gosec
+		h.live += c.heapBytes
+	}
+
+	if h.conf.AllocPerCall != nil {
+		h.garbage += h.conf.AllocPerCall(rand.Float64()) //nolint:gosec
+	}
+
+	h.maxLive = math.Max(h.maxLive, h.live)
+
+	if h.live > h.conf.LimitBytes {
+		h.ooms++
+		h.mu.Unlock()
+
+		n.oomKill()
+
+		return errHeapOOM
+	}
+
+	n.gcIfDue(now)
+	h.mu.Unlock()
+
+	return nil
+}
+
+// freeCall turns a finished call's live bytes and its reply into
+// garbage.
+func (n *node) freeCall(c *Call, replyLen uint64) {
+	h := n.heap
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	h.live = math.Max(h.conf.BaseBytes, h.live-c.heapBytes)
+	h.garbage += c.heapBytes + float64(replyLen)
+	c.heapBytes = 0
+	n.gcIfDue(Milliseconds(n.loop.GetTime()))
+	h.mu.Unlock()
+}
+
+// gcIfDue starts a collection if one is due.  Caller must hold heap.mu.
+func (n *node) gcIfDue(now Milliseconds) {
+	pause, ran := n.heap.collect(now)
+	if !ran {
+		return
+	}
+
+	n.heap.pausedUntil = now + pause
+	n.heap.pauses.add(float64(pause), false)
+
+	count.IncrSyncSuffix("node_gc", n.name)
+	count.MarkDistributionSuffix("node_gc_pause_ms", float64(pause), n.name)
+	ml.La(n.name+": GC pause for", pause, "ms")
+}
+
+// inGCPause is true while a collection has the node stopped.
+func (n *node) inGCPause() bool {
+	if n.heap == nil {
+		return false
+	}
+
+	n.heap.mu.Lock()
+	defer n.heap.mu.Unlock()
+
+	return Milliseconds(n.loop.GetTime()) < n.heap.pausedUntil
+}
+
+// heapUtilization is the heap in use as a fraction of the limit.
+func (n *node) heapUtilization() float64 {
+	n.heap.mu.Lock()
+	defer n.heap.mu.Unlock()
+
+	return n.heap.used() / n.heap.conf.LimitBytes
+}
+
+// HeapStats returns heap and GC stats for each app with a heap.
+func (l *Loop) HeapStats() []HeapStats {
+	byApp := map[string]*HeapStats{}
+	pauses := map[string]*latencyStats{}
+
+	for _, n := range l.nodes {
+		if n.heap == nil {
+			continue
+		}
+
+		s, ok := byApp[n.App.Name]
+		if !ok {
+			s = &HeapStats{App: n.App.Name}
+			byApp[n.App.Name] = s
+			pauses[n.App.Name] = &latencyStats{}
+		}
+
+		h := n.heap
+
+		h.mu.Lock()
+		s.GCs += h.gcs
+		s.FullGCs += h.fullGCs
+		s.OOMs += h.ooms
+		s.MaxLiveBytes = math.Max(s.MaxLiveBytes, h.maxLive)
+		h.mu.Unlock()
+
+		pauses[n.App.Name].merge(&h.pauses)
+	}
+
+	res := make([]HeapStats, 0, len(byApp))
+
+	for name, s := range byApp {
+		s.Pauses = pauses[name].summary()
+		res = append(res, *s)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].App < res[j].App })
+
+	return res
+}
@@ -0,0 +1,124 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+)
+
+// TestGCTrigger checks when each collector runs and how long it pauses.
+func TestGCTrigger(t *testing.T) {
+	goHeap := newHeap(&HeapConf{
+		Mode:         GCGo,
+		LimitBytes:   100 * bytesPerMB,
+		BaseBytes:    2 * bytesPerMB,
+		PauseMs:      1,
+		PauseMsPerMB: 0.5,
+	})
+
+	// the target is the 4MB minimum until live heap passes 2MB
+	goHeap.garbage = 1.5 * bytesPerMB
+	if pause, ran := goHeap.collect(0); ran {
+		t.Errorf("Expected no GC under the target, got %f", pause)
+	}
+
+	goHeap.garbage = 2 * bytesPerMB
+	if pause, _ := goHeap.collect(0); pause != 2 || goHeap.garbage != 0 {
+		t.Errorf("Expected a 2ms pause clearing garbage, got %f %f", pause, goHeap.garbage)
+	}
+
+	jvmHeap := newHeap(&HeapConf{
+		Mode:            GCJVM,
+		LimitBytes:      10 * bytesPerMB,
+		BaseBytes:       4 * bytesPerMB,
+		YoungBytes:      1 * bytesPerMB,
+		PromoteFraction: 0.5,
+		OldGenFullAt:    0.5,
+		PauseMs:         1,
+		PauseMsPerMB:    2,
+	})
+
+	for i := range 2 {
+		jvmHeap.garbage = bytesPerMB
+		if pause, _ := jvmHeap.collect(0); pause != 2 || jvmHeap.fullGCs != 0 {
+			t.Errorf("Expected minor GC %d of 2ms, got %f", i, pause)
+		}
+	}
+
+	// 4MB live + 1MB promoted reaches half the limit
+	if pause, _ := jvmHeap.collect(0); pause != 9 || jvmHeap.fullGCs != 1 || jvmHeap.oldGarbage != 0 {
+		t.Errorf("Expected a 9ms full GC, got %f", pause)
+	}
+}
+
+// runHeap runs a pool with the given heap and returns the source
+// latency and heap stats.
+func runHeap(t *testing.T, heap *HeapConf) (LatencySummary, HeapStats) {
+	t.Helper()
+	initTest()
+
+	loop := NewLoop()
+
+	rc := lightResourceConfig()
+	rc.Heap = heap
+
+	appConf := AppConf{
+		Name:      "heapServer",
+		Size:      2,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(2, 4)}},
+		ReplyLen:  UniformCDF(1000, 2000),
+		Resources: rc,
+	}
+
+	MakeLB(&LbConf{Name: "heapServer", App: &appConf}, loop)
+
+	sourceConf := makeTestSourceConf("heapSource", 0.3, "heapServer", 500.0)
+	source := MakeSource(&sourceConf, loop)
+
+	loop.Run(400)
+
+	var stats HeapStats
+	if all := loop.HeapStats(); len(all) == 1 {
+		stats = all[0]
+	}
+
+	t.Logf("latency=%+v heap=%+v", source.Latency(), stats)
+
+	return source.Latency(), stats
+}
+
+// TestGCPauses checks GC pauses stretch the tail and a live heap over
+// the limit OOM kills the node.
+func TestGCPauses(t *testing.T) {
+	base, _ := runHeap(t, nil)
+
+	paused, stats := runHeap(t, &HeapConf{
+		Mode:         GCGo,
+		LimitBytes:   64 * bytesPerMB,
+		BaseBytes:    16 * bytesPerMB,
+		PerCallBytes: UniformCDF(50000, 100000),
+		AllocPerCall: UniformCDF(1*bytesPerMB, 2*bytesPerMB),
+		PauseMs:      5,
+		PauseMsPerMB: 1,
+	})
+
+	if stats.GCs == 0 || stats.OOMs != 0 {
+		t.Errorf("Expected GCs and no OOMs, got %+v", stats)
+	}
+
+	if paused.P99 < base.P99+10 {
+		t.Errorf("Expected GC pauses to stretch the tail: %.1f vs %.1f", paused.P99, base.P99)
+	}
+
+	_, stats = runHeap(t, &HeapConf{
+		Mode:         GCJVM,
+		LimitBytes:   2 * bytesPerMB,
+		BaseBytes:    1 * bytesPerMB,
+		PerCallBytes: UniformCDF(0.5*bytesPerMB, 0.6*bytesPerMB),
+		YoungBytes:   bytesPerMB,
+	})
+
+	if stats.OOMs == 0 {
+		t.Errorf("Expected live heap over the limit to OOM, got %+v", stats)
+	}
+}
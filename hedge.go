@@ -0,0 +1,350 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"sort"
+	"sync"
+
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	defaultHedgeMinSamples = 20
+	hedgeRecentSamples     = 1000 // latencies kept for a percentile delay
+	hedgeDelayRefresh      = 50   // calls between percentile recomputes
+)
+
+// HedgeConf configures hedged requests on a RemoteCall: if no reply
+// has come after the delay, a duplicate goes to another instance and
+// the first reply wins.  The loser is cancelled, which only saves work
+// if its callee has Cancellation; its reply is ignored.
+type HedgeConf struct {
+	Delay      Milliseconds // hedge after this long without a reply (0 = don't)
+	Percentile float64      // or after this percentile of observed latency, e.g. 0.95 (0 = use Delay)
+	MinSamples int          // latencies seen before Percentile is used, Delay until then (0 = 20)
+	MaxHedges  int          // duplicates per call (0 = 1)
+}
+
+// hedgeGroup is a call and its duplicates.
+type hedgeGroup struct {
+	mu        sync.Mutex
+	done      bool
+	instances map[int]bool   // LB instance indexes already sent to
+	attempts  []*cancelToken // cancelled when another attempt wins
+}
+
+// hedgeTracker is one caller instance's hedging of one endpoint.
+type hedgeTracker struct {
+	mu      sync.Mutex
+	calls   int
+	hedged  int // calls that sent at least one hedge
+	hedges  int // duplicates sent
+	wins    int // calls a hedge answered first
+	recent  []float64
+	next    int
+	delay   Milliseconds
+	latency latencyStats // first reply, what the caller sees
+	primary latencyStats // the original attempt's own reply
+}
+
+// HedgeStats sums up an app's hedging of calls to an endpoint.
+type HedgeStats struct {
+	App        string
+	Endpoint   string
+	Calls      int
+	Hedged     int // calls that sent a hedge
+	Hedges     int // duplicates sent
+	Wins       int // calls a hedge answered first
+	P99        float64
+	PrimaryP99 float64 // p99 of the original attempts alone
+}
+
+// HedgeRate returns the share of calls that sent a hedge.
+func (s HedgeStats) HedgeRate() float64 {
+	if s.Calls == 0 {
+		return 0
+	}
+
+	return float64(s.Hedged) / float64(s.Calls)
+}
+
+// ExtraLoad returns the duplicates sent per call, the extra load on
+// the callee pool.
+func (s HedgeStats) ExtraLoad() float64 {
+	if s.Calls == 0 {
+		return 0
+	}
+
+	return float64(s.Hedges) / float64(s.Calls)
+}
+
+// sentTo records the instance an attempt went to.
+func (g *hedgeGroup) sentTo(i int) {
+	g.mu.Lock()
+	g.instances[i] = true
+	g.mu.Unlock()
+}
+
+// avoid filters out instances the group has already used, unless
+// that leaves none.
+func (g *hedgeGroup) avoid(candidates []int) []int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.instances) == 0 {
+		return candidates
+	}
+
+	res := make([]int, 0, len(candidates))
+
+	for _, i := range candidates {
+		if !g.instances[i] {
+			res = append(res, i)
+		}
+	}
+
+	if len(res) == 0 {
+		return candidates
+	}
+
+	return res
+}
+
+// finish marks the group answered, returning true for the first
+// reply, and cancels the attempts that lost.
+func (g *hedgeGroup) finish(winner *cancelToken) bool {
+	g.mu.Lock()
+	first := !g.done
+	g.done = true
+	attempts := g.attempts
+	g.mu.Unlock()
+
+	if !first {
+		return false
+	}
+
+	for _, t := range attempts {
+		if t != winner {
+			t.cancel()
+		}
+	}
+
+	return true
+}
+
+// attempt records an attempt's token.
+func (g *hedgeGroup) attempt(t *cancelToken) {
+	g.mu.Lock()
+	g.attempts = append(g.attempts, t)
+	g.mu.Unlock()
+}
+
+// answered is whether a reply has come.
+func (g *hedgeGroup) answered() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.done
+}
+
+// observe records a first reply's latency for the percentile delay.
+func (ht *hedgeTracker) observe(ms float64) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+
+	if len(ht.recent) < hedgeRecentSamples {
+		ht.recent = append(ht.recent, ms)
+
+		return
+	}
+
+	ht.recent[ht.next] = ms
+	ht.next = (ht.next + 1) % hedgeRecentSamples
+}
+
+// hedgeDelay returns how long to wait before hedging a new call, or 0
+// not to hedge it.
+func (ht *hedgeTracker) hedgeDelay(conf *HedgeConf) Milliseconds {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+
+	ht.calls++
+
+	minSamples := conf.MinSamples
+	if minSamples <= 0 {
+		minSamples = defaultHedgeMinSamples
+	}
+
+	if conf.Percentile <= 0 || len(ht.recent) < minSamples {
+		return conf.Delay
+	}
+
+	if ht.delay == 0 || ht.calls%hedgeDelayRefresh == 0 {
+		s := append([]float64(nil), ht.recent...)
+		sort.Float64s(s)
+		ht.delay = Milliseconds(percentileOf(s, conf.Percentile))
+	}
+
+	return ht.delay
+}
+
+// hedgeTrackerFor returns the caller's tracker for an endpoint.
+func (n *node) hedgeTrackerFor(rc *RemoteCall) *hedgeTracker {
+	n.hedgesMu.Lock()
+	defer n.hedgesMu.Unlock()
+
+	if n.hedges == nil {
+		n.hedges = make(map[string]*hedgeTracker)
+	}
+
+	ht, ok := n.hedges[rc.Endpoint]
+	if !ok {
+		ht = &hedgeTracker{}
+		n.hedges[rc.Endpoint] = ht
+	}
+
+	return ht
+}
+
+// hedgeRemoteCall sends the call and schedules its hedges, handing
+// only the first reply to f.
+func (n *node) hedgeRemoteCall(rc *RemoteCall, c *Call, lb *LB, f handleReply) {
+	ht := n.hedgeTrackerFor(rc)
+	g := &hedgeGroup{instances: make(map[int]bool)}
+	start := Milliseconds(n.loop.GetTime())
+	c.hedge = g
+	g.attempt(c.cancel)
+
+	first := func(n *node, r *Reply, winner *cancelToken) bool {
+		if !g.finish(winner) {
+			count.IncrSyncSuffix("hedge_loser_ignored", n.name)
+
+			return false
+		}
+
+		ms := float64(Milliseconds(n.loop.GetTime()) - start)
+		ht.latency.add(ms, r.status != 0)
+		ht.observe(ms)
+		f(n, r)
+
+		return true
+	}
+
+	n.attemptRemoteCall(rc, c, lb, func(n *node, r *Reply) {
+		// a primary cancelled by a winning hedge never finished
+		if r.status != statusClientClosed {
+			ht.primary.add(float64(Milliseconds(n.loop.GetTime())-start), r.status != 0)
+		}
+
+		first(n, r, c.cancel)
+	}, 0)
+
+	hedges := rc.Hedge.MaxHedges
+	if hedges <= 0 {
+		hedges = 1
+	}
+
+	delay := ht.hedgeDelay(rc.Hedge)
+	if delay <= 0 {
+		return
+	}
+
+	n.retriesMu.Lock()
+
+	for k := 1; k <= hedges; k++ {
+		n.resends = append(n.resends, &pendingResend{
+			at: start + delay*Milliseconds(k),
+			send: func() {
+				if g.answered() {
+					return
+				}
+
+				ht.mu.Lock()
+				ht.hedges++
+
+				if k == 1 {
+					ht.hedged++
+				}
+
+				ht.mu.Unlock()
+
+				count.IncrSyncSuffix("hedge_sent", n.name)
+
+				hc := c.retryCopy()
+				hc.hedge = g
+				hc.hedged = true
+				hc.attempt = c.attempt
+				g.attempt(hc.cancel)
+
+				n.attemptRemoteCall(rc, hc, lb, func(n *node, r *Reply) {
+					if first(n, r, hc.cancel) {
+						ht.mu.Lock()
+						ht.wins++
+						ht.mu.Unlock()
+					}
+				}, 0)
+			},
+		})
+	}
+
+	n.retriesMu.Unlock()
+}
+
+// HedgeStats returns hedging per calling app and endpoint, summed
+// across the app's instances.
+func (l *Loop) HedgeStats() []HedgeStats {
+	type sum struct {
+		stats   HedgeStats
+		latency latencyStats
+		primary latencyStats
+	}
+
+	sums := make(map[[2]string]*sum)
+
+	for _, n := range l.nodes {
+		n.hedgesMu.Lock()
+
+		for endpoint, ht := range n.hedges {
+			key := [2]string{n.App.Name, endpoint}
+
+			s, ok := sums[key]
+			if !ok {
+				s = &sum{stats: HedgeStats{App: n.App.Name, Endpoint: endpoint}}
+				sums[key] = s
+			}
+
+			ht.mu.Lock()
+			s.stats.Calls += ht.calls
+			s.stats.Hedged += ht.hedged
+			s.stats.Hedges += ht.hedges
+			s.stats.Wins += ht.wins
+			ht.mu.Unlock()
+
+			s.latency.merge(&ht.latency)
+			s.primary.merge(&ht.primary)
+		}
+
+		n.hedgesMu.Unlock()
+	}
+
+	res := make([]HedgeStats, 0, len(sums))
+
+	for _, s := range sums {
+		s.stats.P99 = s.latency.percentile(p99)
+		s.stats.PrimaryP99 = s.primary.percentile(p99)
+		res = append(res, s.stats)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].App != res[j].App {
+			return res[i].App < res[j].App
+		}
+
+		return res[i].Endpoint < res[j].Endpoint
+	})
+
+	return res
+}
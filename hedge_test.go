@@ -0,0 +1,98 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+)
+
+// TestHedgeDelay checks the delay is fixed until enough latencies are
+// seen and then follows their percentile.
+func TestHedgeDelay(t *testing.T) {
+	conf := &HedgeConf{Delay: 7, Percentile: 0.9, MinSamples: 10}
+	ht := &hedgeTracker{}
+
+	if d := ht.hedgeDelay(conf); d != 7 {
+		t.Errorf("Expected the fixed delay before samples, got %v", d)
+	}
+
+	for i := 1; i <= 100; i++ {
+		ht.observe(float64(i))
+	}
+
+	if d := ht.hedgeDelay(conf); d < 85 || d > 95 {
+		t.Errorf("Expected about the p90 of 1..100, got %v", d)
+	}
+}
+
+// runHedged sends a front's calls hedged with conf to a pool with one
+// slow instance and returns the hedge stats.
+func runHedged(t *testing.T, conf *HedgeConf) HedgeStats {
+	t.Helper()
+	initTest()
+
+	loop := NewLoop()
+
+	backConf := AppConf{
+		Name:      "hedgeBack",
+		Size:      8,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 2)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "hedgeBack", App: &backConf}, loop)
+
+	frontConf := AppConf{
+		Name: "hedgeFront",
+		Size: 2,
+		Stages: []*StageConf{{
+			LocalWork:   UniformCDF(1, 2),
+			RemoteCalls: []*RemoteCall{{Endpoint: "hedgeBack", Hedge: conf}},
+		}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "hedgeFront", App: &frontConf}, loop)
+
+	sourceConf := makeTestSourceConf("hedgeSource", 0.5, "hedgeFront", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.AddFault(&Fault{Kind: FaultLatency, Target: "hedgeBack-0", Start: 0, Latency: 60})
+
+	loop.Run(500)
+
+	stats := loop.HedgeStats()
+	if len(stats) != 1 {
+		t.Fatalf("Expected one hedged endpoint, got %+v", stats)
+	}
+
+	t.Logf("%+v rate %.2f extra %.2f", stats[0], stats[0].HedgeRate(), stats[0].ExtraLoad())
+
+	return stats[0]
+}
+
+// TestHedgeTail checks hedging around a slow instance cuts the p99
+// for a little extra load.
+func TestHedgeTail(t *testing.T) {
+	s := runHedged(t, &HedgeConf{Delay: 30})
+
+	if s.ExtraLoad() < 0.05 || s.ExtraLoad() > 0.3 {
+		t.Errorf("Expected about one call in 8 hedged: %.2f", s.ExtraLoad())
+	}
+
+	if s.Wins == 0 || s.P99 >= s.PrimaryP99-10 {
+		t.Errorf("Expected hedges to win and cut the p99: %+v", s)
+	}
+}
+
+// TestHedgeNoDelay checks a hedge with no Delay, before Percentile has
+// the samples it needs, doesn't hedge every call at once.
+func TestHedgeNoDelay(t *testing.T) {
+	s := runHedged(t, &HedgeConf{Percentile: 0.99, MinSamples: 10000})
+
+	if s.Calls == 0 || s.Hedges != 0 {
+		t.Errorf("Expected calls and no hedges: %+v", s)
+	}
+}
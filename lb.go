@@ -5,7 +5,9 @@
 package sim
 
 import (
+	"math/rand"
 	"strconv"
+	"sync/atomic"
 
 	count "github.com/jayalane/go-counter"
 )
@@ -14,17 +16,61 @@ const (
 	lbSuffix = "-lb"
 )
 
+// LbStrategy is how an LB picks the instance for a call.
+type LbStrategy int
+
+const (
+	// LbRoundRobin sends to each instance in turn (the default).
+	LbRoundRobin LbStrategy = iota
+	// LbRandom picks an instance uniformly at random.
+	LbRandom
+	// LbLeastOutstanding picks the instance with the fewest calls in flight.
+	LbLeastOutstanding
+	// LbPowerOfTwo picks the less loaded of two random instances.
+	LbPowerOfTwo
+)
+
+// String returns a readable name for the strategy.
+func (s LbStrategy) String() string {
+	switch s {
+	case LbRoundRobin:
+		return "round_robin"
+	case LbRandom:
+		return "random"
+	case LbLeastOutstanding:
+		return "least_outstanding"
+	case LbPowerOfTwo:
+		return "power_of_two"
+	}
+
+	return "unknown"
+}
+
 // LbConf is the configuration of an application.
 type LbConf struct {
-	Name string
-	App  *AppConf
+	Name     string
+	App      *AppConf
+	Strategy LbStrategy
+
+	// ZoneAffinity prefers instances in the caller's zone.
+	ZoneAffinity bool
+
+	// RateLimit is an optional limit on all calls through the LB, like
+	// an API gateway's.
+	RateLimit *RateLimitConf
 }
 
 // LB is a load balancer.
 type LB struct {
-	n            node
-	appInstances []*node
-	lastSent     int
+	n               node
+	appInstances    []*node
+	lastSent        int
+	strategy        LbStrategy
+	zoneAffinity    bool
+	all             []int
+	sent            []atomic.Int64
+	outstanding     []atomic.Int64
+	instanceLatency []latencyStats
 }
 
 // Run starts the goroutine for this node.
@@ -46,32 +92,111 @@ func (lb *LB) GenerateEvent() {
 func (lb *LB) handleCall(c *Call) {
 	ml.La(lb.n.name+": LB got an Incoming call:", c, c.ReqID, c.caller.name)
 
-	lb.lastSent++
-	poolSize := len(lb.appInstances)
+	if !lb.n.rateLimit(c) {
+		return
+	}
+
+	i := lb.pick(c)
+	dest := lb.appInstances[i]
+
+	if c.hedge != nil {
+		c.hedge.sentTo(i)
+	}
 
-	ml.La(lb.n.name+": sending call", c.ReqID, "to", lb.appInstances[lb.lastSent%poolSize].name)
+	ml.La(lb.n.name+": sending call", c.ReqID, "to", dest.name)
 
-	newCall := lb.makeCall(&lb.n, c, lb.appInstances[lb.lastSent%poolSize])
+	newCall := lb.makeCall(&lb.n, c, dest)
 	newCall.Params = c.Params
 	newCall.caller = &lb.n
 	newCall.StartTime = Milliseconds(lb.n.loop.GetTime())
 
 	count.IncrSuffix("lb_call_send", lb.n.name)
+	lb.sent[i].Add(1)
+	lb.outstanding[i].Add(1)
 
-	newCall.sendCall(lb.appInstances[lb.lastSent%poolSize],
+	newCall.sendCall(dest,
 		func(n *node, r *Reply) {
 			currentTime := n.loop.GetTime()
 			latencyMs := float64(currentTime) - float64(r.call.StartTime)
 
+			lb.outstanding[i].Add(-1)
+			lb.n.releaseLimit(c)
+			lb.instanceLatency[i].add(latencyMs, r.status != 0)
+			lb.promReply(i, r, latencyMs)
 			count.IncrSuffix("lb_call_get_reply", lb.n.name)
 			count.MarkDistributionSuffix("lb_reply_latency_ms", latencyMs, lb.n.name)
 			ml.La(n.name+": LB got a reply", *r, *c)
 			r.reqID = c.ReqID
-			c.caller.replyCh <- r
+			lb.n.sendReply(c, r)
 		},
 	)
 }
 
+// pick returns the index of the instance to send the next call to.
+func (lb *LB) pick(c *Call) int {
+	candidates := lb.candidates(c)
+	if c.hedge != nil {
+		candidates = c.hedge.avoid(candidates)
+	}
+
+	poolSize := len(candidates)
+
+	switch lb.strategy {
+	case LbRandom:
+		return candidates[rand.Intn(poolSize)] //nolint:gosec
+	case LbLeastOutstanding:
+		best := candidates[0]
+
+		for _, i := range candidates[1:] {
+			if lb.outstanding[i].Load() < lb.outstanding[best].Load() {
+				best = i
+			}
+		}
+
+		return best
+	case LbPowerOfTwo:
+		a := candidates[rand.Intn(poolSize)] //nolint:gosec
+		b := candidates[rand.Intn(poolSize)] //nolint:gosec
+
+		if lb.outstanding[b].Load() < lb.outstanding[a].Load() {
+			return b
+		}
+
+		return a
+	case LbRoundRobin:
+	}
+
+	lb.lastSent++
+
+	return candidates[lb.lastSent%poolSize]
+}
+
+// candidates returns the instance indexes the call may go to.  With
+// zone affinity that is the available instances in the caller's zone,
+// falling back to the whole pool if there are none.
+func (lb *LB) candidates(c *Call) []int {
+	if !lb.zoneAffinity || c.fromZone == "" {
+		return lb.all
+	}
+
+	local := make([]int, 0, len(lb.all))
+
+	for _, i := range lb.all {
+		n := lb.appInstances[i]
+		if n.zone == c.fromZone && n.IsAvailable() {
+			local = append(local, i)
+		}
+	}
+
+	if len(local) == 0 {
+		count.IncrSyncSuffix("lb_zone_fallback", lb.n.name)
+
+		return lb.all
+	}
+
+	return local
+}
+
 // makeCall generates the call from an old call.
 func (lb *LB) makeCall(n *node, oldC *Call, destN *node) *Call {
 	c := Call{}
@@ -84,9 +209,16 @@ func (lb *LB) makeCall(n *node, oldC *Call, destN *node) *Call {
 
 	c.caller = n
 	c.TimeoutMs = 90.0
-	c.Wakeup = Milliseconds(n.loop.GetTime() + networkDelayConst) // later better
+	c.replyTimeout = oldC.replyTimeout
+	c.Wakeup = Milliseconds(n.loop.GetTime()) + n.loop.callDelay(oldC.fromZone, destN.zone)
 	c.Endpoint = destN.name
 	c.Params = oldC.Params
+	c.fromZone = oldC.fromZone
+	c.length = oldC.length
+	c.origin = oldC.origin
+	c.Priority = oldC.Priority
+	c.cancel = oldC.cancel
+	c.trace = oldC.trace
 
 	return &c
 }
@@ -98,11 +230,24 @@ func MakeLB(lbConf *LbConf, l *Loop) *LB {
 	lb.n.App = lbConf.App
 	lb.n.name = lbConf.Name + lbSuffix
 	lb.n.callCB = lb.handleCall
+	lb.strategy = lbConf.Strategy
+	lb.zoneAffinity = lbConf.ZoneAffinity
+	lb.n.limiter = newRateLimiter(lbConf.RateLimit)
+	lb.all = make([]int, lbConf.App.Size)
 	lb.appInstances = make([]*node, lbConf.App.Size)
+	lb.sent = make([]atomic.Int64, lbConf.App.Size)
+	lb.outstanding = make([]atomic.Int64, lbConf.App.Size)
+	lb.instanceLatency = make([]latencyStats, lbConf.App.Size)
 
 	for i := uint16(0); i < lbConf.App.Size; i++ { //nolint:intrange
-		n := makeApp(lbConf, l, "-"+strconv.FormatUint(uint64(i), 10))
+		zone := ""
+		if len(lbConf.App.Zones) > 0 {
+			zone = lbConf.App.Zones[int(i)%len(lbConf.App.Zones)]
+		}
+
+		n := makeApp(lbConf, l, "-"+strconv.FormatUint(uint64(i), 10), zone)
 		lb.appInstances[i] = n
+		lb.all[i] = int(i)
 	}
 
 	l.AddLB(lb.n.name, &lb) // this name is the lookup for the app
@@ -4,10 +4,15 @@ package sim
 
 import (
 	"fmt"
+	"io"
 	"runtime"
 	"sync"
 )
 
+const (
+	loopStartMs = 1000.0 // instead of 1 or 0 - just to make them stand out.
+)
+
 // Loop is a main driver for the simulation
 // call Run() after hooking up all the
 // nodes to the SimEntryPoint(s) and
@@ -19,6 +24,18 @@ type Loop struct {
 	nodes       []*node
 	lbs         map[string]*LB
 	broadcaster *Broadcaster
+	faults      []*scheduledFault
+	network     *NetworkConf
+	transfers   transferSet
+	eventsMu    sync.Mutex
+	events      []Event
+	tracer      *tracer
+	metrics     *metricsRecorder
+	prom        *promRegistry
+	edgesMu     sync.Mutex
+	edges       map[edgeKey]*edgeStats
+	statsWriter io.Writer
+	running     sync.WaitGroup // node runners and reply loops
 }
 
 // GetTime returns the current sim time safely.
@@ -37,9 +54,10 @@ func (l *Loop) IncrementTime() {
 	l.muTime.Unlock()
 }
 
-// Run starts the main loop and runs it for length msecs.
+// Run starts the main loop and runs it for length msecs.  The nodes
+// stop when it returns, so a loop runs only once.
 func (l *Loop) Run(length float64) {
-	l.time = 1000 // instead of 1 or 0 - just to make them stand out.
+	l.time = loopStartMs
 
 	for i, s := range l.sources {
 		fmt.Println("Call start source", i, s)
@@ -51,9 +69,12 @@ func (l *Loop) Run(length float64) {
 		v.Run()
 	}
 
-	for ; l.GetTime() < length+1000.0; l.IncrementTime() {
+	for ; l.GetTime() < length+loopStartMs; l.IncrementTime() {
 		var wg sync.WaitGroup
 
+		l.applyFaults()
+		l.advanceTransfers()
+
 		ml.La("Main loop looping", l.GetTime(), "***********************************************", runtime.NumGoroutine(), goid())
 
 		for i, s := range l.sources {
@@ -78,19 +99,42 @@ func (l *Loop) Run(length float64) {
 
 		l.broadcaster.Broadcast(&wg) // tell everyone the ms is over.
 		wg.Wait()
+		l.sampleMetrics()
+	}
+
+	l.stop()
+
+	ml.La("Exiting main loop", "***********************************************")
+}
+
+// stop shuts down the node and source goroutines and waits for them,
+// so no reply callback is still running once Run returns.
+func (l *Loop) stop() {
+	for _, s := range l.sources {
+		close(s.n.done)
 	}
 
 	for _, n := range l.nodes {
-		n.done <- true
+		close(n.done)
 	}
 
-	ml.La("Exiting main loop", "***********************************************")
+	l.running.Wait()
 }
 
 // Stats prints out the accumulated stats for the run
 // to stop the main loop.
 func (l *Loop) Stats() {
-	ml.La("TBD")
+	if l.statsWriter == nil {
+		return
+	}
+
+	l.WriteInstanceReport(l.statsWriter)
+}
+
+// SetStatsWriter makes Stats write the instance report to w.  Pass
+// nil (the default) for no report.
+func (l *Loop) SetStatsWriter(w io.Writer) {
+	l.statsWriter = w
 }
 
 // NewLoop initializes and returns a simulation main loop.
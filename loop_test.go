@@ -515,3 +515,52 @@ func TestCPUCascadeToOOM(t *testing.T) {
 	memExhaustion := count.ReadSync("node_memory_exhaustion")
 	t.Logf("node_cpu_delay=%d node_memory_exhaustion=%d", cpuDelay, memExhaustion)
 }
+
+// TestAwaitReplies has a front await a back that fails every call and
+// checks the front fails its calls rather than answering 200.
+func TestAwaitReplies(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+
+	backConf := AppConf{
+		Name:      "awaitBack",
+		Size:      2,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 2)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "awaitBack", App: &backConf}, loop)
+
+	frontConf := AppConf{
+		Name: "awaitFront",
+		Size: 2,
+		Stages: []*StageConf{{
+			LocalWork:    UniformCDF(1, 2),
+			RemoteCalls:  []*RemoteCall{{Endpoint: "awaitBack"}},
+			AwaitReplies: true,
+		}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "awaitFront", App: &frontConf}, loop)
+
+	sourceConf := makeTestSourceConf("awaitSource", 0.1, "awaitFront", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.AddFault(&Fault{Kind: FaultErrorRate, Target: "awaitBack", Fraction: 1, Start: 0, ErrorRate: 1.0})
+
+	errorsBefore := count.ReadSync("node_fault_error_reply")
+	failedBefore := count.ReadSync("node_awaited_call_failed")
+
+	loop.Run(200)
+
+	errors := count.ReadSync("node_fault_error_reply") - errorsBefore
+	failed := count.ReadSync("node_awaited_call_failed") - failedBefore
+
+	if errors == 0 || failed == 0 || failed > errors {
+		t.Errorf("Expected the front to fail the calls awaitBack failed, got %d failed of %d errors", failed, errors)
+	}
+}
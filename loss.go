@@ -0,0 +1,71 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"math"
+	"math/rand"
+
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	defaultRTO            = 200.0 // ms, like the Linux minimum RTO
+	defaultMaxRetransmits = 6
+)
+
+// LossMode is what happens to a call or reply lost on a link.
+type LossMode int
+
+const (
+	// LossRetransmit resends after an RTO that doubles on each loss, so
+	// the sender sees added latency; after MaxRetransmits it gives up.
+	LossRetransmit LossMode = iota
+	// LossDrop loses the message outright; the sender gives up after an
+	// RTO, unless the call's own timeout fires first.
+	LossDrop
+)
+
+// lossPenalty draws the losses for one message between two zones.
+// It returns the retransmission delay to add, or lost = true and how
+// long until the sender gives up if the message never arrives.
+func (l *Loop) lossPenalty(from string, to string) (Milliseconds, bool) {
+	if l.network == nil {
+		return 0, false
+	}
+
+	lc := l.network.link(from, to)
+	if lc == nil || lc.LossRate <= 0 {
+		return 0, false
+	}
+
+	rto := lc.RTO
+	if rto <= 0 {
+		rto = defaultRTO
+	}
+
+	maxRetransmits := lc.MaxRetransmits
+	if maxRetransmits <= 0 {
+		maxRetransmits = defaultMaxRetransmits
+	}
+
+	var penalty Milliseconds
+
+	for attempt := 0; rand.Float64() < lc.LossRate; attempt++ { //nolint:gosec
+		count.IncrSyncSuffix("network_packet_lost", "network")
+
+		backoff := rto * Milliseconds(math.Pow(2, float64(attempt)))
+
+		if lc.LossMode == LossDrop || attempt >= maxRetransmits {
+			return penalty + backoff, true
+		}
+
+		count.IncrSyncSuffix("network_retransmit", "network")
+
+		penalty += backoff
+	}
+
+	return penalty, false
+}
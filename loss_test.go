@@ -0,0 +1,122 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+)
+
+// TestLossPenalty checks the retransmission backoff and giving up.
+func TestLossPenalty(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+	loop.SetNetwork(&NetworkConf{
+		Default: &LinkConf{Latency: UniformCDF(1, 1)},
+		Links: map[ZonePair]*LinkConf{
+			{From: "a", To: "b"}: {LossRate: 1, RTO: 10, MaxRetransmits: 3},
+			{From: "a", To: "c"}: {LossRate: 1, LossMode: LossDrop},
+		},
+	})
+
+	if penalty, lost := loop.lossPenalty("a", "a"); penalty != 0 || lost {
+		t.Errorf("Expected a lossless link, got %f %v", penalty, lost)
+	}
+
+	// 10 + 20 + 40 then the 4th loss gives up after another 80
+	if penalty, lost := loop.lossPenalty("b", "a"); penalty != 150 || !lost {
+		t.Errorf("Expected 150ms of retransmits then loss, got %f %v", penalty, lost)
+	}
+
+	if penalty, lost := loop.lossPenalty("a", "c"); penalty != defaultRTO || !lost {
+		t.Errorf("Expected an outright drop noticed after an RTO, got %f %v", penalty, lost)
+	}
+}
+
+// runLossy runs a source in zone a against a pool in zone b.
+func runLossy(lossRate float64, mode LossMode) LatencySummary {
+	initTest()
+
+	loop := NewLoop()
+	loop.SetNetwork(&NetworkConf{
+		Default: &LinkConf{
+			Latency:  UniformCDF(1, 2),
+			LossRate: lossRate,
+			LossMode: mode,
+			RTO:      20,
+		},
+	})
+
+	appConf := AppConf{
+		Name:      "lossyServer",
+		Size:      2,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 3)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+		Zones:     []string{"b"},
+	}
+
+	lbConf := LbConf{Name: "lossyServer", App: &appConf}
+	MakeLB(&lbConf, loop)
+
+	sourceConf := makeTestSourceConf("lossySource", 0.5, "lossyServer", 100.0)
+	sourceConf.Zone = "a"
+	source := MakeSource(&sourceConf, loop)
+
+	loop.Run(300)
+
+	return source.Latency()
+}
+
+// TestLossyLink checks retransmits stretch the tail and drops show up
+// as timeouts.
+func TestLossyLink(t *testing.T) {
+	clean := runLossy(0, LossRetransmit)
+	retransmit := runLossy(0.1, LossRetransmit)
+	drop := runLossy(0.1, LossDrop)
+
+	t.Logf("p99 clean=%.1fms retransmit=%.1fms; errors drop=%d", clean.P99, retransmit.P99, drop.Errors)
+
+	if retransmit.P99 < clean.P99+20 {
+		t.Errorf("Expected retransmits to add to the tail: %.1f vs %.1f", retransmit.P99, clean.P99)
+	}
+
+	if clean.Errors != 0 || drop.Errors == 0 {
+		t.Errorf("Expected timeouts only on the dropping link: clean=%d drop=%d", clean.Errors, drop.Errors)
+	}
+}
+
+// TestLossOncePerHop checks a call through the LB is only exposed to
+// the link's loss once each way, and lost calls without a timeout
+// still fail.
+func TestLossOncePerHop(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+	loop.SetNetwork(&NetworkConf{
+		Default: &LinkConf{Latency: UniformCDF(1, 2), LossRate: 0.2, LossMode: LossDrop, RTO: 20},
+	})
+
+	appConf := AppConf{
+		Name:      "hopServer",
+		Size:      2,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 3)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "hopServer", App: &appConf}, loop)
+
+	sourceConf := makeTestSourceConf("hopSource", 0.5, "hopServer", 0)
+	source := MakeSource(&sourceConf, loop)
+
+	loop.Run(600)
+
+	s := source.Latency()
+	t.Logf("%+v error rate %.2f", s, s.ErrorRate())
+
+	// 1 - 0.8^2 = 0.36 lost once each way, 0.59 if drawn on every send
+	if s.ErrorRate() < 0.2 || s.ErrorRate() > 0.5 {
+		t.Errorf("Expected about a third of the calls lost, got %.2f", s.ErrorRate())
+	}
+}
@@ -0,0 +1,394 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultMetricsIntervalMs = 1000
+
+// Metric scopes: one app instance, the instances behind one LB
+// together, one source and the gauges added in the MetricsConf.
+const (
+	ScopeNode   = "node"
+	ScopePool   = "pool"
+	ScopeSource = "source"
+	ScopeCustom = "custom"
+)
+
+// MetricsConf turns on sampling time series metrics during a run.
+// Each interval every instance, pool and source gets a sample of:
+//
+//	cpu, memory, network, disk  mean utilization (0.0 to 1.0)
+//	queue_length                calls waiting for a worker
+//	in_flight                   calls being worked on
+//	pending_calls               remote calls waiting on a reply
+//	throughput                  replies per second
+//	errors                      failed replies
+//	latency_p50, _p90, _p99     reply latency in ms
+//
+// Pools sum the counts and average the utilizations of their
+// instances.  Sources have only the last three.
+type MetricsConf struct {
+	IntervalMs Milliseconds              // sample period (0 = 1000)
+	Series     []string                  // series to keep (nil = all)
+	Gauges     map[string]func() float64 // extra series, sampled under ScopeCustom
+}
+
+// MetricSample is one value of one series.
+type MetricSample struct {
+	Time   Milliseconds
+	Scope  string // ScopeNode, ScopePool, ScopeSource or ScopeCustom
+	Name   string // the instance, pool, source or gauge
+	Series string
+	Value  float64
+}
+
+// metricWindow is what a node has seen since the last sample.
+type metricWindow struct {
+	mu       sync.Mutex
+	latency  []float64
+	errors   int
+	histFrom int // Historical index the window starts at
+}
+
+// metricsRecorder samples the loop's series.
+type metricsRecorder struct {
+	mu      sync.Mutex
+	conf    *MetricsConf
+	keep    map[string]bool
+	samples []MetricSample
+}
+
+// SetMetrics turns on sampling time series metrics for the run.
+func (l *Loop) SetMetrics(conf *MetricsConf) {
+	m := &metricsRecorder{conf: conf}
+
+	if len(conf.Series) > 0 {
+		m.keep = make(map[string]bool, len(conf.Series))
+		for _, s := range conf.Series {
+			m.keep[s] = true
+		}
+	}
+
+	l.metrics = m
+}
+
+// interval is the sample period.
+func (m *metricsRecorder) interval() Milliseconds {
+	if m.conf.IntervalMs <= 0 {
+		return defaultMetricsIntervalMs
+	}
+
+	return m.conf.IntervalMs
+}
+
+// recordReply notes a reply an app instance sent, or a source got,
+// for the metrics.
+func (n *node) recordReply(c *Call, r *Reply) {
+	if n.loop == nil || n.loop.metrics == nil || n.callCB != nil {
+		return
+	}
+
+	n.window.add(n.loop.GetTime()-float64(c.StartTime), r.status != 0)
+}
+
+// add notes one reply.
+func (w *metricWindow) add(ms float64, failed bool) {
+	w.mu.Lock()
+	w.latency = append(w.latency, ms)
+
+	if failed {
+		w.errors++
+	}
+
+	w.mu.Unlock()
+}
+
+// take returns the window's latencies and errors and starts a new one.
+func (w *metricWindow) take() ([]float64, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lat, errs := w.latency, w.errors
+	w.latency, w.errors = nil, 0
+
+	return lat, errs
+}
+
+// metricSet is the series of one instance, pool or source for one
+// sample; utilizations are averaged over the instances, counts summed.
+type metricSet struct {
+	util      map[string]float64
+	counts    map[string]float64
+	latency   []float64
+	errors    int
+	instances int
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{util: map[string]float64{}, counts: map[string]float64{}}
+}
+
+// add folds another instance's set in.
+func (s *metricSet) add(o *metricSet) {
+	for k, v := range o.util {
+		s.util[k] += v
+	}
+
+	for k, v := range o.counts {
+		s.counts[k] += v
+	}
+
+	s.latency = append(s.latency, o.latency...)
+	s.errors += o.errors
+	s.instances++
+}
+
+// nodeMetrics takes the node's set for the window just ended.
+func (n *node) nodeMetrics() *metricSet {
+	s := newMetricSet()
+	s.instances = 1
+
+	n.resources.mu.Lock()
+	from := n.window.histFrom
+	s.util["cpu"] = meanFrom(n.resources.cpu.Historical, from)
+	s.util["memory"] = meanFrom(n.resources.memory.Historical, from)
+	s.util["network"] = meanFrom(n.resources.network.Historical, from)
+
+	if n.disk != nil {
+		s.util["disk"] = meanFrom(n.resources.disk.Historical, from)
+	}
+
+	n.window.histFrom = len(n.resources.cpu.Historical)
+	n.resources.mu.Unlock()
+
+	// without a worker pool calls wait only to arrive
+	if n.App.Workers > 0 {
+		n.workers.mu.Lock()
+		s.counts["queue_length"] = float64(n.workers.queue.len())
+		s.counts["in_flight"] = float64(n.workers.busy)
+		n.workers.mu.Unlock()
+	} else {
+		n.callsMu.Lock()
+		s.counts["queue_length"] = float64(len(n.calls))
+		n.callsMu.Unlock()
+
+		s.counts["in_flight"] = float64(n.inFlight.Load())
+	}
+
+	n.pendingCallMapMu.RLock()
+	s.counts["pending_calls"] = float64(len(n.pendingCallMap))
+	n.pendingCallMapMu.RUnlock()
+
+	s.latency, s.errors = n.window.take()
+
+	return s
+}
+
+// meanFrom is the mean of xs[from:], or the last value if there is
+// nothing new.
+func meanFrom(xs []float64, from int) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+
+	if from >= len(xs) {
+		return xs[len(xs)-1]
+	}
+
+	sum := 0.0
+	for _, x := range xs[from:] {
+		sum += x
+	}
+
+	return sum / float64(len(xs)-from)
+}
+
+// sampleMetrics records a sample of every series at the end of each
+// interval, stamped with the end of the ms just run.
+func (l *Loop) sampleMetrics() {
+	m := l.metrics
+	if m == nil {
+		return
+	}
+
+	now := Milliseconds(l.GetTime()) + 1
+	if int64(now-loopStartMs)%int64(m.interval()) != 0 {
+		return
+	}
+
+	perSec := msInSec / float64(m.interval())
+	sets := map[*node]*metricSet{}
+
+	for _, n := range l.nodes {
+		if n.callCB != nil || n.resources == nil {
+			continue
+		}
+
+		sets[n] = n.nodeMetrics()
+		m.addSet(now, ScopeNode, n.name, sets[n], perSec)
+	}
+
+	for _, name := range l.lbNames() {
+		pool := newMetricSet()
+
+		for _, n := range l.lbs[name].appInstances {
+			if s, ok := sets[n]; ok {
+				pool.add(s)
+			}
+		}
+
+		if pool.instances > 0 {
+			m.addSet(now, ScopePool, strings.TrimSuffix(name, lbSuffix), pool, perSec)
+		}
+	}
+
+	for _, src := range l.sources {
+		s := newMetricSet()
+		s.latency, s.errors = src.n.window.take()
+		m.addSet(now, ScopeSource, src.n.name, s, perSec)
+	}
+
+	names := make([]string, 0, len(m.conf.Gauges))
+	for name := range m.conf.Gauges {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		m.add(MetricSample{Time: now, Scope: ScopeCustom, Name: name, Series: name, Value: m.conf.Gauges[name]()})
+	}
+}
+
+// addSet records the series of one set.
+func (m *metricsRecorder) addSet(now Milliseconds, scope string, name string, s *metricSet, perSec float64) {
+	utils := make([]string, 0, len(s.util))
+	for k := range s.util {
+		utils = append(utils, k)
+	}
+
+	sort.Strings(utils)
+
+	for _, k := range utils {
+		m.add(MetricSample{Time: now, Scope: scope, Name: name, Series: k, Value: s.util[k] / float64(s.instances)})
+	}
+
+	for _, k := range []string{"queue_length", "in_flight", "pending_calls"} {
+		if v, ok := s.counts[k]; ok {
+			m.add(MetricSample{Time: now, Scope: scope, Name: name, Series: k, Value: v})
+		}
+	}
+
+	m.add(MetricSample{Time: now, Scope: scope, Name: name, Series: "throughput",
+		Value: float64(len(s.latency)) * perSec})
+	m.add(MetricSample{Time: now, Scope: scope, Name: name, Series: "errors", Value: float64(s.errors)})
+
+	if len(s.latency) == 0 {
+		return
+	}
+
+	sort.Float64s(s.latency)
+
+	m.add(MetricSample{Time: now, Scope: scope, Name: name, Series: "latency_p50", Value: percentileOf(s.latency, p50)})
+	m.add(MetricSample{Time: now, Scope: scope, Name: name, Series: "latency_p90", Value: percentileOf(s.latency, p90)})
+	m.add(MetricSample{Time: now, Scope: scope, Name: name, Series: "latency_p99", Value: percentileOf(s.latency, p99)})
+}
+
+// add keeps the sample if its series is wanted.
+func (m *metricsRecorder) add(s MetricSample) {
+	if m.keep != nil && !m.keep[s.Series] {
+		return
+	}
+
+	m.mu.Lock()
+	m.samples = append(m.samples, s)
+	m.mu.Unlock()
+}
+
+// Metrics returns the samples recorded so far.
+func (l *Loop) Metrics() []MetricSample {
+	if l.metrics == nil {
+		return nil
+	}
+
+	l.metrics.mu.Lock()
+	defer l.metrics.mu.Unlock()
+
+	return append([]MetricSample(nil), l.metrics.samples...)
+}
+
+// WriteMetricsCSV writes the samples as CSV, one row per sample in
+// long form: time_ms, scope, name, series, value.
+func (l *Loop) WriteMetricsCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write([]string{"time_ms", "scope", "name", "series", "value"}); err != nil {
+		return fmt.Errorf("writing metrics csv: %w", err)
+	}
+
+	for _, s := range l.Metrics() {
+		row := []string{
+			strconv.FormatInt(int64(s.Time), 10),
+			s.Scope,
+			s.Name,
+			s.Series,
+			strconv.FormatFloat(s.Value, 'g', -1, 64),
+		}
+
+		if err := cw.Write(row); err != nil {
+			return fmt.Errorf("writing metrics csv: %w", err)
+		}
+	}
+
+	cw.Flush()
+
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("writing metrics csv: %w", err)
+	}
+
+	return nil
+}
+
+// WriteMetricsParquet writes the samples as a Parquet file with the
+// same columns as WriteMetricsCSV.
+func (l *Loop) WriteMetricsParquet(w io.Writer) error {
+	samples := l.Metrics()
+
+	times := make([]int64, len(samples))
+	scopes := make([]string, len(samples))
+	names := make([]string, len(samples))
+	series := make([]string, len(samples))
+	values := make([]float64, len(samples))
+
+	for i, s := range samples {
+		times[i] = int64(s.Time)
+		scopes[i] = s.Scope
+		names[i] = s.Name
+		series[i] = s.Series
+		values[i] = s.Value
+	}
+
+	err := writeParquet(w, len(samples), []parquetColumn{
+		{name: "time_ms", int64s: times},
+		{name: "scope", strings: scopes},
+		{name: "name", strings: names},
+		{name: "series", strings: series},
+		{name: "value", doubles: values},
+	})
+	if err != nil {
+		return fmt.Errorf("writing metrics parquet: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"testing"
+)
+
+// TestMetricsExport samples a small pool every 100ms and checks the
+// node, pool, source and custom series come out in CSV and Parquet.
+func TestMetricsExport(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+	loop.SetMetrics(&MetricsConf{
+		IntervalMs: 100,
+		Gauges:     map[string]func() float64{"sim_time": loop.GetTime},
+	})
+
+	appConf := AppConf{
+		Name:        "metricsApp",
+		Size:        2,
+		Workers:     4,
+		AcceptQueue: 10,
+		Stages:      []*StageConf{{LocalWork: UniformCDF(1, 3)}},
+		ReplyLen:    UniformCDF(100, 200),
+		Resources:   lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "metricsApp", App: &appConf}, loop)
+
+	sourceConf := makeTestSourceConf("metricsSource", 0.2, "metricsApp", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.Run(500)
+
+	type key struct{ scope, name, series string }
+
+	got := map[key][]float64{}
+
+	for _, s := range loop.Metrics() {
+		k := key{s.Scope, s.Name, s.Series}
+		got[k] = append(got[k], s.Value)
+	}
+
+	for _, k := range []key{
+		{ScopeNode, "metricsApp-0", "cpu"},
+		{ScopeNode, "metricsApp-1", "in_flight"},
+		{ScopePool, "metricsApp", "queue_length"},
+		{ScopePool, "metricsApp", "throughput"},
+		{ScopeSource, "metricsSource", "latency_p99"},
+		{ScopeCustom, "sim_time", "sim_time"},
+	} {
+		if len(got[k]) == 0 {
+			t.Errorf("Expected samples of %+v", k)
+		}
+	}
+
+	if n := len(got[key{ScopeCustom, "sim_time", "sim_time"}]); n != 5 {
+		t.Errorf("Expected 5 samples in 500ms every 100ms, got %d", n)
+	}
+
+	total := 0.0
+	for _, v := range got[key{ScopePool, "metricsApp", "throughput"}] {
+		total += v
+	}
+
+	if total < 100 {
+		t.Errorf("Expected the pool to reply to ~200 calls/s, got %v", got[key{ScopePool, "metricsApp", "throughput"}])
+	}
+
+	var buf bytes.Buffer
+	if err := loop.WriteMetricsCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != len(loop.Metrics())+1 || rows[0][3] != "series" {
+		t.Errorf("Expected a header and a row per sample, got %d rows, header %v", len(rows), rows[0])
+	}
+
+	buf.Reset()
+
+	if err := loop.WriteMetricsParquet(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	b := buf.Bytes()
+	if string(b[:4]) != parquetMagic || string(b[len(b)-4:]) != parquetMagic {
+		t.Fatalf("Expected Parquet magic at both ends")
+	}
+
+	footer := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	if footer <= 0 || footer > len(b)-12 {
+		t.Errorf("Expected a footer inside the file, got length %d of %d", footer, len(b))
+	}
+}
+
+// TestMetricsSeriesFilter keeps only the series asked for.
+func TestMetricsSeriesFilter(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+	loop.SetMetrics(&MetricsConf{IntervalMs: 50, Series: []string{"throughput"}})
+
+	appConf := AppConf{
+		Name:      "metricsFilter",
+		Size:      1,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 2)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "metricsFilter", App: &appConf}, loop)
+
+	sourceConf := makeTestSourceConf("metricsFilterSource", 0.1, "metricsFilter", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.Run(200)
+
+	samples := loop.Metrics()
+	if len(samples) == 0 {
+		t.Fatal("Expected throughput samples")
+	}
+
+	for _, s := range samples {
+		if s.Series != "throughput" {
+			t.Fatalf("Expected only throughput, got %+v", s)
+		}
+	}
+}
+
+// TestMetricsWithoutWorkers reports calls in flight on a node without
+// a worker pool.
+func TestMetricsWithoutWorkers(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+	loop.SetMetrics(&MetricsConf{IntervalMs: 50, Series: []string{"in_flight", "queue_length"}})
+
+	appConf := AppConf{
+		Name:      "metricsNoPool",
+		Size:      1,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(20, 30)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "metricsNoPool", App: &appConf}, loop)
+
+	sourceConf := makeTestSourceConf("metricsNoPoolSource", 0.2, "metricsNoPool", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.Run(500)
+
+	seen := map[string]bool{}
+	busy := false
+
+	for _, s := range loop.Metrics() {
+		if s.Name == "metricsNoPool-0" {
+			seen[s.Series] = true
+			busy = busy || (s.Series == "in_flight" && s.Value > 0)
+		}
+	}
+
+	if !seen["in_flight"] || !seen["queue_length"] || !busy {
+		t.Errorf("Expected in_flight and queue_length with calls in flight, got %v busy=%v", seen, busy)
+	}
+}
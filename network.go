@@ -0,0 +1,212 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+
+	count "github.com/jayalane/go-counter"
+)
+
+// LinkConf describes the network path between two zones.
+type LinkConf struct {
+	Latency   ModelCdf // one way delay in ms
+	Bandwidth float64  // bytes per ms shared by transfers between the zones (0 = unlimited)
+
+	// Optional loss on the link
+	LossRate       float64      // 0.0 to 1.0 chance each send of a call or reply is lost
+	LossMode       LossMode     // retransmit after an RTO or drop outright
+	RTO            Milliseconds // first retransmission timeout (0 = 200ms), doubles each loss
+	MaxRetransmits int          // give up after this many (0 = 6)
+}
+
+// ZonePair keys the zone (or region) latency matrix.  Lookups try
+// From→To first and then To→From, so symmetric links need one entry.
+type ZonePair struct {
+	From string
+	To   string
+}
+
+// NetworkConf places zones into regions and gives the latency matrix
+// between them.  Without one the loop uses a flat networkDelayConst
+// per call hop and delivers replies instantly.
+type NetworkConf struct {
+	Default     *LinkConf              // used when nothing more specific matches
+	Links       map[ZonePair]*LinkConf // zone to zone
+	Regions     map[string]string      // zone -> region
+	RegionLinks map[ZonePair]*LinkConf // region to region, if no zone link
+}
+
+// SetNetwork sets the zone latency matrix for the loop.  Call before Run.
+func (l *Loop) SetNetwork(nc *NetworkConf) {
+	l.network = nc
+}
+
+// link returns the most specific link config between two zones.
+func (nc *NetworkConf) link(from string, to string) *LinkConf {
+	if lc := lookupLink(nc.Links, from, to); lc != nil {
+		return lc
+	}
+
+	if lc := lookupLink(nc.RegionLinks, nc.Regions[from], nc.Regions[to]); lc != nil {
+		return lc
+	}
+
+	return nc.Default
+}
+
+// lookupLink checks a link map in both directions.
+func lookupLink(links map[ZonePair]*LinkConf, from string, to string) *LinkConf {
+	if lc, ok := links[ZonePair{From: from, To: to}]; ok {
+		return lc
+	}
+
+	if lc, ok := links[ZonePair{From: to, To: from}]; ok {
+		return lc
+	}
+
+	return nil
+}
+
+// callDelay returns the network delay for a call hop between zones.
+func (l *Loop) callDelay(from string, to string) Milliseconds {
+	if l.network == nil {
+		return networkDelayConst
+	}
+
+	return l.sampleLatency(from, to)
+}
+
+// replyDelay returns the network delay for a reply hop between zones.
+func (l *Loop) replyDelay(from string, to string) Milliseconds {
+	if l.network == nil {
+		return 0
+	}
+
+	return l.sampleLatency(from, to)
+}
+
+// sampleLatency draws a one way delay from the matrix.
+func (l *Loop) sampleLatency(from string, to string) Milliseconds {
+	lc := l.network.link(from, to)
+	if lc == nil || lc.Latency == nil {
+		return networkDelayConst
+	}
+
+	p := rand.Float64() //nolint:gosec
+
+	return Milliseconds(lc.Latency(p))
+}
+
+// delayedReplies holds replies still crossing the network to a node.
+type delayedReplies struct {
+	mu      sync.Mutex
+	replies PQueue
+}
+
+// deliverReply hands a reply to n after delay ms.
+func (n *node) deliverReply(r *Reply, delay Milliseconds) {
+	// a frozen node picks it up when it thaws
+	if delay <= 0 && !n.isFrozen() {
+		n.handOver(r)
+
+		return
+	}
+
+	n.arriving.mu.Lock()
+	heap.Push(&n.arriving.replies, &Item{
+		value:    r,
+		priority: int(Milliseconds(n.loop.GetTime()) + delay),
+	})
+	n.arriving.mu.Unlock()
+}
+
+// sendReply sends a reply for c back across the network to its
+// caller.  Replies from an app instance cross the zone link to the
+// caller's zone; an LB handing a reply on stays in the caller's zone.
+func (n *node) sendReply(c *Call, r *Reply) {
+	n.loop.endSpan(c.span, statusTags(r.status)...)
+	n.recordReply(c, r)
+	n.promReply(c, r)
+
+	from, to, landing := n.zone, c.fromZone, true
+	if n.callCB != nil {
+		from, landing = c.fromZone, false
+	}
+
+	delay := n.loop.replyDelay(from, to)
+
+	// like calls, loss is drawn once on the hop back from the instance
+	if landing {
+		penalty, lost := n.loop.lossPenalty(from, to)
+		if lost {
+			count.IncrSyncSuffix("network_reply_lost", n.name)
+			ml.La(n.name+": Reply lost in the network", r.reqID)
+			c.caller.deliverReply(c.lostReply(r.reqID), delay+penalty)
+
+			return
+		}
+
+		delay += penalty
+	}
+
+	if n.loop.startTransfer(n, c.caller, from, to, landing, r.length,
+		func(_ Milliseconds) {
+			c.caller.deliverReply(r, delay)
+		}) {
+		return
+	}
+
+	c.caller.deliverReply(r, delay)
+}
+
+// releaseReplies delivers the replies that have arrived by now.
+func (n *node) releaseReplies() {
+	now := n.loop.GetTime()
+
+	n.arriving.mu.Lock()
+	defer n.arriving.mu.Unlock()
+
+	for {
+		next := n.arriving.replies.Peak()
+		if next == nil || float64(next.priority) > now {
+			return
+		}
+
+		item := heap.Pop(&n.arriving.replies)
+
+		r, ok := item.(*Item).value.(*Reply)
+		if !ok {
+			panic("Got non-reply from reply pqueue")
+		}
+
+		n.handOver(r)
+	}
+}
+
+// handOver puts a reply on the reply channel, unless the node has
+// stopped at the end of the run.
+func (n *node) handOver(r *Reply) {
+	select {
+	case n.replyCh <- r:
+	case <-n.done:
+		ml.La(n.name+": Stopped, dropping reply", r.reqID)
+	}
+}
+
+// nodesInZone returns the app nodes placed in a zone.
+func (l *Loop) nodesInZone(zone string) []*node {
+	var res []*node
+
+	for _, n := range l.nodes {
+		if n.zone == zone && n.callCB == nil {
+			res = append(res, n)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,81 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"os"
+	"testing"
+)
+
+// runZones runs a two zone pool fed from zone a and returns the LB and
+// the source.
+func runZones(affinity bool, outage bool) (*LB, *Source) {
+	initTest()
+
+	loop := NewLoop()
+	loop.SetNetwork(&NetworkConf{
+		Default: &LinkConf{Latency: UniformCDF(1, 2)},
+		Links: map[ZonePair]*LinkConf{
+			{From: "a", To: "b"}: {Latency: UniformCDF(20, 25)},
+		},
+	})
+
+	appConf := AppConf{
+		Name:      "zoneServer",
+		Size:      4,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 3)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+		Zones:     []string{"a", "b"},
+	}
+
+	lbConf := LbConf{Name: "zoneServer", App: &appConf, ZoneAffinity: affinity}
+	lb := MakeLB(&lbConf, loop)
+
+	sourceConf := makeTestSourceConf("zoneSource", 1, "zoneServer", 500.0)
+	sourceConf.Zone = "a"
+	source := MakeSource(&sourceConf, loop)
+
+	if outage {
+		loop.AddFault(&Fault{Kind: FaultZoneOutage, Target: "a", Start: 50})
+	}
+
+	loop.Run(150)
+	loop.WriteInstanceReport(os.Stdout)
+
+	return lb, source
+}
+
+// TestZoneAffinity checks zone aware routing keeps traffic local, is
+// faster than spreading across zones, and fails over on a zone outage.
+func TestZoneAffinity(t *testing.T) {
+	lb, local := runZones(true, false)
+
+	for i, is := range lb.InstanceStats() {
+		if lb.appInstances[i].zone == "b" && is.Sent > 0 {
+			t.Errorf("Expected no calls to zone b, %s got %d", is.Name, is.Sent)
+		}
+	}
+
+	_, spread := runZones(false, false)
+
+	t.Logf("mean latency local=%.1fms spread=%.1fms", local.Latency().Mean, spread.Latency().Mean)
+
+	if local.Latency().Mean >= spread.Latency().Mean {
+		t.Error("Expected zone local routing to be faster than cross zone")
+	}
+
+	lb, _ = runZones(true, true)
+
+	crossZone := 0
+
+	for i, is := range lb.InstanceStats() {
+		if lb.appInstances[i].zone == "b" {
+			crossZone += is.Sent
+		}
+	}
+
+	if crossZone == 0 {
+		t.Error("Expected calls to fail over to zone b during the outage")
+	}
+}
@@ -7,7 +7,9 @@ package sim
 import (
 	"container/heap"
 	"math/rand"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	count "github.com/jayalane/go-counter"
@@ -36,17 +38,51 @@ type node struct {
 	replyCh          chan *Reply
 	done             chan bool
 	name             string
+	pool             string         // LB name the instance is behind, without the suffix
 	resources        *NodeResources // Resource utilization tracking
 	outboundQueue    []*OutboundCall
 	outboundMu       sync.Mutex
+	faultsMu         sync.RWMutex
+	activeFaults     []*Fault
+	degradation      *Degradation
+	zone             string
+	cores            *psCPU
+	heap             *heapState
+	disk             *diskState
+	nicIn            *bwLink
+	nicOut           *bwLink
+	poolsMu          sync.Mutex
+	pools            map[string]*connPool
+	limiter          *rateLimiter
+	breakersMu       sync.Mutex
+	breakers         map[string]*breaker
+	callerLimitsMu   sync.Mutex
+	callerLimits     map[string]*adaptiveLimiter
+	adaptive         *adaptiveLimiter
+	retriesMu        sync.Mutex
+	retryBudget      *retryBudget
+	retryCounts      map[string]*retryCounts
+	resends          []*pendingResend
+	hedgesMu         sync.Mutex
+	hedges           map[string]*hedgeTracker
+	shedder          *shedder
+	cancels          cancelCounts
+	bulkheadsMu      sync.Mutex
+	bulkheads        map[string]*bulkhead
+	workers          workerPool
+	inFlight         atomic.Int64 // calls started and not yet finished
+	arriving         delayedReplies
+	window           metricWindow
 	App              *AppConf
 }
 
 type pendingCall struct {
 	//	reqID int
-	reply *Reply
-	call  *Call
-	f     handleReply
+	reply  *Reply
+	call   *Call
+	callee *node // where the call was sent
+	f      handleReply
+	sentAt Milliseconds
 }
 
 // InitCallMap inits the pending call hash and
@@ -84,11 +120,86 @@ func (n *node) initCallMap() {
 				ml.La(n.name+": done handling reply", n.loop.GetTime(), response)
 			case <-time.After(secondsInMin * time.Second):
 				ml.La(n.name+": one minute with no replies", n.loop.GetTime())
+			case <-n.done:
+				ml.La(n.name + ": reply loop shutting down on done")
+				n.loop.running.Done()
+
+				return
 			}
 		}
 	}()
 }
 
+// expirePendingCalls gives up on calls that have had no reply within
+// their configured timeout, answering them locally with a 504.
+func (n *node) expirePendingCalls() {
+	now := Milliseconds(n.loop.GetTime())
+
+	var expired []*pendingCall
+
+	n.pendingCallMapMu.Lock()
+
+	for reqID, pc := range n.pendingCallMap {
+		if pc.call.replyTimeout > 0 && now-pc.sentAt > pc.call.replyTimeout {
+			expired = append(expired, pc)
+			delete(n.pendingCallMap, reqID)
+		}
+	}
+
+	n.pendingCallMapMu.Unlock()
+
+	for _, pc := range expired {
+		count.IncrSyncSuffix("call_timeout", n.name)
+		ml.La(n.name+": Call timed out", pc.call.ReqID)
+		pc.call.cancel.cancel()
+
+		pc.f(n, &Reply{
+			reqID:  pc.call.ReqID,
+			status: http.StatusGatewayTimeout,
+			call:   pc.call,
+		})
+	}
+}
+
+// resetCallsTo answers every call waiting on the dead node with a
+// 503, as its connections reset when the container dies.  The reset
+// reaches the callers next ms; a late reply from it is then dropped
+// as unknown.
+func (l *Loop) resetCallsTo(dead *node) {
+	for _, s := range l.sources {
+		s.n.resetPendingTo(dead)
+	}
+
+	for _, n := range l.nodes {
+		n.resetPendingTo(dead)
+	}
+}
+
+// resetPendingTo answers this node's calls waiting on the dead node.
+func (n *node) resetPendingTo(dead *node) {
+	var reset []*pendingCall
+
+	n.pendingCallMapMu.RLock()
+
+	for _, pc := range n.pendingCallMap {
+		if pc.callee == dead {
+			reset = append(reset, pc)
+		}
+	}
+
+	n.pendingCallMapMu.RUnlock()
+
+	for _, pc := range reset {
+		count.IncrSyncSuffix("call_connection_reset", n.name)
+		ml.La(n.name+": Connection reset by", dead.name, pc.call.ReqID)
+		n.deliverReply(&Reply{
+			reqID:  pc.call.ReqID,
+			status: http.StatusServiceUnavailable,
+			call:   pc.call,
+		}, 1)
+	}
+}
+
 func (n *node) addCall(j *Call) {
 	n.callsMu.Lock()
 	defer n.callsMu.Unlock()
@@ -121,15 +232,11 @@ func (n *node) addTask(t *Task) {
 // If the callee has room, it consumes network and pushes onto callCh.
 // Returns true if the call was accepted, false otherwise.
 func (n *node) tryAcceptCall(c *Call) bool {
-	if n.resources != nil {
-		n.resources.mu.RLock()
-		isDown := n.resources.isDown
-		n.resources.mu.RUnlock()
-
-		if isDown {
-			return false
-		}
+	if !n.IsAvailable() {
+		return false
+	}
 
+	if n.resources != nil {
 		if err := n.consumeNetworkForCall(); err != nil {
 			return false
 		}
@@ -197,12 +304,7 @@ func (n *node) drainOutbound() {
 // processOutboundCall handles a single outbound call. Returns true if the
 // call should be retained in the queue, false if it was delivered or failed.
 func (n *node) processOutboundCall(oc *OutboundCall, now Milliseconds) bool {
-	// Check retry backoff delay
-	if oc.retryState != nil && now < oc.retryState.nextRetryAt {
-		return true
-	}
-
-	// Check timeout
+	// Check timeout, even while backing off
 	if oc.call.TimeoutMs > 0 && float64(now-oc.queuedAt) > oc.call.TimeoutMs {
 		n.sendErrorReply(oc.call, "Outbound call timed out")
 		count.IncrSyncSuffix("outbound_timeout", n.name)
@@ -211,6 +313,11 @@ func (n *node) processOutboundCall(oc *OutboundCall, now Milliseconds) bool {
 		return false
 	}
 
+	// Check retry backoff delay
+	if oc.retryState != nil && now < oc.retryState.nextRetryAt {
+		return true
+	}
+
 	// Attempt delivery
 	if oc.callee.tryAcceptCall(oc.call) {
 		count.IncrSyncSuffix("outbound_delivered", n.name)
@@ -279,37 +386,163 @@ func (n *node) buildRemoteCallsFunc(c *Call, h *StageConf) func() {
 				ml.La(n.name+": Got a reply", *r)
 			}
 
-			if rc.Retry != nil {
-				rs := &RetryState{policy: rc.Retry}
-				newCall.sendCallWithRetry(&lb.n, replyHandler, rs)
-			} else {
-				newCall.sendCall(&lb.n, replyHandler)
+			if h.AwaitReplies {
+				atomic.AddInt32(&c.outstanding, 1)
+
+				replyHandler = func(n *node, r *Reply) {
+					ml.La(n.name+": Got an awaited reply", *r)
+
+					if r.status != 0 {
+						atomic.CompareAndSwapUint64(&c.childStatus, 0, r.status)
+					}
+
+					n.awaitDone(c)
+				}
 			}
+
+			replyHandler = n.edgeReply(rc.Endpoint, newCall.StartTime, replyHandler)
+
+			if rc.Hedge != nil {
+				n.hedgeRemoteCall(rc, newCall, lb, replyHandler)
+
+				continue
+			}
+
+			n.attemptRemoteCall(rc, newCall, lb, replyHandler, 0)
+		}
+	}
+}
+
+// attemptRemoteCall sends one attempt of a remote call, retrying it
+// on failure and holding a bulkhead slot if the RemoteCall says to.
+func (n *node) attemptRemoteCall(rc *RemoteCall, c *Call, lb *LB, f handleReply, attempt int) {
+	if rc.Retry != nil && len(rc.Retry.RetryOn) > 0 {
+		f = n.retryOnReply(rc, c, lb, f, attempt)
+	}
+
+	if rc.Bulkhead != nil {
+		n.bulkheadAttempt(rc, c, f, func(f handleReply) {
+			n.guardedSend(rc, c, lb, f)
+		})
+
+		return
+	}
+
+	n.guardedSend(rc, c, lb, f)
+}
+
+// guardedSend sends the call through the caller's breaker and
+// concurrency limit, if it has them.
+func (n *node) guardedSend(rc *RemoteCall, c *Call, lb *LB, f handleReply) {
+	// An open breaker fails the call fast without sending it
+	if rc.Breaker != nil {
+		var ok bool
+
+		f, ok = n.breakerAllow(rc, c, f)
+		if !ok {
+			return
+		}
+	}
+
+	if rc.ConcurrencyLimit != nil {
+		var ok bool
+
+		f, ok = n.callerLimitAllow(rc, c, f)
+		if !ok {
+			return
 		}
 	}
+
+	n.sendRemoteCall(rc, c, lb, f)
+}
+
+// sendRemoteCall sends a stage's remote call to the endpoint's LB,
+// through the caller's connection pool if it has one.
+func (n *node) sendRemoteCall(rc *RemoteCall, c *Call, lb *LB, f handleReply) {
+	if n.App.Connections != nil {
+		n.sendPooled(rc, c, lb, f)
+
+		return
+	}
+
+	n.sendDirect(rc, c, lb, f)
+}
+
+// sendDirect sends the call, with its retry policy if any.
+func (n *node) sendDirect(rc *RemoteCall, c *Call, lb *LB, f handleReply) {
+	if rc.Retry != nil {
+		rs := &RetryState{policy: rc.Retry}
+		c.sendCallWithRetry(&lb.n, f, rs)
+	} else {
+		c.sendCall(&lb.n, f)
+	}
 }
 
 // handleCall processes an incoming call.
 func (n *node) handleCall(c *Call) {
 	ml.La(n.name+": Got an incoming call:", c, n.name, c.ReqID)
+	n.traceServer(c)
 
 	// Check if node is down - send error reply instead of queuing
-	if n.resources != nil && !n.IsAvailable() {
+	if !n.IsAvailable() {
 		n.sendErrorReply(c, "Node is down")
 		ml.La(n.name + ": Node down, sending error reply")
 
 		return
 	}
 
+	// Injected error rate from the chaos schedule
+	if rate := n.faultErrorRate(); rate > 0 && rand.Float64() < rate { //nolint:gosec
+		count.IncrSyncSuffix("node_fault_error_reply", n.name)
+		n.sendErrorReply(c, "Injected fault error")
+
+		return
+	}
+
+	if !n.shedAdmit(c) || !n.rateLimit(c) || !n.adaptiveAdmit(c) {
+		return
+	}
+
+	// With a worker pool the call may have to wait for a worker
+	if n.App.Workers > 0 {
+		n.admitCall(c)
+
+		return
+	}
+
+	n.startCall(c)
+}
+
+// startCall builds the tasks for a call and queues them.
+func (n *node) startCall(c *Call) {
+	if n.dropCancelledCall(c) {
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&c.running, 0, 1) {
+		n.inFlight.Add(1)
+	}
 	// Consume memory for new call (network already consumed in tryAcceptCall)
 	if n.resources != nil {
 		if err := n.consumeMemoryForCall(); err != nil {
 			ml.La(n.name+": Memory resource error:", err.Error())
+			n.finishCall(c)
+
+			return
+		}
+	}
+
+	if n.heap != nil {
+		if err := n.allocCall(c); err != nil {
+			ml.La(n.name+": Heap error:", err.Error())
+			n.finishCall(c)
 
 			return
 		}
 	}
 
+	extra := n.faultLatency()
+	mult := n.workMultiplier()
 	tasks := make([]Task, len(n.App.Stages))
 
 	for i, h := range n.App.Stages {
@@ -318,11 +551,14 @@ func (n *node) handleCall(c *Call) {
 		count.IncrSyncSuffix("node_task_make_"+c.caller.name, n.name)
 
 		p := rand.Float64() //nolint:gosec
+		work := h.LocalWork(p) * mult
 
 		tasks[i] = Task{
-			wakeup: Milliseconds(n.loop.GetTime() + h.LocalWork(p)), // TBD
+			wakeup: Milliseconds(n.loop.GetTime()+work) + extra, // TBD
 			call:   c,
 			reqID:  c.ReqID,
+			work:   work,
+			stage:  h,
 		}
 
 		tasks[i].later = n.buildRemoteCallsFunc(c, h)
@@ -332,7 +568,21 @@ func (n *node) handleCall(c *Call) {
 		tasks[i].nextTask = &tasks[i+1]
 	}
 
+	n.traceStart(c, tasks)
+
+	if n.App.awaitsReplies() {
+		c.awaits = true
+		atomic.StoreInt32(&c.outstanding, int32(len(tasks))) //nolint:gosec
+	}
+
 	for i := range tasks {
+		// With cores the work is CPU demand that waits its share
+		if n.cores != nil {
+			n.cores.run(&cpuJob{remaining: tasks[i].work * n.cpuMultiplier(), extra: extra, task: &tasks[i]})
+
+			continue
+		}
+
 		ml.La(n.name+": adding task", tasks[i].wakeup, tasks[i].later, len(n.tasks))
 		n.addTask(&tasks[i])
 	}
@@ -410,6 +660,14 @@ func (n *node) runner() {
 			n.callsMu.Lock()
 			ml.La(n.name+": Raw Node got ms", len(n.calls))
 			n.callsMu.Unlock()
+
+			if n.isFrozen() {
+				count.IncrSyncSuffix("node_frozen_ms", n.name)
+				msWg.Done()
+
+				continue
+			}
+
 			n.handleCalls()
 			n.handleTasks()
 			ml.La(n.name + ": Ending msWG")
@@ -420,6 +678,7 @@ func (n *node) runner() {
 
 		case <-n.done:
 			ml.La(n.name + ":Node shutting down on done")
+			n.loop.running.Done()
 
 			return
 		}
@@ -431,10 +690,13 @@ func (n *node) runner() {
 func (n *node) run() {
 	ml.La(n.name, ": Doing Run/Init", goid())
 
+	// the runner and reply loop both stop when done is closed
+	n.done = make(chan bool)
+	n.loop.running.Add(2) //nolint:mnd
+
 	n.initCallMap()
 
 	n.callCh = make(chan *Call, bufferSizes) // ?
-	n.done = make(chan bool, smallChannelSize)
 	n.msCh = n.loop.broadcaster.Subscribe()
 	n.calls = make(PQueue, 0)
 	n.tasks = make(PQueue, 0)
@@ -448,8 +710,21 @@ func (n *node) run() {
 func (n *node) nextMillisecond() {
 	ml.La(n.name+":  running", n.loop.GetTime())
 
-	// Drain outbound queue each tick
-	n.drainOutbound()
+	n.sampleWorkers()
+	n.advanceCPU()
+
+	// Hand over replies that have crossed the network, time out calls,
+	// run the disk, drain outbound queue, send due retries and give
+	// out freed pool and bulkhead slots each tick, unless frozen
+	if !n.isFrozen() {
+		n.releaseReplies()
+		n.expirePendingCalls()
+		n.tickConnPools()
+		n.advanceDisk()
+		n.drainOutbound()
+		n.sendResends()
+		n.tickBulkheads()
+	}
 
 	// Update resource utilization
 	if n.resources != nil {
@@ -465,7 +740,13 @@ func (n *node) nextMillisecond() {
 		count.MarkDistributionSuffix("cpu_utilization", cpuCurrent, n.name)
 		count.MarkDistributionSuffix("memory_utilization", memoryCurrent, n.name)
 		count.MarkDistributionSuffix("network_utilization", networkCurrent, n.name)
+
+		if n.disk != nil {
+			count.MarkDistributionSuffix("disk_utilization", n.disk.utilization()*oneHundred, n.name)
+		}
 	}
+
+	n.updateShedding()
 }
 
 // generateEvent does nothing for a base node.
@@ -0,0 +1,260 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// a minimal Parquet writer: one row group of required, plain encoded,
+// uncompressed columns, enough for notebooks to load flat tables.
+
+const parquetMagic = "PAR1"
+
+// Parquet physical and converted types and encodings used.
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+	parquetUTF8      = 0
+	parquetRequired  = 0
+	parquetPlain     = 0
+	parquetRLE       = 3
+	parquetDataPage  = 0
+)
+
+// Thrift compact protocol field types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// parquetColumn is one column; set exactly one of the value slices.
+type parquetColumn struct {
+	name    string
+	int64s  []int64
+	doubles []float64
+	strings []string
+}
+
+// physical is the column's Parquet type.
+func (c *parquetColumn) physical() int32 {
+	switch {
+	case c.int64s != nil:
+		return parquetInt64
+	case c.doubles != nil:
+		return parquetDouble
+	}
+
+	return parquetByteArray
+}
+
+// plain is the column's values, plain encoded.
+func (c *parquetColumn) plain() []byte {
+	var buf bytes.Buffer
+
+	var b [8]byte
+
+	for _, v := range c.int64s {
+		binary.LittleEndian.PutUint64(b[:], uint64(v)) //nolint:gosec
+		buf.Write(b[:])
+	}
+
+	for _, v := range c.doubles {
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		buf.Write(b[:])
+	}
+
+	for _, v := range c.strings {
+		binary.LittleEndian.PutUint32(b[:4], uint32(len(v))) //nolint:gosec
+		buf.Write(b[:4])
+		buf.WriteString(v)
+	}
+
+	return buf.Bytes()
+}
+
+// thriftWriter writes Thrift's compact protocol.
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16 // last field id per open struct
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63))) //nolint:gosec,mnd
+}
+
+// field writes a field header.
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+
+	if d := id - *last; d > 0 && d <= 15 {
+		t.buf.WriteByte(byte(d)<<4 | typ) //nolint:gosec,mnd
+	} else {
+		t.buf.WriteByte(typ)
+		t.zigzag(int64(id))
+	}
+
+	*last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+// list writes a list header; the elements follow.
+func (t *thriftWriter) list(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+
+	if n < 15 { //nolint:mnd
+		t.buf.WriteByte(byte(n)<<4 | elem) //nolint:gosec,mnd
+	} else {
+		t.buf.WriteByte(0xf0 | elem) //nolint:mnd
+		t.varint(uint64(n))
+	}
+}
+
+// begin opens a struct, as field id or, with id 0, a list element.
+func (t *thriftWriter) begin(id int16) {
+	if id != 0 {
+		t.field(id, thriftStruct)
+	}
+
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) end() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+// columnChunk is where a column was written.
+type columnChunk struct {
+	offset int64
+	size   int64
+}
+
+// writeParquet writes rows of the columns as a Parquet file.
+func writeParquet(w io.Writer, rows int, cols []parquetColumn) error {
+	var out bytes.Buffer
+
+	out.WriteString(parquetMagic)
+
+	chunks := make([]columnChunk, len(cols))
+
+	for i := range cols {
+		data := cols[i].plain()
+
+		h := &thriftWriter{}
+		h.begin(0)
+		h.i32(1, parquetDataPage)
+		h.i32(2, int32(len(data))) //nolint:gosec
+		h.i32(3, int32(len(data))) //nolint:gosec
+		h.begin(5)
+		h.i32(1, int32(rows)) //nolint:gosec
+		h.i32(2, parquetPlain)
+		h.i32(3, parquetRLE)
+		h.i32(4, parquetRLE)
+		h.end()
+		h.end()
+
+		chunks[i] = columnChunk{offset: int64(out.Len()), size: int64(h.buf.Len() + len(data))}
+		out.Write(h.buf.Bytes())
+		out.Write(data)
+	}
+
+	m := &thriftWriter{}
+	m.begin(0)
+	m.i32(1, 1)
+	m.list(2, thriftStruct, len(cols)+1)
+	m.begin(0)
+	m.str(4, "schema")
+	m.i32(5, int32(len(cols))) //nolint:gosec
+	m.end()
+
+	for i := range cols {
+		m.begin(0)
+		m.i32(1, cols[i].physical())
+		m.i32(3, parquetRequired)
+		m.str(4, cols[i].name)
+
+		if cols[i].strings != nil {
+			m.i32(6, parquetUTF8)
+		}
+
+		m.end()
+	}
+
+	m.i64(3, int64(rows))
+	m.list(4, thriftStruct, 1)
+	m.begin(0)
+	m.list(1, thriftStruct, len(cols))
+
+	total := int64(0)
+
+	for i := range cols {
+		total += chunks[i].size
+
+		m.begin(0)
+		m.i64(2, chunks[i].offset)
+		m.begin(3)
+		m.i32(1, cols[i].physical())
+		m.list(2, thriftI32, 1)
+		m.zigzag(parquetPlain)
+		m.list(3, thriftBinary, 1)
+		m.varint(uint64(len(cols[i].name)))
+		m.buf.WriteString(cols[i].name)
+		m.i32(4, 0) // uncompressed
+		m.i64(5, int64(rows))
+		m.i64(6, chunks[i].size)
+		m.i64(7, chunks[i].size)
+		m.i64(9, chunks[i].offset)
+		m.end()
+		m.end()
+	}
+
+	m.i64(2, total)
+	m.i64(3, int64(rows))
+	m.end()
+	m.str(6, "go-sim")
+	m.end()
+
+	out.Write(m.buf.Bytes())
+
+	var n [4]byte
+
+	binary.LittleEndian.PutUint32(n[:], uint32(m.buf.Len())) //nolint:gosec
+	out.Write(n[:])
+	out.WriteString(parquetMagic)
+
+	if _, err := w.Write(out.Bytes()); err != nil {
+		return fmt.Errorf("writing parquet: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// thriftReader reads back the Thrift compact protocol writeParquet
+// uses, into maps of field id to int64, string, list or struct.
+type thriftReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *thriftReader) varint() uint64 {
+	v, n := binary.Uvarint(r.b[r.pos:])
+	r.pos += n
+
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.varint()
+
+	return int64(v>>1) ^ -int64(v&1) //nolint:gosec
+}
+
+func (r *thriftReader) byte() byte {
+	b := r.b[r.pos]
+	r.pos++
+
+	return b
+}
+
+func (r *thriftReader) value(typ byte) any {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.zigzag()
+	case thriftBinary:
+		n := int(r.varint()) //nolint:gosec
+		s := string(r.b[r.pos : r.pos+n])
+		r.pos += n
+
+		return s
+	case thriftList:
+		h := r.byte()
+
+		n := int(h >> 4)
+		if n == 15 { //nolint:mnd
+			n = int(r.varint()) //nolint:gosec
+		}
+
+		l := make([]any, n)
+		for i := range l {
+			l[i] = r.value(h & 0x0f) //nolint:mnd
+		}
+
+		return l
+	case thriftStruct:
+		return r.structure()
+	}
+
+	panic("unexpected thrift type")
+}
+
+func (r *thriftReader) structure() map[int16]any {
+	fields := map[int16]any{}
+
+	var last int16
+
+	for {
+		h := r.byte()
+		if h == 0 {
+			return fields
+		}
+
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(r.zigzag()) //nolint:gosec
+		}
+
+		last = id
+		fields[id] = r.value(h & 0x0f) //nolint:mnd
+	}
+}
+
+// TestParquetRoundTrip writes a file and reads it back: the footer's
+// schema and row count and each column's page of values.
+func TestParquetRoundTrip(t *testing.T) {
+	cols := []parquetColumn{
+		{name: "time_ms", int64s: []int64{1000, 1100, -5}},
+		{name: "scope", strings: []string{"node", "pool", ""}},
+		{name: "value", doubles: []float64{0.5, math.Pi, 1e9}},
+	}
+
+	var buf bytes.Buffer
+	if err := writeParquet(&buf, 3, cols); err != nil {
+		t.Fatal(err)
+	}
+
+	b := buf.Bytes()
+	footerLen := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	meta := (&thriftReader{b: b[len(b)-8-footerLen : len(b)-8]}).structure()
+
+	if meta[3] != int64(3) {
+		t.Errorf("Expected 3 rows, got %v", meta[3])
+	}
+
+	schema, _ := meta[2].([]any)
+	if len(schema) != len(cols)+1 || schema[0].(map[int16]any)[5] != int64(len(cols)) {
+		t.Fatalf("Expected a root and %d columns, got %v", len(cols), schema)
+	}
+
+	groups, _ := meta[4].([]any)
+	chunks, _ := groups[0].(map[int16]any)[1].([]any)
+
+	for i, col := range cols {
+		element := schema[i+1].(map[int16]any)
+		if element[4] != col.name || element[1] != int64(col.physical()) {
+			t.Errorf("Expected column %s of type %d, got %v", col.name, col.physical(), element)
+		}
+
+		chunk := chunks[i].(map[int16]any)[3].(map[int16]any)
+		if chunk[5] != int64(3) {
+			t.Errorf("%s: expected 3 values, got %v", col.name, chunk[5])
+		}
+
+		page := &thriftReader{b: b, pos: int(chunk[9].(int64))}
+		header := page.structure()
+		data := b[page.pos : page.pos+int(header[3].(int64))]
+
+		var got any
+
+		switch {
+		case col.int64s != nil:
+			vals := []int64{}
+			for j := 0; j < len(data); j += 8 {
+				vals = append(vals, int64(binary.LittleEndian.Uint64(data[j:]))) //nolint:gosec
+			}
+
+			got = vals
+		case col.doubles != nil:
+			vals := []float64{}
+			for j := 0; j < len(data); j += 8 {
+				vals = append(vals, math.Float64frombits(binary.LittleEndian.Uint64(data[j:])))
+			}
+
+			got = vals
+		default:
+			vals := []string{}
+			for j := 0; j < len(data); {
+				n := int(binary.LittleEndian.Uint32(data[j:]))
+				vals = append(vals, string(data[j+4:j+4+n]))
+				j += 4 + n
+			}
+
+			got = vals
+		}
+
+		want := map[bool]any{true: col.int64s, false: col.doubles}[col.int64s != nil]
+		if col.strings != nil {
+			want = col.strings
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, got %v", col.name, want, got)
+		}
+	}
+}
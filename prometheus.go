@@ -0,0 +1,372 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const promReadTimeout = 10 * time.Second
+
+// promBuckets are the latency histogram bounds in ms.
+var promBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000} //nolint:mnd
+
+// promHelp is the help text of each metric family.
+var promHelp = map[string]string{
+	"gosim_sim_time_ms":           "Simulated time in ms.",
+	"gosim_replies_total":         "Replies sent by app instances.",
+	"gosim_reply_latency_ms":      "Time from a call being sent to the instance replying.",
+	"gosim_lb_calls_total":        "Calls the LB finished per backend instance.",
+	"gosim_lb_latency_ms":         "Latency the LB saw per backend instance.",
+	"gosim_lb_outstanding":        "Calls the LB has in flight per backend instance.",
+	"gosim_source_requests_total": "Requests the source finished.",
+	"gosim_source_latency_ms":     "End to end latency seen by the source.",
+	"gosim_utilization":           "Resource utilization of an instance, 0.0 to 1.0.",
+	"gosim_in_flight":             "Calls an instance is working on.",
+	"gosim_queue_length":          "Calls waiting for one of an instance's workers, or to start without a pool.",
+}
+
+// PromConf turns on Prometheus metrics for the run.
+type PromConf struct {
+	Addr string // address to serve /metrics on during the run, e.g. "localhost:9464" ("" = don't serve)
+}
+
+// promKey is one series: a family and its labels.
+type promKey struct {
+	name     string
+	app      string
+	instance string
+	endpoint string
+	code     string
+	resource string
+}
+
+// promHistogram is a cumulative latency histogram.
+type promHistogram struct {
+	counts []uint64 // per bucket, not cumulative, +Inf last
+	sum    float64
+}
+
+// promRegistry holds the counters and histograms, which only grow.
+type promRegistry struct {
+	mu       sync.Mutex
+	counters map[promKey]uint64
+	hists    map[promKey]*promHistogram
+	server   *http.Server
+	addr     string
+}
+
+// SetPrometheus turns on Prometheus metrics and, with an Addr, serves
+// them on /metrics while the loop runs.
+func (l *Loop) SetPrometheus(conf *PromConf) error {
+	l.prom = &promRegistry{counters: map[promKey]uint64{}, hists: map[promKey]*promHistogram{}}
+
+	if conf.Addr == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", conf.Addr)
+	if err != nil {
+		return fmt.Errorf("serving prometheus metrics: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		if err := l.WritePrometheus(w); err != nil {
+			ml.La("Prometheus scrape failed", err.Error())
+		}
+	})
+
+	l.prom.addr = ln.Addr().String()
+	l.prom.server = &http.Server{Handler: mux, ReadHeaderTimeout: promReadTimeout}
+
+	go func() {
+		if err := l.prom.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			ml.La("Prometheus server stopped", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+// PrometheusAddr is the address /metrics is served on, if any.
+func (l *Loop) PrometheusAddr() string {
+	if l.prom == nil {
+		return ""
+	}
+
+	return l.prom.addr
+}
+
+// StopPrometheus stops serving /metrics.
+func (l *Loop) StopPrometheus() error {
+	if l.prom == nil || l.prom.server == nil {
+		return nil
+	}
+
+	if err := l.prom.server.Close(); err != nil {
+		return fmt.Errorf("stopping prometheus server: %w", err)
+	}
+
+	return nil
+}
+
+// inc adds one to a counter.
+func (p *promRegistry) inc(k promKey) {
+	p.mu.Lock()
+	p.counters[k]++
+	p.mu.Unlock()
+}
+
+// observe adds ms to a histogram.
+func (p *promRegistry) observe(k promKey, ms float64) {
+	i := sort.SearchFloat64s(promBuckets, ms)
+
+	p.mu.Lock()
+
+	h, ok := p.hists[k]
+	if !ok {
+		h = &promHistogram{counts: make([]uint64, len(promBuckets)+1)}
+		p.hists[k] = h
+	}
+
+	h.counts[i]++
+	h.sum += ms
+	p.mu.Unlock()
+}
+
+// reply counts a reply and its latency under the families.
+func (p *promRegistry) reply(counter, hist, app, instance, endpoint string, status uint64, ms float64) {
+	code := strconv.Itoa(http.StatusOK)
+	if status != 0 {
+		code = strconv.FormatUint(status, 10)
+	}
+
+	p.inc(promKey{name: counter, app: app, instance: instance, endpoint: endpoint, code: code})
+	p.observe(promKey{name: hist, app: app, instance: instance, endpoint: endpoint}, ms)
+}
+
+// promReply notes a reply an app instance sent.
+func (n *node) promReply(c *Call, r *Reply) {
+	if n.loop == nil || n.loop.prom == nil || n.callCB != nil || n.App == nil {
+		return
+	}
+
+	n.loop.prom.reply("gosim_replies_total", "gosim_reply_latency_ms", n.App.Name, n.name, n.pool, r.status,
+		n.loop.GetTime()-float64(c.StartTime))
+}
+
+// promReply notes a reply from the LB's i'th instance.
+func (lb *LB) promReply(i int, r *Reply, ms float64) {
+	if lb.n.loop.prom == nil {
+		return
+	}
+
+	lb.n.loop.prom.reply("gosim_lb_calls_total", "gosim_lb_latency_ms", lb.n.App.Name,
+		lb.appInstances[i].name, strings.TrimSuffix(lb.n.name, lbSuffix), r.status, ms)
+}
+
+// promReply notes a reply to one of the source's requests.
+func (s *Source) promReply(c *Call, r *Reply) {
+	if s.n.loop.prom == nil {
+		return
+	}
+
+	s.n.loop.prom.reply("gosim_source_requests_total", "gosim_source_latency_ms", s.n.name, s.n.name,
+		c.Endpoint, r.status, s.n.loop.GetTime()-float64(c.StartTime))
+}
+
+// promGauges reads the gauges now.
+func (l *Loop) promGauges() map[promKey]float64 {
+	gauges := map[promKey]float64{{name: "gosim_sim_time_ms"}: l.GetTime()}
+
+	for _, n := range l.nodes {
+		if n.callCB != nil || n.App == nil || n.resources == nil {
+			continue
+		}
+
+		k := promKey{app: n.App.Name, instance: n.name, endpoint: n.pool}
+
+		n.resources.mu.RLock()
+		util := map[string]float64{
+			"cpu":     n.resources.cpu.Current,
+			"memory":  n.resources.memory.Current,
+			"network": n.resources.network.Current,
+		}
+
+		if n.disk != nil {
+			util["disk"] = n.resources.disk.Current
+		}
+		n.resources.mu.RUnlock()
+
+		for resource, v := range util {
+			u := k
+			u.name, u.resource = "gosim_utilization", resource
+			gauges[u] = v
+		}
+
+		var busy, queued int
+
+		// without a worker pool calls wait only to arrive
+		if n.App.Workers > 0 {
+			n.workers.mu.Lock()
+			busy, queued = n.workers.busy, n.workers.queue.len()
+			n.workers.mu.Unlock()
+		} else {
+			n.callsMu.Lock()
+			queued = len(n.calls)
+			n.callsMu.Unlock()
+
+			busy = int(n.inFlight.Load())
+		}
+
+		k.name = "gosim_in_flight"
+		gauges[k] = float64(busy)
+		k.name = "gosim_queue_length"
+		gauges[k] = float64(queued)
+	}
+
+	for _, name := range l.lbNames() {
+		lb := l.lbs[name]
+
+		for i, n := range lb.appInstances {
+			k := promKey{name: "gosim_lb_outstanding", app: lb.n.App.Name, instance: n.name,
+				endpoint: strings.TrimSuffix(name, lbSuffix)}
+			gauges[k] = float64(lb.outstanding[i].Load())
+		}
+	}
+
+	return gauges
+}
+
+// labels formats the key's labels, with extra ones after.
+func (k promKey) labels(extra ...string) string {
+	var parts []string
+
+	for _, kv := range [][2]string{
+		{"app", k.app}, {"instance", k.instance}, {"endpoint", k.endpoint},
+		{"code", k.code}, {"resource", k.resource},
+	} {
+		if kv[1] != "" {
+			parts = append(parts, kv[0]+"="+strconv.Quote(kv[1]))
+		}
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// sortedKeys returns the keys by family then labels.
+func sortedKeys[V any](m map[promKey]V) []promKey {
+	keys := make([]promKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+
+		return keys[i].labels() < keys[j].labels()
+	})
+
+	return keys
+}
+
+// WritePrometheus writes the counters, histograms and gauges in the
+// Prometheus text exposition format.
+func (l *Loop) WritePrometheus(w io.Writer) error {
+	if l.prom == nil {
+		return nil
+	}
+
+	gauges := l.promGauges()
+
+	l.prom.mu.Lock()
+
+	counters := make(map[promKey]uint64, len(l.prom.counters))
+	for k, v := range l.prom.counters {
+		counters[k] = v
+	}
+
+	hists := make(map[promKey]promHistogram, len(l.prom.hists))
+	for k, h := range l.prom.hists {
+		hists[k] = promHistogram{counts: append([]uint64(nil), h.counts...), sum: h.sum}
+	}
+
+	l.prom.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	family := ""
+
+	header := func(name, typ string) {
+		if name != family {
+			family = name
+			fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, promHelp[name], name, typ)
+		}
+	}
+
+	for _, k := range sortedKeys(gauges) {
+		header(k.name, "gauge")
+		fmt.Fprintf(bw, "%s%s %s\n", k.name, k.labels(), promFloat(gauges[k]))
+	}
+
+	for _, k := range sortedKeys(counters) {
+		header(k.name, "counter")
+		fmt.Fprintf(bw, "%s%s %d\n", k.name, k.labels(), counters[k])
+	}
+
+	for _, k := range sortedKeys(hists) {
+		header(k.name, "histogram")
+
+		h := hists[k]
+		cum := uint64(0)
+
+		for i, c := range h.counts {
+			cum += c
+
+			le := "+Inf"
+			if i < len(promBuckets) {
+				le = promFloat(promBuckets[i])
+			}
+
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", k.name, k.labels("le", le), cum)
+		}
+
+		fmt.Fprintf(bw, "%s_sum%s %s\n", k.name, k.labels(), promFloat(h.sum))
+		fmt.Fprintf(bw, "%s_count%s %d\n", k.name, k.labels(), cum)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("writing prometheus metrics: %w", err)
+	}
+
+	return nil
+}
+
+// promFloat formats a sample value.
+func promFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
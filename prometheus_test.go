@@ -0,0 +1,162 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape gets the text of /metrics.
+func scrape(addr string) (string, error) {
+	resp, err := http.Get("http://" + addr + "/metrics") //nolint:noctx
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+
+	return string(body), err
+}
+
+// scrapeSimTime reads gosim_sim_time_ms from a scrape.
+func scrapeSimTime(text string) (float64, bool) {
+	for _, line := range strings.Split(text, "\n") {
+		if v, ok := strings.CutPrefix(line, "gosim_sim_time_ms "); ok {
+			f, err := strconv.ParseFloat(v, 64)
+
+			return f, err == nil
+		}
+	}
+
+	return 0, false
+}
+
+// TestPrometheusEndpoint serves /metrics on a free port, scrapes it
+// while the loop runs to see sim time advance, and checks a scrape
+// after the run has the source, LB and instance series.
+func TestPrometheusEndpoint(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+	if err := loop.SetPrometheus(&PromConf{Addr: "127.0.0.1:0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer loop.StopPrometheus() //nolint:errcheck
+
+	appConf := AppConf{
+		Name:        "promApp",
+		Size:        2,
+		Workers:     4,
+		AcceptQueue: 10,
+		Stages:      []*StageConf{{LocalWork: UniformCDF(1, 3)}},
+		ReplyLen:    UniformCDF(100, 200),
+		Resources:   lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "promApp", App: &appConf}, loop)
+
+	plainConf := AppConf{
+		Name:      "promPlain",
+		Size:      1,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 3)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "promPlain", App: &plainConf}, loop)
+
+	sourceConf := makeTestSourceConf("promSource", 0.1, "promApp", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	// scrape over and over from the start of the run to its end
+	started := make(chan struct{})
+	done := make(chan struct{})
+	seen := make(chan []float64)
+
+	go func() {
+		var times []float64
+
+		for {
+			if text, err := scrape(loop.PrometheusAddr()); err == nil {
+				if v, ok := scrapeSimTime(text); ok {
+					times = append(times, v)
+				}
+			}
+
+			if len(times) == 1 {
+				close(started)
+			}
+
+			select {
+			case <-done:
+				seen <- times
+
+				return
+			default:
+			}
+		}
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a scrape before the run")
+	}
+
+	loop.Run(1000)
+	close(done)
+
+	times := <-seen
+	during := map[float64]bool{}
+
+	for i, v := range times {
+		if i > 0 && v < times[i-1] {
+			t.Errorf("Expected sim time never to go back, got %v", times)
+
+			break
+		}
+
+		if v >= loopStartMs && v < loopStartMs+1000 {
+			during[v] = true
+		}
+	}
+
+	t.Logf("%d scrapes, %d during the run", len(times), len(during))
+
+	if len(during) < 2 {
+		t.Errorf("Expected sim time to advance between scrapes during the run, got %d times %v", len(times), during)
+	}
+
+	text, err := scrape(loop.PrometheusAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"# TYPE gosim_source_latency_ms histogram",
+		`gosim_source_requests_total{app="promSource",instance="promSource",endpoint="promApp",code="200"}`,
+		`gosim_source_latency_ms_bucket{app="promSource",instance="promSource",endpoint="promApp",le="+Inf"}`,
+		`gosim_lb_calls_total{app="promApp",instance="promApp-0",endpoint="promApp",code="200"}`,
+		`gosim_replies_total{app="promApp",instance="promApp-1",endpoint="promApp",code="200"}`,
+		`gosim_utilization{app="promApp",instance="promApp-0",endpoint="promApp",resource="cpu"}`,
+		`gosim_queue_length{app="promApp",instance="promApp-1",endpoint="promApp"}`,
+		`gosim_in_flight{app="promPlain",instance="promPlain-0",endpoint="promPlain"}`,
+		`gosim_queue_length{app="promPlain",instance="promPlain-0",endpoint="promPlain"}`,
+		"gosim_sim_time_ms 2000",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected %s in the scrape", want)
+		}
+	}
+
+	if t.Failed() {
+		t.Log(text)
+	}
+}
@@ -0,0 +1,239 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+
+	count "github.com/jayalane/go-counter"
+)
+
+// RateLimitConf configures a server side rate limiter on an app
+// instance or an LB.  Calls over the limit are rejected with a 429.
+type RateLimitConf struct {
+	Rate        float64 // calls per second refilling the token bucket (0 = no bucket)
+	Burst       float64 // token bucket size (0 = one second of Rate)
+	MaxInFlight int     // calls in flight at once (0 = unlimited)
+	PerCaller   bool    // separate limits for each calling app or source
+}
+
+// limitState is one bucket and in-flight count.
+type limitState struct {
+	tokens   float64
+	last     Milliseconds
+	inFlight int
+
+	allowed   int
+	throttled int
+}
+
+// rateLimiter is a node's limiter, keyed by caller when PerCaller.
+type rateLimiter struct {
+	mu     sync.Mutex
+	conf   *RateLimitConf
+	limits map[string]*limitState
+	counts map[string]*limitState // allowed and throttled per caller
+}
+
+// RateLimitStats sums up one limiter's decisions for one caller.
+type RateLimitStats struct {
+	Limiter   string // app name, or the LB's name
+	Caller    string
+	Allowed   int
+	Throttled int
+}
+
+// ThrottledFraction returns the share of the caller's calls rejected.
+func (s RateLimitStats) ThrottledFraction() float64 {
+	if s.Allowed+s.Throttled == 0 {
+		return 0
+	}
+
+	return float64(s.Throttled) / float64(s.Allowed+s.Throttled)
+}
+
+// newRateLimiter returns a limiter for the config, or nil for none.
+func newRateLimiter(conf *RateLimitConf) *rateLimiter {
+	if conf == nil {
+		return nil
+	}
+
+	return &rateLimiter{
+		conf:   conf,
+		limits: make(map[string]*limitState),
+		counts: make(map[string]*limitState),
+	}
+}
+
+func (rl *rateLimiter) burst() float64 {
+	if rl.conf.Burst > 0 {
+		return rl.conf.Burst
+	}
+
+	return rl.conf.Rate
+}
+
+// admit takes a token and an in-flight slot for the call, returning
+// false if either is out.  Caller must hold rl.mu.
+func (rl *rateLimiter) admit(c *Call, now Milliseconds) bool {
+	key := ""
+	if rl.conf.PerCaller {
+		key = c.origin
+	}
+
+	ls, ok := rl.limits[key]
+	if !ok {
+		ls = &limitState{tokens: rl.burst(), last: now}
+		rl.limits[key] = ls
+	}
+
+	counts, ok := rl.counts[c.origin]
+	if !ok {
+		counts = &limitState{}
+		rl.counts[c.origin] = counts
+	}
+
+	if rl.conf.Rate > 0 {
+		ls.tokens = math.Min(rl.burst(), ls.tokens+rl.conf.Rate*float64(now-ls.last)/msInSec)
+		ls.last = now
+	}
+
+	if (rl.conf.Rate > 0 && ls.tokens < 1) ||
+		(rl.conf.MaxInFlight > 0 && ls.inFlight >= rl.conf.MaxInFlight) {
+		counts.throttled++
+
+		return false
+	}
+
+	if rl.conf.Rate > 0 {
+		ls.tokens--
+	}
+
+	ls.inFlight++
+	counts.allowed++
+	c.heldLimit = ls
+
+	return true
+}
+
+// retryAfter is how long until the call's bucket has a token, or 0
+// if it is not short of one.  Caller must hold rl.mu.
+func (rl *rateLimiter) retryAfter(c *Call) Milliseconds {
+	key := ""
+	if rl.conf.PerCaller {
+		key = c.origin
+	}
+
+	ls, ok := rl.limits[key]
+	if !ok || rl.conf.Rate <= 0 || ls.tokens >= 1 {
+		return 0
+	}
+
+	return Milliseconds(math.Ceil((1 - ls.tokens) * msInSec / rl.conf.Rate))
+}
+
+// clear drops the buckets and in-flight counts, as when the container
+// restarts.  Calls still holding a slot free it in the old state.
+func (rl *rateLimiter) clear() {
+	rl.mu.Lock()
+	rl.limits = make(map[string]*limitState)
+	rl.mu.Unlock()
+}
+
+// rateLimit checks the node's limiter, replying 429 if the call is
+// over it.  It returns false if the call was rejected.
+func (n *node) rateLimit(c *Call) bool {
+	if n.limiter == nil {
+		return true
+	}
+
+	n.limiter.mu.Lock()
+	ok := n.limiter.admit(c, Milliseconds(n.loop.GetTime()))
+	retryAfter := n.limiter.retryAfter(c)
+	n.limiter.mu.Unlock()
+
+	if ok {
+		return true
+	}
+
+	count.IncrSyncSuffix("node_rate_limited", n.name)
+	n.sendRetryAfterReply(c, http.StatusTooManyRequests, retryAfter, "Rate limited")
+
+	return false
+}
+
+// releaseLimit frees the call's in-flight slot, once.
+func (n *node) releaseLimit(c *Call) {
+	if n.limiter == nil {
+		return
+	}
+
+	n.limiter.mu.Lock()
+
+	if c.heldLimit != nil {
+		c.heldLimit.inFlight--
+		c.heldLimit = nil
+	}
+
+	n.limiter.mu.Unlock()
+}
+
+// RateLimitStats returns rate limiter decisions per limiter and caller,
+// summed across an app's instances.
+func (l *Loop) RateLimitStats() []RateLimitStats {
+	type key struct{ limiter, caller string }
+
+	byKey := map[key]*RateLimitStats{}
+
+	add := func(name string, rl *rateLimiter) {
+		if rl == nil {
+			return
+		}
+
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+
+		for caller, counts := range rl.counts {
+			k := key{name, caller}
+
+			s, ok := byKey[k]
+			if !ok {
+				s = &RateLimitStats{Limiter: name, Caller: caller}
+				byKey[k] = s
+			}
+
+			s.Allowed += counts.allowed
+			s.Throttled += counts.throttled
+		}
+	}
+
+	for _, name := range l.lbNames() {
+		add(name, l.lbs[name].n.limiter)
+	}
+
+	for _, n := range l.nodes {
+		if n.callCB == nil {
+			add(n.App.Name, n.limiter)
+		}
+	}
+
+	res := make([]RateLimitStats, 0, len(byKey))
+	for _, s := range byKey {
+		res = append(res, *s)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Limiter != res[j].Limiter {
+			return res[i].Limiter < res[j].Limiter
+		}
+
+		return res[i].Caller < res[j].Caller
+	})
+
+	return res
+}
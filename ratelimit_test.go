@@ -0,0 +1,193 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+)
+
+// TestTokenBucket checks the burst, refill and in-flight limits.
+func TestTokenBucket(t *testing.T) {
+	rl := newRateLimiter(&RateLimitConf{Rate: 1000, Burst: 2, MaxInFlight: 3})
+	calls := make([]*Call, 4)
+
+	for i := range calls {
+		calls[i] = &Call{origin: "a"}
+	}
+
+	if !rl.admit(calls[0], 0) || !rl.admit(calls[1], 0) || rl.admit(calls[2], 0) {
+		t.Error("Expected a burst of 2")
+	}
+
+	// one token a ms
+	if !rl.admit(calls[2], 1) || rl.admit(calls[3], 5) {
+		t.Error("Expected a refill then the in-flight limit")
+	}
+
+	calls[0].heldLimit.inFlight--
+
+	if !rl.admit(calls[3], 6) {
+		t.Error("Expected a freed slot to admit")
+	}
+
+	if rl.counts["a"].allowed != 4 || rl.counts["a"].throttled != 2 {
+		t.Errorf("Unexpected counts %+v", rl.counts["a"])
+	}
+}
+
+// TestGatewayRateLimit checks a per caller gateway limit throttles the
+// greedy source and not the polite one.
+func TestGatewayRateLimit(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+
+	appConf := AppConf{
+		Name:      "gateway",
+		Size:      2,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 2)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+		RateLimit: &RateLimitConf{MaxInFlight: 50},
+	}
+
+	MakeLB(&LbConf{
+		Name:      "gateway",
+		App:       &appConf,
+		RateLimit: &RateLimitConf{Rate: 100, Burst: 5, PerCaller: true},
+	}, loop)
+
+	greedyConf := makeTestSourceConf("greedySource", 0.5, "gateway", 500.0)
+	greedy := MakeSource(&greedyConf, loop)
+
+	politeConf := makeTestSourceConf("politeSource", 0.05, "gateway", 500.0)
+	polite := MakeSource(&politeConf, loop)
+
+	loop.Run(400)
+
+	t.Logf("throttled greedy=%.2f polite=%.2f stats=%+v", greedy.ThrottledFraction(), polite.ThrottledFraction(),
+		loop.RateLimitStats())
+
+	if greedy.ThrottledFraction() < 0.5 || polite.ThrottledFraction() > 0.1 {
+		t.Errorf("Expected only the greedy source throttled: %.2f/%.2f", greedy.ThrottledFraction(),
+			polite.ThrottledFraction())
+	}
+
+	for _, s := range loop.RateLimitStats() {
+		if s.Limiter == "gateway" && s.Throttled != 0 {
+			t.Errorf("Expected the instances' in-flight limit not to be reached: %+v", s)
+		}
+
+		if s.Limiter == "gateway-lb" && s.Caller == "greedySource" && s.ThrottledFraction() < 0.5 {
+			t.Errorf("Expected the LB to throttle the greedy source: %+v", s)
+		}
+	}
+}
+
+// TestRejectReleasesLimit checks a call turned away by a full accept
+// queue gives back its in-flight slot and a restart clears them.
+func TestRejectReleasesLimit(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+
+	appConf := AppConf{
+		Name:      "limitServer",
+		Size:      1,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 2)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Workers:   1,
+		RateLimit: &RateLimitConf{MaxInFlight: 5},
+	}
+
+	lb := MakeLB(&LbConf{Name: "limitServer", App: &appConf}, loop)
+	n := lb.appInstances[0]
+
+	caller := &node{name: "limitSource", loop: loop}
+	caller.initCallMap()
+
+	for range 3 {
+		c := &Call{ReqID: IncrCallNumber(), caller: caller, origin: caller.name}
+		if n.rateLimit(c) {
+			n.admitCall(c)
+		}
+	}
+
+	if inFlight := n.limiter.limits[""].inFlight; inFlight != 1 {
+		t.Errorf("Expected only the working call in flight, got %d", inFlight)
+	}
+
+	n.fullOOMCleanup()
+
+	if len(n.limiter.limits) != 0 {
+		t.Errorf("Expected a restart to clear the limits, got %+v", n.limiter.limits)
+	}
+}
+
+// runKilledLimit runs a source through an LB with an in-flight limit,
+// killing the whole pool for a while if kill, and returns the calls
+// the LB let through, its slots still held at the end and the calls
+// it still waits on.
+func runKilledLimit(kill bool) (int, int, int) {
+	initTest()
+
+	loop := NewLoop()
+
+	appConf := AppConf{
+		Name:      "killedLimit",
+		Size:      2,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 2)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	lb := MakeLB(&LbConf{
+		Name:      "killedLimit",
+		App:       &appConf,
+		RateLimit: &RateLimitConf{MaxInFlight: 4},
+	}, loop)
+
+	sourceConf := makeTestSourceConf("killedLimitSource", 1, "killedLimit", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	if kill {
+		loop.AddFault(&Fault{Kind: FaultKill, Target: "killedLimit", Start: 50, Duration: 20})
+	}
+
+	loop.Run(400)
+
+	allowed := 0
+
+	for _, s := range loop.RateLimitStats() {
+		if s.Limiter == "killedLimit-lb" {
+			allowed += s.Allowed
+		}
+	}
+
+	lb.n.limiter.mu.Lock()
+	held := lb.n.limiter.limits[""].inFlight
+	lb.n.limiter.mu.Unlock()
+
+	lb.n.pendingCallMapMu.RLock()
+	pending := len(lb.n.pendingCallMap)
+	lb.n.pendingCallMapMu.RUnlock()
+
+	return allowed, held, pending
+}
+
+// TestKillReleasesLBLimit checks the calls lost with killed instances
+// give back the LB's in-flight slots, so throughput recovers.
+func TestKillReleasesLBLimit(t *testing.T) {
+	base, _, _ := runKilledLimit(false)
+	allowed, held, pending := runKilledLimit(true)
+
+	t.Logf("allowed %d without the kill, %d with it, %d slots held for %d calls at the end", base, allowed, held, pending)
+
+	if allowed < base*3/4 {
+		t.Errorf("Expected throughput to recover after the kill: %d vs %d", allowed, base)
+	}
+
+	if held != pending {
+		t.Errorf("Expected a slot held only for each call still out, got %d for %d", held, pending)
+	}
+}
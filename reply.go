@@ -8,4 +8,7 @@ type Reply struct {
 	length uint64
 	status uint64
 	call   *Call
+
+	retryAfter Milliseconds // server's hint of when to try again
+	local      bool         // failed at the caller without being sent
 }
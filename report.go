@@ -0,0 +1,603 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// a self-contained HTML report of a finished run, charts drawn as
+// inline SVG so the file can be mailed around and opened anywhere.
+
+const (
+	chartWidth     = 640
+	chartHeight    = 280
+	chartMarginL   = 60
+	chartMarginR   = 150
+	chartMarginT   = 20
+	chartMarginB   = 40
+	chartTicks     = 5
+	cdfPoints      = 200
+	heatmapCols    = 100
+	heatmapCellW   = 5
+	heatmapCellH   = 12
+	heatmapLabelW  = 160
+	topoBoxW       = 170
+	topoBoxH       = 40
+	topoColGap     = 90
+	topoRowGap     = 20
+	eventRowH      = 22
+	maxEventRows   = 500
+	reportPercent  = 100
+	reportFontSize = 11
+)
+
+// chartColors are the series colors, reused in turn.
+var chartColors = []string{
+	"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd",
+	"#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf",
+}
+
+// chartSeries is one line on a chart.
+type chartSeries struct {
+	name string
+	x, y []float64
+}
+
+// reportPool is a pool's row in the config summary.
+type reportPool struct {
+	Name, App, Zones, Strategy, Calls string
+	Size, Workers, AcceptQueue        int
+	Stages                            int
+}
+
+// reportSource is a source's row in the config summary and latency
+// table.
+type reportSource struct {
+	Name, Endpoints string
+	PerSec          float64
+	Latency         LatencySummary
+	ErrorPct        float64
+}
+
+// reportFault is a scheduled fault's row.
+type reportFault struct {
+	Kind, Target    string
+	Start, Duration float64
+}
+
+// reportHeatmap is one pool's utilization of one resource.
+type reportHeatmap struct {
+	Pool, Resource string
+	SVG            template.HTML
+}
+
+type reportData struct {
+	RunMs      float64
+	Pools      []reportPool
+	Sources    []reportSource
+	Faults     []reportFault
+	Topology   template.HTML
+	LatencyCDF template.HTML
+	Throughput template.HTML
+	Errors     template.HTML
+	Heatmaps   []reportHeatmap
+	Timeline   template.HTML
+	Events     []Event
+	MoreEvents int
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>go-sim run report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 3px 8px; text-align: right; font-size: 13px; }
+th { background: #f0f0f0; }
+td.l, th.l { text-align: left; }
+svg { display: block; margin-bottom: 1em; }
+h3 { margin-bottom: 0.3em; }
+</style></head><body>
+<h1>go-sim run report</h1>
+<p>{{printf "%.0f" .RunMs}} ms simulated.</p>
+
+<h2>Configuration</h2>
+<table><tr><th class="l">pool</th><th class="l">app</th><th>size</th><th class="l">zones</th><th>workers</th>
+<th>accept queue</th><th>stages</th><th class="l">calls</th><th class="l">LB strategy</th></tr>
+{{range .Pools}}<tr><td class="l">{{.Name}}</td><td class="l">{{.App}}</td><td>{{.Size}}</td><td class="l">{{.Zones}}</td>
+<td>{{.Workers}}</td><td>{{.AcceptQueue}}</td><td>{{.Stages}}</td><td class="l">{{.Calls}}</td><td class="l">{{.Strategy}}</td></tr>
+{{end}}</table>
+<table><tr><th class="l">source</th><th>requests/s</th><th class="l">endpoints</th></tr>
+{{range .Sources}}<tr><td class="l">{{.Name}}</td><td>{{printf "%.1f" .PerSec}}</td><td class="l">{{.Endpoints}}</td></tr>
+{{end}}</table>
+{{if .Faults}}<table><tr><th class="l">fault</th><th class="l">target</th><th>start ms</th><th>duration ms</th></tr>
+{{range .Faults}}<tr><td class="l">{{.Kind}}</td><td class="l">{{.Target}}</td><td>{{printf "%.0f" .Start}}</td>
+<td>{{if .Duration}}{{printf "%.0f" .Duration}}{{else}}rest of run{{end}}</td></tr>
+{{end}}</table>{{end}}
+
+<h2>Topology</h2>
+{{.Topology}}
+
+<h2>Source latency</h2>
+<table><tr><th class="l">source</th><th>requests</th><th>errors</th><th>mean ms</th><th>p50</th><th>p90</th>
+<th>p99</th><th>max</th></tr>
+{{range .Sources}}<tr><td class="l">{{.Name}}</td><td>{{.Latency.Count}}</td><td>{{printf "%.2f%%" .ErrorPct}}</td>
+<td>{{printf "%.1f" .Latency.Mean}}</td><td>{{printf "%.1f" .Latency.P50}}</td><td>{{printf "%.1f" .Latency.P90}}</td>
+<td>{{printf "%.1f" .Latency.P99}}</td><td>{{printf "%.1f" .Latency.Max}}</td></tr>
+{{end}}</table>
+{{.LatencyCDF}}
+
+<h2>Throughput and errors</h2>
+{{if .Throughput}}{{.Throughput}}{{.Errors}}{{else}}<p>No time series: turn on Loop.SetMetrics before the run.</p>{{end}}
+
+<h2>Pool utilization</h2>
+{{range .Heatmaps}}<h3>{{.Pool}} {{.Resource}}</h3>{{.SVG}}{{end}}
+
+<h2>Events</h2>
+{{if .Events}}{{.Timeline}}
+<table><tr><th>ms</th><th class="l">kind</th><th class="l">node</th><th class="l">detail</th></tr>
+{{range .Events}}<tr><td>{{printf "%.0f" .Time}}</td><td class="l">{{.Kind}}</td><td class="l">{{.Node}}</td><td class="l">{{.Detail}}</td></tr>
+{{end}}</table>{{if .MoreEvents}}<p>and {{.MoreEvents}} more.</p>{{end}}
+{{else}}<p>No events.</p>{{end}}
+</body></html>
+`))
+
+// WriteHTMLReport writes a self-contained HTML report of the finished
+// run: config summary, topology, source latency CDFs and percentiles,
+// throughput and error timelines (with SetMetrics on), per-pool
+// utilization heatmaps from the resource history and the events.
+func (l *Loop) WriteHTMLReport(w io.Writer) error {
+	runMs := l.GetTime() - loopStartMs
+	d := reportData{RunMs: runMs}
+
+	for _, name := range l.lbNames() {
+		d.Pools = append(d.Pools, l.lbs[name].reportPool())
+	}
+
+	var cdfs []chartSeries
+
+	for _, s := range l.sources {
+		d.Sources = append(d.Sources, s.reportSource())
+		cdfs = append(cdfs, cdfSeries(s.n.name, s.latency.sorted()))
+	}
+
+	for _, sf := range l.faults {
+		d.Faults = append(d.Faults, reportFault{
+			Kind:     sf.fault.Kind.String(),
+			Target:   sf.fault.Target,
+			Start:    float64(sf.fault.Start),
+			Duration: float64(sf.fault.Duration),
+		})
+	}
+
+	d.Topology = svgTopology(l.Topology())
+	d.LatencyCDF = svgLineChart("latency CDF", "ms", "fraction of requests", cdfs)
+	d.Throughput, d.Errors = l.reportTimelines()
+	d.Heatmaps = l.reportHeatmaps()
+
+	events := l.Events()
+	d.Timeline = svgEvents(events, runMs)
+
+	if len(events) > maxEventRows {
+		d.MoreEvents = len(events) - maxEventRows
+		events = events[:maxEventRows]
+	}
+
+	for i := range events {
+		events[i].Time -= loopStartMs
+	}
+
+	d.Events = events
+
+	if err := reportTemplate.Execute(w, d); err != nil {
+		return fmt.Errorf("writing html report: %w", err)
+	}
+
+	return nil
+}
+
+// reportPool is the LB's pool's config row.
+func (lb *LB) reportPool() reportPool {
+	a := lb.n.App
+
+	var calls []string
+
+	for _, h := range a.Stages {
+		for _, rc := range h.RemoteCalls {
+			calls = append(calls, rc.Endpoint)
+		}
+	}
+
+	return reportPool{
+		Name:        strings.TrimSuffix(lb.n.name, lbSuffix),
+		App:         a.Name,
+		Zones:       strings.Join(a.Zones, ", "),
+		Strategy:    lb.strategy.String(),
+		Calls:       strings.Join(calls, ", "),
+		Size:        len(lb.appInstances),
+		Workers:     a.Workers,
+		AcceptQueue: a.AcceptQueue,
+		Stages:      len(a.Stages),
+	}
+}
+
+// reportSource is the source's config and latency row.
+func (s *Source) reportSource() reportSource {
+	var endpoints []string
+
+	s.endpoints.Range(func(k, _ any) bool {
+		if e, ok := k.(string); ok {
+			endpoints = append(endpoints, e)
+		}
+
+		return true
+	})
+
+	sort.Strings(endpoints)
+
+	ls := s.latency.summary()
+
+	return reportSource{
+		Name:      s.n.name,
+		Endpoints: strings.Join(endpoints, ", "),
+		PerSec:    s.lambda * msInSec,
+		Latency:   ls,
+		ErrorPct:  ls.ErrorRate() * reportPercent,
+	}
+}
+
+// cdfSeries is the CDF of sorted samples, thinned to cdfPoints.
+func cdfSeries(name string, sorted []float64) chartSeries {
+	cs := chartSeries{name: name}
+	step := max(1, len(sorted)/cdfPoints)
+
+	for i := 0; i < len(sorted); i += step {
+		cs.x = append(cs.x, sorted[i])
+		cs.y = append(cs.y, float64(i+1)/float64(len(sorted)))
+	}
+
+	if len(sorted) > 0 {
+		cs.x = append(cs.x, sorted[len(sorted)-1])
+		cs.y = append(cs.y, 1)
+	}
+
+	return cs
+}
+
+// reportTimelines charts each source's throughput and errors from the
+// metrics samples, or nothing if metrics were off.
+func (l *Loop) reportTimelines() (template.HTML, template.HTML) {
+	byName := map[string]map[string]*chartSeries{"throughput": {}, "errors": {}}
+
+	var names []string
+
+	for _, m := range l.Metrics() {
+		series, ok := byName[m.Series]
+		if !ok || m.Scope != ScopeSource {
+			continue
+		}
+
+		cs, ok := series[m.Name]
+		if !ok {
+			cs = &chartSeries{name: m.Name}
+			series[m.Name] = cs
+
+			if m.Series == "throughput" {
+				names = append(names, m.Name)
+			}
+		}
+
+		cs.x = append(cs.x, float64(m.Time-loopStartMs))
+		cs.y = append(cs.y, m.Value)
+	}
+
+	if len(names) == 0 {
+		return "", ""
+	}
+
+	sort.Strings(names)
+
+	var tput, errs []chartSeries
+
+	for _, name := range names {
+		tput = append(tput, *byName["throughput"][name])
+
+		if cs, ok := byName["errors"][name]; ok {
+			errs = append(errs, *cs)
+		}
+	}
+
+	return svgLineChart("throughput", "run ms", "replies/s", tput),
+		svgLineChart("errors", "run ms", "failed replies per interval", errs)
+}
+
+// reportHeatmaps draws each pool's CPU, memory and network history,
+// an instance a row.
+func (l *Loop) reportHeatmaps() []reportHeatmap {
+	var res []reportHeatmap
+
+	for _, name := range l.lbNames() {
+		lb := l.lbs[name]
+		histories := make([]map[string][]float64, len(lb.appInstances))
+		rows := make([]string, len(lb.appInstances))
+
+		for i, n := range lb.appInstances {
+			histories[i] = n.GetResourceHistory()
+			rows[i] = n.name
+		}
+
+		for _, resource := range []string{"cpu", "memory", "network"} {
+			values := make([][]float64, len(rows))
+			for i := range rows {
+				values[i] = histories[i][resource]
+			}
+
+			res = append(res, reportHeatmap{
+				Pool:     strings.TrimSuffix(name, lbSuffix),
+				Resource: resource,
+				SVG:      svgHeatmap(rows, values),
+			})
+		}
+	}
+
+	return res
+}
+
+// svgText escapes s for SVG text.
+func svgText(s string) string {
+	return html.EscapeString(s)
+}
+
+// axisRange is the range a chart shows for values from lo to hi.
+func axisRange(lo, hi float64) (float64, float64) {
+	if hi <= lo {
+		return lo, lo + 1
+	}
+
+	return lo, hi
+}
+
+// svgLineChart draws the series on shared axes with a legend.
+func svgLineChart(title, xLabel, yLabel string, series []chartSeries) template.HTML {
+	xMin, xMax := math.Inf(1), math.Inf(-1)
+	yMax := 0.0
+
+	for _, cs := range series {
+		for i := range cs.x {
+			xMin = math.Min(xMin, cs.x[i])
+			xMax = math.Max(xMax, cs.x[i])
+			yMax = math.Max(yMax, cs.y[i])
+		}
+	}
+
+	if math.IsInf(xMin, 1) {
+		xMin, xMax = 0, 1
+	}
+
+	xMin, xMax = axisRange(xMin, xMax)
+	_, yMax = axisRange(0, yMax)
+
+	plotW := float64(chartWidth - chartMarginL - chartMarginR)
+	plotH := float64(chartHeight - chartMarginT - chartMarginB)
+	px := func(x float64) float64 { return chartMarginL + (x-xMin)/(xMax-xMin)*plotW }
+	py := func(y float64) float64 { return chartMarginT + plotH - y/yMax*plotH }
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-size="%d">`,
+		chartWidth, chartHeight, reportFontSize)
+	fmt.Fprintf(&b, `<text x="%d" y="14" font-weight="bold">%s</text>`, chartMarginL, svgText(title))
+	fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%.0f" height="%.0f" fill="none" stroke="#999"/>`,
+		chartMarginL, chartMarginT, plotW, plotH)
+
+	for i := 0; i <= chartTicks; i++ {
+		x := xMin + (xMax-xMin)*float64(i)/chartTicks
+		y := yMax * float64(i) / chartTicks
+
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="middle">%.4g</text>`,
+			px(x), chartMarginT+plotH+14, x)
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end">%.4g</text>`, chartMarginL-4, py(y)+4, y)
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#eee"/>`,
+			chartMarginL, py(y), chartMarginL+plotW, py(y))
+	}
+
+	fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`,
+		chartMarginL+plotW/2, chartHeight-6, svgText(xLabel))
+	fmt.Fprintf(&b, `<text x="12" y="%.1f" text-anchor="middle" transform="rotate(-90 12 %.1f)">%s</text>`,
+		chartMarginT+plotH/2, chartMarginT+plotH/2, svgText(yLabel))
+
+	for i, cs := range series {
+		color := chartColors[i%len(chartColors)]
+
+		pts := make([]string, len(cs.x))
+		for j := range cs.x {
+			pts[j] = fmt.Sprintf("%.1f,%.1f", px(cs.x[j]), py(cs.y[j]))
+		}
+
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="1.5" points="%s"/>`,
+			color, strings.Join(pts, " "))
+
+		ly := chartMarginT + 10 + 16*i
+		fmt.Fprintf(&b, `<line x1="%.0f" y1="%d" x2="%.0f" y2="%d" stroke="%s" stroke-width="3"/>`,
+			chartMarginL+plotW+10, ly, chartMarginL+plotW+30, ly, color)
+		fmt.Fprintf(&b, `<text x="%.0f" y="%d">%s</text>`, chartMarginL+plotW+35, ly+4, svgText(cs.name))
+	}
+
+	b.WriteString(`</svg>`)
+
+	return template.HTML(b.String()) //nolint:gosec // built from escaped text
+}
+
+// heatColor shades utilization from white (0) to dark red (1).
+func heatColor(v float64) string {
+	v = math.Max(0, math.Min(1, v))
+	g := int(255 * (1 - v)) //nolint:mnd
+	r := int(255 - 80*v)    //nolint:mnd
+
+	return fmt.Sprintf("rgb(%d,%d,%d)", r, g, g)
+}
+
+// svgHeatmap draws a row of cells per named series, each cell the
+// mean of its share of the series.
+func svgHeatmap(rows []string, values [][]float64) template.HTML {
+	cols := 0
+	for _, v := range values {
+		cols = max(cols, min(len(v), heatmapCols))
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-size="%d">`,
+		heatmapLabelW+cols*heatmapCellW+10, len(rows)*heatmapCellH+4, reportFontSize)
+
+	for i, name := range rows {
+		y := i * heatmapCellH
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%s</text>`,
+			heatmapLabelW-4, y+heatmapCellH-2, svgText(name))
+
+		v := values[i]
+
+		for c := 0; c < cols && len(v) > 0; c++ {
+			lo := c * len(v) / cols
+			hi := max(lo+1, (c+1)*len(v)/cols)
+
+			sum := 0.0
+			for _, x := range v[lo:hi] {
+				sum += x
+			}
+
+			mean := sum / float64(hi-lo)
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"><title>%.2f</title></rect>`,
+				heatmapLabelW+c*heatmapCellW, y, heatmapCellW, heatmapCellH-1, heatColor(mean), mean)
+		}
+	}
+
+	b.WriteString(`</svg>`)
+
+	return template.HTML(b.String()) //nolint:gosec // built from escaped text
+}
+
+// svgTopology lays the graph out left to right by call depth.
+func svgTopology(t Topology) template.HTML {
+	depths := t.depths()
+	cols := map[int][]TopologyNode{}
+	maxDepth, maxRows := 0, 0
+
+	for _, n := range t.Nodes {
+		d := depths[n.Name]
+		cols[d] = append(cols[d], n)
+		maxDepth = max(maxDepth, d)
+		maxRows = max(maxRows, len(cols[d]))
+	}
+
+	type point struct{ x, y int }
+
+	at := map[string]point{}
+
+	for d, ns := range cols {
+		for i, n := range ns {
+			at[n.Name] = point{10 + d*(topoBoxW+topoColGap), 10 + i*(topoBoxH+topoRowGap)}
+		}
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-size="%d">`,
+		20+(maxDepth+1)*(topoBoxW+topoColGap), 20+maxRows*(topoBoxH+topoRowGap), reportFontSize)
+	b.WriteString(`<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="6" ` +
+		`markerHeight="6" orient="auto"><path d="M0,0 L10,5 L0,10 z" fill="#666"/></marker></defs>`)
+
+	for _, e := range t.Edges {
+		from, ok1 := at[e.From]
+		to, ok2 := at[e.To]
+
+		if !ok1 || !ok2 {
+			continue
+		}
+
+		fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#666" marker-end="url(#arrow)">`+
+			`<title>%s</title></line>`,
+			from.x+topoBoxW, from.y+topoBoxH/2, to.x, to.y+topoBoxH/2, svgText(t.edgeLabel(e)))
+	}
+
+	for _, n := range t.Nodes {
+		p := at[n.Name]
+		fill, sub := "#dbe9f6", n.Strategy
+
+		if n.Kind == TopologySource {
+			fill, sub = "#e3f4dc", "source"
+		} else {
+			sub = fmt.Sprintf("%d instances, %s", n.Size, n.Strategy)
+		}
+
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" rx="4" fill="%s" stroke="#888"/>`,
+			p.x, p.y, topoBoxW, topoBoxH, fill)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle" font-weight="bold">%s</text>`,
+			p.x+topoBoxW/2, p.y+16, svgText(n.Name))
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle">%s</text>`,
+			p.x+topoBoxW/2, p.y+31, svgText(sub))
+	}
+
+	b.WriteString(`</svg>`)
+
+	return template.HTML(b.String()) //nolint:gosec // built from escaped text
+}
+
+// svgEvents marks the events on a timeline, a row per kind.
+func svgEvents(events []Event, runMs float64) template.HTML {
+	var kinds []string
+
+	row := map[string]int{}
+
+	for _, e := range events {
+		if _, ok := row[e.Kind]; !ok {
+			row[e.Kind] = len(kinds)
+			kinds = append(kinds, e.Kind)
+		}
+	}
+
+	plotW := float64(chartWidth - chartMarginL - chartMarginR)
+	_, runMs = axisRange(0, runMs)
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-size="%d">`,
+		chartWidth, len(kinds)*eventRowH+chartMarginB, reportFontSize)
+
+	for i, k := range kinds {
+		y := i*eventRowH + eventRowH/2
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, chartMarginL+40, y+4, svgText(k))
+		fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%.0f" y2="%d" stroke="#eee"/>`,
+			chartMarginL+44, y, chartMarginL+44+plotW, y)
+	}
+
+	for _, e := range events {
+		x := chartMarginL + 44 + float64(e.Time-loopStartMs)/runMs*plotW
+		y := row[e.Kind]*eventRowH + eventRowH/2
+		fmt.Fprintf(&b, `<circle cx="%.1f" cy="%d" r="4" fill="%s" fill-opacity="0.6"><title>%.0f ms %s %s</title></circle>`,
+			x, y, chartColors[row[e.Kind]%len(chartColors)], float64(e.Time-loopStartMs),
+			svgText(e.Node), svgText(e.Detail))
+	}
+
+	axisY := len(kinds)*eventRowH + 14
+
+	for i := 0; i <= chartTicks; i++ {
+		ms := runMs * float64(i) / chartTicks
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">%.0f</text>`,
+			chartMarginL+44+ms/runMs*plotW, axisY, ms)
+	}
+
+	fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">run ms</text>`,
+		chartMarginL+44+plotW/2, axisY+16)
+	b.WriteString(`</svg>`)
+
+	return template.HTML(b.String()) //nolint:gosec // built from escaped text
+}
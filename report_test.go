@@ -0,0 +1,85 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestHTMLReport runs a front and back with metrics and a fault and
+// checks the report has each section and the graph it was built from.
+func TestHTMLReport(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+	loop.SetMetrics(&MetricsConf{IntervalMs: 50})
+
+	backConf := AppConf{
+		Name:      "reportBack",
+		Size:      2,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 3)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "reportBack", App: &backConf}, loop)
+
+	frontConf := AppConf{
+		Name: "reportFront",
+		Size: 2,
+		Stages: []*StageConf{{
+			LocalWork:    UniformCDF(1, 2),
+			RemoteCalls:  []*RemoteCall{{Endpoint: "reportBack"}},
+			AwaitReplies: true,
+		}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "reportFront", App: &frontConf}, loop)
+
+	sourceConf := makeTestSourceConf("reportSource", 0.1, "reportFront", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.AddFault(&Fault{Kind: FaultErrorRate, Target: "reportBack", Start: 100, Duration: 100, ErrorRate: 0.5})
+
+	loop.Run(300)
+
+	topo := loop.Topology()
+	if len(topo.Nodes) != 3 || len(topo.Edges) != 2 {
+		t.Errorf("Expected source, front and back with two edges, got %+v", topo)
+	}
+
+	depths := topo.depths()
+	if depths["reportSource"] != 0 || depths["reportFront"] != 1 || depths["reportBack"] != 2 {
+		t.Errorf("Expected the graph laid out source, front, back, got %v", depths)
+	}
+
+	var buf bytes.Buffer
+	if err := loop.WriteHTMLReport(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	page := buf.String()
+
+	for _, want := range []string{
+		"<h2>Configuration</h2>",
+		"<h2>Topology</h2>",
+		"latency CDF",
+		"throughput",
+		"<h3>reportBack cpu</h3>",
+		"fault_start",
+		"error_rate 0.50",
+		"reportSource",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("Expected %q in the report", want)
+		}
+	}
+
+	if strings.Contains(page, "No time series") {
+		t.Errorf("Expected timelines with metrics on")
+	}
+}
@@ -6,6 +6,7 @@ package sim
 
 import (
 	"errors"
+	"fmt"
 	"math"
 	"math/rand"
 	"net/http"
@@ -27,6 +28,7 @@ const (
 	cpu ResourceType = iota
 	memory
 	network
+	disk
 )
 
 // ResourceState tracks current utilization for a single resource.
@@ -42,6 +44,7 @@ type NodeResources struct {
 	cpu     ResourceState
 	memory  ResourceState
 	network ResourceState
+	disk    ResourceState // only with a DiskConf
 
 	// Recovery state
 	isDown      bool
@@ -80,6 +83,26 @@ type ResourceConfig struct {
 	CPUDecayRate     float64 // How fast CPU usage decreases
 	MemoryDecayRate  float64 // How fast memory usage decreases
 	NetworkDecayRate float64 // How fast network usage decreases
+
+	// Cores turns on the processor sharing CPU model: LocalWork is CPU
+	// ms of demand and running tasks share this many cores, so they
+	// stretch under contention.  It replaces CPUPerLocalWork, the CPU
+	// delay and CPURejectLimit (0 = utilization model).
+	Cores float64
+
+	// NICBandwidth in bytes per ms each way (0 = unlimited).  When set,
+	// network utilization is the bytes actually moved instead of the
+	// NetworkPerCall and NetworkPerReply costs.
+	NICBandwidth float64
+
+	// Disk gives the node a disk that stages with DiskReads or
+	// DiskWrites wait on (nil = no disk).
+	Disk *DiskConf
+
+	// Heap turns on the byte based memory model with garbage collection
+	// pauses.  It replaces MemoryPerCall, MemoryPerQueuedCall and the
+	// memory decay (nil = fraction model).
+	Heap *HeapConf
 }
 
 // DefaultResourceConfig returns sensible default resource configuration.
@@ -120,6 +143,12 @@ func (n *node) initResources(config *ResourceConfig) {
 		config:           config,
 		pendingWork:      make([]*Call, 0),
 	}
+
+	n.cores = newPSCPU(config.Cores)
+	n.heap = newHeap(config.Heap)
+	n.disk = newDisk(config.Disk)
+	n.nicIn = newNIC(config.NICBandwidth)
+	n.nicOut = newNIC(config.NICBandwidth)
 }
 
 // consumeResources attempts to consume the specified amount of a resource type.
@@ -149,41 +178,79 @@ func (n *node) consumeResources(resType ResourceType, amount float64) error {
 		n.resources.network.Current = math.Min(1.0, n.resources.network.Current+amount)
 	}
 
-	needsOOMKill := n.resources.memory.Current > n.resources.memory.Limit
+	// A heap is only OOM killed on live bytes, in allocCall
+	needsOOMKill := n.heap == nil && n.resources.memory.Current > n.resources.memory.Limit
 
 	var oomErr error
 
 	if needsOOMKill {
-		n.resources.isDown = true
-		n.resources.downUntil = Milliseconds(n.loop.GetTime()) + n.resources.memoryRecoveryMs
-		// Only clear pendingWork (safe under resources.mu)
-		n.resources.pendingWork = nil
-
-		count.IncrSyncSuffix("node_memory_exhaustion", n.name)
-		ml.La(n.name+": Memory exhausted, restarting in", n.resources.memoryRecoveryMs, "ms")
+		n.markOOMLocked()
 
 		oomErr = errNodeDownMem
 	}
 
 	n.resources.mu.Unlock()
 
+	if needsOOMKill {
+		n.loop.resetCallsTo(n)
+	}
+
 	// Queue clearing happens at recovery time in updateResources().
 	// While the node is down, no new work is processed from queues.
 
 	return oomErr
 }
 
+// markOOMLocked takes the node down for its memory recovery time.
+// Caller must hold resources.mu.
+func (n *node) markOOMLocked() {
+	n.resources.isDown = true
+	n.resources.downUntil = Milliseconds(n.loop.GetTime()) + n.resources.memoryRecoveryMs
+	// Only clear pendingWork (safe under resources.mu)
+	n.resources.pendingWork = nil
+
+	count.IncrSyncSuffix("node_memory_exhaustion", n.name)
+	ml.La(n.name+": Memory exhausted, restarting in", n.resources.memoryRecoveryMs, "ms")
+	n.loop.recordEvent("oom", n.name, fmt.Sprintf("restarting in %.0f ms", float64(n.resources.memoryRecoveryMs)))
+}
+
+// oomKill takes the node down as out of memory.
+func (n *node) oomKill() {
+	n.resources.mu.Lock()
+
+	killed := !n.resources.isDown
+	if killed {
+		n.markOOMLocked()
+	}
+
+	n.resources.mu.Unlock()
+
+	if killed {
+		n.loop.resetCallsTo(n)
+	}
+}
+
 // checkResourceLimits is no longer used; OOM detection is inline in consumeResources.
 
 // updateResources updates resource utilization each millisecond.
 func (n *node) updateResources() {
-	n.resources.mu.Lock()
-
 	currentTime := Milliseconds(n.loop.GetTime())
-	needsRecovery := false
+
+	n.resources.mu.RLock()
+	needsRecovery := n.resources.isDown && currentTime >= n.resources.downUntil
+	n.resources.mu.RUnlock()
+
+	// Perform full OOM cleanup while still down, outside of resources.mu
+	// to avoid deadlock, so no call accepted after the restart is lost
+	// with it. OOM kill = container death, no work survives.
+	if needsRecovery {
+		n.fullOOMCleanup()
+	}
+
+	n.resources.mu.Lock()
 
 	// Check if node should come back online
-	if n.resources.isDown && currentTime >= n.resources.downUntil {
+	if needsRecovery {
 		n.resources.isDown = false
 		n.resources.cpu.Current = 0
 		n.resources.memory.Current = 0
@@ -192,6 +259,7 @@ func (n *node) updateResources() {
 
 		count.IncrSyncSuffix("node_recovery", n.name)
 		ml.La(n.name + ": Node recovered from memory exhaustion")
+		n.loop.recordEvent("recovered", n.name, "back up")
 	}
 
 	if !n.resources.isDown {
@@ -201,18 +269,32 @@ func (n *node) updateResources() {
 		n.resources.network.Current = math.Max(0, n.resources.network.Current-n.resources.config.NetworkDecayRate)
 	}
 
+	// With a heap the memory utilization is the bytes in use
+	if n.heap != nil && !n.resources.isDown {
+		n.resources.memory.Current = math.Min(1.0, n.heapUtilization())
+	}
+
+	// With cores the CPU utilization is the cores actually busy
+	if n.cores != nil {
+		n.resources.cpu.Current = n.cores.utilization()
+	}
+
+	if n.disk != nil {
+		n.resources.disk.Current = n.disk.utilization()
+		n.resources.disk.Historical = append(n.resources.disk.Historical, n.resources.disk.Current)
+	}
+
+	// With a NIC the network utilization is the real bytes moved
+	if n.nicIn != nil {
+		n.resources.network.Current = math.Min(1.0, n.nicUtilization())
+	}
+
 	// Record historical data
 	n.resources.cpu.Historical = append(n.resources.cpu.Historical, n.resources.cpu.Current)
 	n.resources.memory.Historical = append(n.resources.memory.Historical, n.resources.memory.Current)
 	n.resources.network.Historical = append(n.resources.network.Historical, n.resources.network.Current)
 
 	n.resources.mu.Unlock()
-
-	// At recovery time, perform full OOM cleanup outside of resources.mu
-	// to avoid deadlock. OOM kill = container death, no work survives.
-	if needsRecovery {
-		n.fullOOMCleanup()
-	}
 }
 
 // calculateCPUDelay returns delay in milliseconds if CPU is over limit.
@@ -240,6 +322,45 @@ func (n *node) fullOOMCleanup() {
 	n.outboundQueue = nil
 	n.outboundMu.Unlock()
 
+	// Connections die with the container
+	n.resetPools()
+
+	// So do the workers and any calls waiting for one
+	n.resetWorkers()
+	n.inFlight.Store(0)
+	n.resetBulkheads()
+
+	if n.cores != nil {
+		n.cores.clear()
+	}
+
+	if n.disk != nil {
+		n.disk.clear()
+	}
+
+	if n.limiter != nil {
+		n.limiter.clear()
+	}
+
+	if n.adaptive != nil {
+		n.adaptive.clear(Milliseconds(n.loop.GetTime()))
+	}
+
+	// The calls it was waiting on are forgotten with pendingCallMap
+	n.callerLimitsMu.Lock()
+
+	for _, al := range n.callerLimits {
+		al.clear(Milliseconds(n.loop.GetTime()))
+	}
+
+	n.callerLimitsMu.Unlock()
+
+	if n.heap != nil {
+		n.heap.mu.Lock()
+		n.heap.reset()
+		n.heap.mu.Unlock()
+	}
+
 	// Clear pending call map
 	n.pendingCallMapMu.Lock()
 	n.pendingCallMap = make(map[int]*pendingCall)
@@ -265,14 +386,31 @@ func (n *node) fullOOMCleanup() {
 
 // sendErrorReply sends an error response for rejected calls.
 func (n *node) sendErrorReply(c *Call, message string) {
+	n.sendStatusReply(c, http.StatusServiceUnavailable, message)
+}
+
+// sendStatusReply sends an error reply with the given HTTP status.
+func (n *node) sendStatusReply(c *Call, status uint64, message string) {
+	n.sendRetryAfterReply(c, status, 0, message)
+}
+
+// sendRetryAfterReply sends a failure reply hinting when to try again.
+func (n *node) sendRetryAfterReply(c *Call, status uint64, retryAfter Milliseconds, message string) {
+	n.loop.endSpan(c.span, append(statusTags(status), "error.message", message)...)
+
 	r := Reply{
-		reqID:  c.ReqID,
-		status: http.StatusServiceUnavailable,
-		call:   c,
+		reqID:      c.ReqID,
+		status:     status,
+		call:       c,
+		retryAfter: retryAfter,
 	}
 
 	if c.caller != nil {
-		c.caller.replyCh <- &r
+		if c.caller != n {
+			n.sendReply(c, &r)
+		} else {
+			c.caller.deliverReply(&r, 0)
+		}
 		ml.La(n.name+": Sent error reply", message, "for call", c.ReqID)
 	}
 }
@@ -303,6 +441,10 @@ func (n *node) GetResourceHistory() map[string][]float64 {
 
 // IsAvailable checks if node is operational.
 func (n *node) IsAvailable() bool {
+	if n.resources == nil {
+		return !n.isKilled()
+	}
+
 	n.resources.mu.RLock()
 	defer n.resources.mu.RUnlock()
 
@@ -312,7 +454,7 @@ func (n *node) IsAvailable() bool {
 // consumeCPUForLocalWork consumes CPU resources for local work processing.
 func (n *node) consumeCPUForLocalWork() {
 	p := rand.Float64() //nolint:gosec
-	cpuCost := n.resources.config.CPUPerLocalWork(p)
+	cpuCost := n.resources.config.CPUPerLocalWork(p) * n.cpuMultiplier()
 
 	if err := n.consumeResources(cpu, cpuCost); err != nil {
 		ml.La(n.name+": CPU resource error:", err.Error())
@@ -321,6 +463,10 @@ func (n *node) consumeCPUForLocalWork() {
 
 // consumeMemoryForCall consumes memory resources for handling a call.
 func (n *node) consumeMemoryForCall() error {
+	if n.heap != nil {
+		return nil
+	}
+
 	p := rand.Float64() //nolint:gosec
 	memoryCost := n.resources.config.MemoryPerCall(p)
 
@@ -328,15 +474,35 @@ func (n *node) consumeMemoryForCall() error {
 }
 
 // consumeNetworkForCall consumes network resources for incoming calls.
+// With a NIC it only refuses calls while the NIC is over its limit.
 func (n *node) consumeNetworkForCall() error {
+	if n.nicIn != nil {
+		n.resources.mu.RLock()
+		saturated := n.resources.network.Current > n.resources.network.Limit
+		n.resources.mu.RUnlock()
+
+		if saturated {
+			count.IncrSyncSuffix("node_network_saturated", n.name)
+
+			return errNodeDownNetwork
+		}
+
+		return nil
+	}
+
 	p := rand.Float64() //nolint:gosec
 	networkCost := n.resources.config.NetworkPerCall(p)
 
 	return n.consumeResources(network, networkCost)
 }
 
-// consumeMemoryForQueuedCall consumes memory for a call queued due to CPU saturation.
+// consumeMemoryForQueuedCall consumes memory for a call queued due to
+// CPU saturation, if the config gives a cost for it.
 func (n *node) consumeMemoryForQueuedCall() error {
+	if n.heap != nil || n.resources.config.MemoryPerQueuedCall == nil {
+		return nil
+	}
+
 	p := rand.Float64() //nolint:gosec
 	memoryCost := n.resources.config.MemoryPerQueuedCall(p)
 
@@ -344,7 +510,12 @@ func (n *node) consumeMemoryForQueuedCall() error {
 }
 
 // consumeNetworkForReply consumes network resources for outgoing replies.
+// With a NIC the reply's transfer time stands in for the cost.
 func (n *node) consumeNetworkForReply() error {
+	if n.nicOut != nil {
+		return nil
+	}
+
 	p := rand.Float64() //nolint:gosec
 	networkCost := n.resources.config.NetworkPerReply(p)
 
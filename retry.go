@@ -7,6 +7,9 @@ package sim
 import (
 	"math"
 	"math/rand"
+	"sort"
+
+	count "github.com/jayalane/go-counter"
 )
 
 // RetryPolicy configures retry behavior for outbound calls.
@@ -16,6 +19,9 @@ type RetryPolicy struct {
 	BackoffFactor float64
 	MaxDelay      Milliseconds
 	Jitter        float64 // 0.0 to 1.0, fraction of delay to randomize
+
+	RetryOn         []uint64 // reply statuses that send the call again, e.g. 503, or 504 for timeouts
+	HonorRetryAfter bool     // wait at least as long as the reply's retry-after hint
 }
 
 // RetryState tracks retry progress for a single outbound call.
@@ -53,3 +59,314 @@ func (p *RetryPolicy) DelayForAttempt(attempt int) Milliseconds {
 
 	return Milliseconds(delay)
 }
+
+// retryBudgetBucketMs is how finely a retry budget's window is kept.
+const retryBudgetBucketMs = 100
+
+// RetryBudgetConf caps a client's retries at a share of its requests
+// over a sliding window, like Finagle's retry budgets.
+type RetryBudgetConf struct {
+	Ratio     float64      // retries allowed per request, e.g. 0.1 for 10%
+	MinPerSec float64      // retries allowed per second whatever the traffic
+	Window    Milliseconds // how long requests count toward the budget (0 = 10s)
+}
+
+// budgetBucket counts one slice of the budget's window.
+type budgetBucket struct {
+	start    Milliseconds
+	requests int
+	retries  int
+}
+
+// retryBudget is a client instance's budget across its endpoints.
+type retryBudget struct {
+	conf    *RetryBudgetConf
+	buckets []budgetBucket
+}
+
+// retryCounts tracks one caller instance's calls to one endpoint.
+type retryCounts struct {
+	calls     int
+	retries   int
+	denied    int
+	exhausted int
+}
+
+// pendingResend is a send waiting for its time: a retry's backoff or
+// a hedge's delay.
+type pendingResend struct {
+	at   Milliseconds
+	send func()
+}
+
+// RetryStats sums up an app's retries of calls to an endpoint.
+type RetryStats struct {
+	App       string
+	Endpoint  string
+	Calls     int // first attempts
+	Retries   int // further attempts sent
+	Denied    int // retries the budget refused
+	Exhausted int // calls that failed after MaxRetries
+}
+
+// Amplification returns attempts sent per call made.
+func (s RetryStats) Amplification() float64 {
+	if s.Calls == 0 {
+		return 0
+	}
+
+	return float64(s.Calls+s.Retries) / float64(s.Calls)
+}
+
+// newRetryBudget returns a budget for the config, or nil for none.
+func newRetryBudget(conf *RetryBudgetConf) *retryBudget {
+	if conf == nil {
+		return nil
+	}
+
+	return &retryBudget{conf: conf, buckets: make([]budgetBucket, int(conf.window()/retryBudgetBucketMs))}
+}
+
+func (conf *RetryBudgetConf) window() Milliseconds {
+	if conf.Window >= retryBudgetBucketMs {
+		return conf.Window
+	}
+
+	return 10 * msInSec //nolint:mnd
+}
+
+// bucket returns the bucket for now, clearing it if it is stale.
+func (rb *retryBudget) bucket(now Milliseconds) *budgetBucket {
+	slot := int(math.Floor(float64(now / retryBudgetBucketMs)))
+	start := Milliseconds(slot * retryBudgetBucketMs)
+	b := &rb.buckets[slot%len(rb.buckets)]
+
+	if b.start != start {
+		*b = budgetBucket{start: start}
+	}
+
+	return b
+}
+
+// request counts a first attempt.
+func (rb *retryBudget) request(now Milliseconds) {
+	rb.bucket(now).requests++
+}
+
+// allowRetry spends from the budget, returning false if it is empty.
+func (rb *retryBudget) allowRetry(now Milliseconds) bool {
+	window := rb.conf.window()
+	requests, retries := 0, 0
+
+	for _, b := range rb.buckets {
+		if now-b.start < window {
+			requests += b.requests
+			retries += b.retries
+		}
+	}
+
+	allowed := rb.conf.Ratio*float64(requests) + rb.conf.MinPerSec*float64(window)/msInSec
+	if float64(retries+1) > allowed {
+		return false
+	}
+
+	rb.bucket(now).retries++
+
+	return true
+}
+
+// retryable is whether a reply's status is one the policy retries.
+func (p *RetryPolicy) retryable(r *Reply) bool {
+	if r.local {
+		return false
+	}
+
+	for _, s := range p.RetryOn {
+		if r.status == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryCountsFor returns the counts for an endpoint.  Caller holds
+// n.retriesMu.
+func (n *node) retryCountsFor(endpoint string) *retryCounts {
+	if n.retryCounts == nil {
+		n.retryCounts = make(map[string]*retryCounts)
+	}
+
+	rc, ok := n.retryCounts[endpoint]
+	if !ok {
+		rc = &retryCounts{}
+		n.retryCounts[endpoint] = rc
+	}
+
+	return rc
+}
+
+// retryOnReply wraps f to send the call again, after the policy's
+// backoff, when the reply has a status the policy retries and the
+// client's budget allows.  Only the final attempt's reply reaches f.
+func (n *node) retryOnReply(rc *RemoteCall, c *Call, lb *LB, f handleReply, attempt int) handleReply {
+	now := Milliseconds(n.loop.GetTime())
+
+	// a hedge is another try of a call already counted
+	if attempt == 0 && !c.hedged {
+		n.retriesMu.Lock()
+		n.retryCountsFor(rc.Endpoint).calls++
+
+		if n.retryBudget != nil {
+			n.retryBudget.request(now)
+		}
+
+		n.retriesMu.Unlock()
+	}
+
+	return func(n *node, r *Reply) {
+		if !rc.Retry.retryable(r) {
+			f(n, r)
+
+			return
+		}
+
+		now := Milliseconds(n.loop.GetTime())
+
+		n.retriesMu.Lock()
+		counts := n.retryCountsFor(rc.Endpoint)
+
+		if attempt >= rc.Retry.MaxRetries {
+			counts.exhausted++
+			n.retriesMu.Unlock()
+			count.IncrSyncSuffix("retry_exhausted", n.name)
+			f(n, r)
+
+			return
+		}
+
+		if n.retryBudget != nil && !n.retryBudget.allowRetry(now) {
+			counts.denied++
+			n.retriesMu.Unlock()
+			count.IncrSyncSuffix("retry_budget_denied", n.name)
+			f(n, r)
+
+			return
+		}
+
+		counts.retries++
+
+		delay := rc.Retry.DelayForAttempt(attempt)
+		if rc.Retry.HonorRetryAfter && r.retryAfter > delay {
+			delay = r.retryAfter
+		}
+
+		n.resends = append(n.resends, &pendingResend{
+			at: now + delay,
+			send: func() {
+				n.attemptRemoteCall(rc, c.retryCopy(), lb, f, attempt+1)
+			},
+		})
+		n.retriesMu.Unlock()
+
+		count.IncrSyncSuffix("retry_on_status", n.name)
+		ml.La(n.name+": Retrying call", c.ReqID, "after status", r.status, "in", delay)
+	}
+}
+
+// retryCopy returns a fresh attempt of the call, leaving now.
+func (c *Call) retryCopy() *Call {
+	now := Milliseconds(c.caller.loop.GetTime())
+
+	return &Call{
+		Wakeup:       now + c.caller.loop.callDelay(c.fromZone, c.fromZone),
+		StartTime:    now,
+		Endpoint:     c.Endpoint,
+		TimeoutMs:    c.TimeoutMs,
+		replyTimeout: c.replyTimeout,
+		Priority:     c.Priority,
+		length:       c.length,
+		Params:       c.Params,
+		caller:       c.caller,
+		cpuCost:      c.cpuCost,
+		memoryCost:   c.memoryCost,
+		networkCost:  c.networkCost,
+		fromZone:     c.fromZone,
+		origin:       c.origin,
+		cancel:       c.cancel.sibling(),
+		attempt:      c.attempt + 1,
+		trace:        c.traceParent,
+		hedge:        c.hedge,
+		hedged:       c.hedged,
+	}
+}
+
+// sendResends sends the retries whose backoff is over.
+func (n *node) sendResends() {
+	now := Milliseconds(n.loop.GetTime())
+
+	var due []*pendingResend
+
+	n.retriesMu.Lock()
+
+	waiting := n.resends[:0]
+
+	for _, pr := range n.resends {
+		if pr.at <= now {
+			due = append(due, pr)
+
+			continue
+		}
+
+		waiting = append(waiting, pr)
+	}
+
+	n.resends = waiting
+	n.retriesMu.Unlock()
+
+	for _, pr := range due {
+		pr.send()
+	}
+}
+
+// RetryStats returns retries per calling app and endpoint, summed
+// across the app's instances.
+func (l *Loop) RetryStats() []RetryStats {
+	sums := make(map[[2]string]*RetryStats)
+
+	for _, n := range l.nodes {
+		n.retriesMu.Lock()
+
+		for endpoint, counts := range n.retryCounts {
+			key := [2]string{n.App.Name, endpoint}
+
+			s, ok := sums[key]
+			if !ok {
+				s = &RetryStats{App: n.App.Name, Endpoint: endpoint}
+				sums[key] = s
+			}
+
+			s.Calls += counts.calls
+			s.Retries += counts.retries
+			s.Denied += counts.denied
+			s.Exhausted += counts.exhausted
+		}
+
+		n.retriesMu.Unlock()
+	}
+
+	res := make([]RetryStats, 0, len(sums))
+	for _, s := range sums {
+		res = append(res, *s)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].App != res[j].App {
+			return res[i].App < res[j].App
+		}
+
+		return res[i].Endpoint < res[j].Endpoint
+	})
+
+	return res
+}
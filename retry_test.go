@@ -0,0 +1,130 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestRetryBudget checks a budget allows retries up to its share of
+// requests in the window and then refuses.
+func TestRetryBudget(t *testing.T) {
+	rb := newRetryBudget(&RetryBudgetConf{Ratio: 0.1, Window: 1000})
+
+	for i := range 100 {
+		rb.request(Milliseconds(1000 + i))
+	}
+
+	allowed := 0
+
+	for rb.allowRetry(1200) {
+		allowed++
+	}
+
+	if allowed != 10 {
+		t.Errorf("Expected 10 retries for 100 requests, got %d", allowed)
+	}
+
+	// the requests age out of the window
+	if rb.allowRetry(2500) {
+		t.Error("Expected no budget once the requests are out of the window")
+	}
+}
+
+// TestRetryAfter checks a rate limited call is told when a token is due.
+func TestRetryAfter(t *testing.T) {
+	rl := newRateLimiter(&RateLimitConf{Rate: 100, Burst: 1})
+	c := &Call{origin: "a"}
+
+	if !rl.admit(c, 0) || rl.admit(c, 0) {
+		t.Fatal("Expected a burst of 1")
+	}
+
+	if wait := rl.retryAfter(c); wait != 10 {
+		t.Errorf("Expected a 10ms retry-after, got %v", wait)
+	}
+
+	policy := &RetryPolicy{RetryOn: []uint64{http.StatusTooManyRequests}}
+	if !policy.retryable(&Reply{status: http.StatusTooManyRequests}) ||
+		policy.retryable(&Reply{status: http.StatusTooManyRequests, local: true}) {
+		t.Error("Expected only a reply from the server to be retryable")
+	}
+}
+
+// runRetryChain sends a source through a front app that retries its
+// calls to a back app failing half its calls, and returns the front's
+// retry stats.
+func runRetryChain(t *testing.T, suffix string, budget *RetryBudgetConf) RetryStats {
+	t.Helper()
+	initTest()
+
+	loop := NewLoop()
+
+	backConf := AppConf{
+		Name:      "retryBack" + suffix,
+		Size:      2,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 2)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: backConf.Name, App: &backConf}, loop)
+
+	frontConf := AppConf{
+		Name: "retryFront" + suffix,
+		Size: 2,
+		Stages: []*StageConf{{
+			LocalWork: UniformCDF(1, 2),
+			RemoteCalls: []*RemoteCall{{
+				Endpoint: backConf.Name,
+				Retry: &RetryPolicy{
+					MaxRetries:    3,
+					InitialDelay:  2,
+					BackoffFactor: 2,
+					MaxDelay:      20,
+					RetryOn:       []uint64{http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+				},
+			}},
+		}},
+		ReplyLen:    UniformCDF(100, 200),
+		Resources:   lightResourceConfig(),
+		RetryBudget: budget,
+	}
+
+	MakeLB(&LbConf{Name: frontConf.Name, App: &frontConf}, loop)
+
+	sourceConf := makeTestSourceConf("retrySource"+suffix, 0.5, frontConf.Name, 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.AddFault(&Fault{Kind: FaultErrorRate, Target: backConf.Name, Start: 0, ErrorRate: 0.5})
+
+	loop.Run(500)
+
+	for _, s := range loop.RetryStats() {
+		if s.App == frontConf.Name {
+			t.Logf("%s: %+v amplification %.2f", suffix, s, s.Amplification())
+
+			return s
+		}
+	}
+
+	t.Fatalf("No retry stats for %s", frontConf.Name)
+
+	return RetryStats{}
+}
+
+// TestRetryAmplification checks status retries amplify the load on a
+// failing backend and that a budget caps it.
+func TestRetryAmplification(t *testing.T) {
+	open := runRetryChain(t, "Open", nil)
+	capped := runRetryChain(t, "Capped", &RetryBudgetConf{Ratio: 0.1})
+
+	if open.Amplification() < 1.6 || open.Exhausted == 0 {
+		t.Errorf("Expected about 1.9x amplification with no budget: %+v", open)
+	}
+
+	if capped.Amplification() > 1.15 || capped.Denied == 0 {
+		t.Errorf("Expected a 10%% budget to cap amplification: %+v", capped)
+	}
+}
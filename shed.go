@@ -0,0 +1,278 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	count "github.com/jayalane/go-counter"
+)
+
+const (
+	defaultShedStepMs = 10
+	shedHysteresis    = 0.9 // signals must fall this far under a threshold to unshed
+)
+
+// Call priorities, following the usual criticality levels.  Any int
+// works; these are just names for the common ones.
+const (
+	PrioritySheddable     = -2 // batch and prefetch work
+	PrioritySheddablePlus = -1 // retryable user work
+	PriorityCritical      = 0  // the default
+	PriorityCriticalPlus  = 1  // work that must survive overload
+)
+
+// ShedConf configures priority load shedding on an app's instances.
+// While any signal is over its threshold the instance sheds one more
+// of the lowest priority levels it has seen every StepMs, replying
+// 503, and unsheds them one at a time once the signals fall back.
+// The highest priority seen is never shed.
+type ShedConf struct {
+	CPU    float64      // CPU utilization to shed above (0 = ignore)
+	Memory float64      // memory or heap utilization to shed above (0 = ignore)
+	Queue  int          // calls waiting for a worker to shed above (0 = ignore)
+	StepMs Milliseconds // time between shedding another level (0 = 10ms)
+}
+
+// shedCount counts one priority's calls at an instance.
+type shedCount struct {
+	admitted int
+	shed     int
+}
+
+// shedder is an instance's priority load shedder.
+type shedder struct {
+	mu       sync.Mutex
+	conf     *ShedConf
+	levels   []int // priorities seen, lowest first
+	cut      int   // how many of the lowest levels are shed
+	lastStep Milliseconds
+	counts   map[int]*shedCount
+}
+
+// ShedStats sums up an app's shedding of one priority.
+type ShedStats struct {
+	App      string
+	Priority int
+	Admitted int
+	Shed     int
+}
+
+// ShedFraction returns the share of the priority's calls shed.
+func (s ShedStats) ShedFraction() float64 {
+	if s.Admitted+s.Shed == 0 {
+		return 0
+	}
+
+	return float64(s.Shed) / float64(s.Admitted+s.Shed)
+}
+
+// newShedder returns a shedder for the config, or nil for none.
+func newShedder(conf *ShedConf) *shedder {
+	if conf == nil {
+		return nil
+	}
+
+	return &shedder{conf: conf, counts: make(map[int]*shedCount)}
+}
+
+func (s *shedder) stepMs() Milliseconds {
+	if s.conf.StepMs > 0 {
+		return s.conf.StepMs
+	}
+
+	return defaultShedStepMs
+}
+
+// admit records the call's priority and returns false if its level is
+// shed.  Caller holds s.mu.
+func (s *shedder) admit(priority int) bool {
+	i := sort.SearchInts(s.levels, priority)
+	if i == len(s.levels) || s.levels[i] != priority {
+		s.levels = append(s.levels, 0)
+		copy(s.levels[i+1:], s.levels[i:])
+		s.levels[i] = priority
+
+		// a new lowest level goes under the cut with the others
+		if i < s.cut {
+			s.cut++
+		}
+	}
+
+	sc, ok := s.counts[priority]
+	if !ok {
+		sc = &shedCount{}
+		s.counts[priority] = sc
+	}
+
+	if i < s.cut {
+		sc.shed++
+
+		return false
+	}
+
+	sc.admitted++
+
+	return true
+}
+
+// step moves the cut one level toward the load, at most once a step,
+// returning whether it moved.  Caller holds s.mu.
+func (s *shedder) step(now Milliseconds, over, under bool) bool {
+	if now-s.lastStep < s.stepMs() {
+		return false
+	}
+
+	switch {
+	case over && s.cut < len(s.levels)-1:
+		s.cut++
+	case under && s.cut > 0:
+		s.cut--
+	default:
+		return false
+	}
+
+	s.lastStep = now
+
+	return true
+}
+
+// shedSignals returns whether the node is over any shedding threshold,
+// and whether it is comfortably under all of them.
+func (n *node) shedSignals(conf *ShedConf) (bool, bool) {
+	over, under := false, true
+
+	check := func(v, limit float64) {
+		if limit <= 0 {
+			return
+		}
+
+		if v > limit {
+			over = true
+		}
+
+		if v > limit*shedHysteresis {
+			under = false
+		}
+	}
+
+	if n.resources != nil {
+		n.resources.mu.RLock()
+		check(n.resources.cpu.Current, conf.CPU)
+		check(n.resources.memory.Current, conf.Memory)
+		n.resources.mu.RUnlock()
+	}
+
+	if conf.Queue > 0 {
+		n.workers.mu.Lock()
+		queued := n.workers.queue.len()
+		n.workers.mu.Unlock()
+
+		check(float64(queued), float64(conf.Queue))
+	}
+
+	return over, under
+}
+
+// updateShedding moves the shed level with the node's load.
+func (n *node) updateShedding() {
+	if n.shedder == nil {
+		return
+	}
+
+	over, under := n.shedSignals(n.shedder.conf)
+
+	n.shedder.mu.Lock()
+	moved := n.shedder.step(Milliseconds(n.loop.GetTime()), over, under)
+	cut := n.shedder.cut
+	levels := append([]int(nil), n.shedder.levels...)
+	n.shedder.mu.Unlock()
+
+	if !moved {
+		return
+	}
+
+	count.MarkDistributionSuffix("shed_levels", float64(cut), n.name)
+
+	if cut == 0 {
+		n.loop.recordEvent("shed_level", n.name, "shedding nothing")
+
+		return
+	}
+
+	n.loop.recordEvent("shed_level", n.name, fmt.Sprintf("shedding priority <= %d", levels[cut-1]))
+}
+
+// shedAdmit checks the call's priority against the shed level,
+// replying 503 if it is shed.  It returns false if the call was shed.
+func (n *node) shedAdmit(c *Call) bool {
+	if n.shedder == nil {
+		return true
+	}
+
+	n.shedder.mu.Lock()
+	ok := n.shedder.admit(c.Priority)
+	n.shedder.mu.Unlock()
+
+	if ok {
+		return true
+	}
+
+	count.IncrSyncSuffix("node_shed_priority", n.name)
+	n.sendErrorReply(c, "Shed for priority")
+
+	return false
+}
+
+// ShedStats returns calls admitted and shed per app and priority,
+// summed across the app's instances.
+func (l *Loop) ShedStats() []ShedStats {
+	type key struct {
+		app      string
+		priority int
+	}
+
+	sums := make(map[key]*ShedStats)
+
+	for _, n := range l.nodes {
+		if n.shedder == nil {
+			continue
+		}
+
+		n.shedder.mu.Lock()
+
+		for priority, sc := range n.shedder.counts {
+			k := key{n.App.Name, priority}
+
+			s, ok := sums[k]
+			if !ok {
+				s = &ShedStats{App: n.App.Name, Priority: priority}
+				sums[k] = s
+			}
+
+			s.Admitted += sc.admitted
+			s.Shed += sc.shed
+		}
+
+		n.shedder.mu.Unlock()
+	}
+
+	res := make([]ShedStats, 0, len(sums))
+	for _, s := range sums {
+		res = append(res, *s)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].App != res[j].App {
+			return res[i].App < res[j].App
+		}
+
+		return res[i].Priority < res[j].Priority
+	})
+
+	return res
+}
@@ -0,0 +1,86 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+)
+
+// TestShedderLevels checks the cut rises a level a step under load,
+// never sheds the top level and falls back once the load goes.
+func TestShedderLevels(t *testing.T) {
+	s := newShedder(&ShedConf{StepMs: 10})
+
+	for _, p := range []int{PriorityCriticalPlus, PrioritySheddable, PriorityCritical} {
+		s.admit(p)
+	}
+
+	for now := Milliseconds(10); now <= 100; now++ {
+		s.step(now, true, false)
+	}
+
+	if s.cut != 2 || s.admit(PriorityCritical) || !s.admit(PriorityCriticalPlus) {
+		t.Errorf("Expected all but the top level shed, cut %d", s.cut)
+	}
+
+	// a new lowest level is shed along with the rest
+	if s.admit(PrioritySheddablePlus - 5) {
+		t.Error("Expected a new lowest level to be shed")
+	}
+
+	for now := Milliseconds(110); now <= 200; now++ {
+		s.step(now, false, true)
+	}
+
+	if s.cut != 0 || !s.admit(PrioritySheddable) {
+		t.Errorf("Expected nothing shed once the load went, cut %d", s.cut)
+	}
+}
+
+// TestCheckoutSurvives checks an overload of plan traffic is shed
+// while checkout traffic still gets through.
+func TestCheckoutSurvives(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+
+	appConf := AppConf{
+		Name:        "shop",
+		Size:        1,
+		Stages:      []*StageConf{{LocalWork: UniformCDF(4, 6)}},
+		ReplyLen:    UniformCDF(100, 200),
+		Resources:   lightResourceConfig(),
+		Workers:     1,
+		AcceptQueue: 20,
+		Shed:        &ShedConf{Queue: 5},
+	}
+
+	MakeLB(&LbConf{Name: "shop", App: &appConf}, loop)
+
+	checkoutConf := makeTestSourceConf("checkoutSource", 0.1, "shop", 500.0)
+	checkoutConf.Priority = PriorityCriticalPlus
+	MakeSource(&checkoutConf, loop)
+
+	planConf := makeTestSourceConf("planSource", 0.4, "shop", 500.0)
+	planConf.Priority = PrioritySheddable
+	MakeSource(&planConf, loop)
+
+	loop.Run(500)
+
+	byPriority := map[int]ShedStats{}
+
+	for _, s := range loop.ShedStats() {
+		t.Logf("%+v shed %.2f", s, s.ShedFraction())
+		byPriority[s.Priority] = s
+	}
+
+	checkout, plan := byPriority[PriorityCriticalPlus], byPriority[PrioritySheddable]
+
+	if checkout.Shed != 0 || checkout.Admitted < 30 {
+		t.Errorf("Expected checkout never shed: %+v", checkout)
+	}
+
+	if plan.ShedFraction() < 0.3 {
+		t.Errorf("Expected plan traffic shed: %+v", plan)
+	}
+}
@@ -7,6 +7,9 @@ package sim
 import (
 	"fmt"
 	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
 
 	count "github.com/jayalane/go-counter"
 )
@@ -21,9 +24,13 @@ type EventCB func(s *Source) *Call
 
 // SourceConf configures an event source.
 type SourceConf struct {
-	Name     string
-	Lambda   float64
-	MakeCall EventCB
+	Name           string
+	Lambda         float64
+	MakeCall       EventCB
+	Zone           string       // Optional zone the traffic enters from
+	RequestLen     ModelCdf     // Optional request size in bytes
+	Priority       int          // Optional priority of the calls it makes
+	ReplyTimeoutMs Milliseconds // Optional wait for the reply before a local 504 (0 = never)
 }
 
 // Source is a source of events.
@@ -35,6 +42,12 @@ type Source struct {
 	nextEvent  Milliseconds
 	lambda     float64
 	newEventCb EventCB // only for sources
+	requestLen ModelCdf
+	priority   int
+	timeout    Milliseconds
+	latency    latencyStats
+	throttled  atomic.Int64
+	endpoints  sync.Map // endpoints called, for the topology
 }
 
 // GetTime returns the loop time.
@@ -55,6 +68,16 @@ func (s *Source) GenerateEvent() {
 	c := s.newEventCb(s)
 	c.caller = &s.n
 	c.StartTime = Milliseconds(s.n.loop.GetTime())
+	c.fromZone = s.n.zone
+	c.origin = s.n.name
+	c.Priority = s.priority
+	c.replyTimeout = s.timeout
+	c.trace = s.n.loop.startTrace()
+
+	if s.requestLen != nil {
+		c.length = uint64(s.requestLen(rand.Float64())) //nolint:gosec
+	}
+	s.endpoints.Store(c.Endpoint, true)
 	lb := s.n.loop.GetLB(c.Endpoint + "-lb")
 
 	ml.La("Generate EVENT!", s.n.name, s.n.loop.GetTime(), c.ReqID, lb.n.name)
@@ -66,12 +89,37 @@ func (s *Source) GenerateEvent() {
 		) {
 			ml.La("Finished EVENT!", s.n.name, s.n.loop.GetTime(), n.name, r)
 			count.IncrSuffix("source_generated_finished", "source")
+			s.latency.add(s.n.loop.GetTime()-float64(c.StartTime), r.status != 0)
+			s.n.recordReply(c, r)
+			s.promReply(c, r)
+			s.n.loop.recordEdge(s.n.name, c.Endpoint, s.n.loop.GetTime()-float64(c.StartTime), r.status != 0)
+
+			if r.status == http.StatusTooManyRequests {
+				s.throttled.Add(1)
+			}
+
 			count.MarkDistributionSuffix(s.n.name, (s.n.loop.GetTime()-float64(c.StartTime))/msInSec,
 				"source")
 		},
 	)
 }
 
+// Latency returns a summary of end to end latency seen by the source.
+func (s *Source) Latency() LatencySummary {
+	return s.latency.summary()
+}
+
+// ThrottledFraction returns the share of the source's calls that came
+// back 429 from a rate limiter.
+func (s *Source) ThrottledFraction() float64 {
+	finished := s.latency.summary().Count
+	if finished == 0 {
+		return 0
+	}
+
+	return float64(s.throttled.Load()) / float64(finished)
+}
+
 // HandleCall for a source does nothing.
 func (s *Source) HandleCall() {
 	panic("Source got a task?" + s.n.name + fmt.Sprintf("%f", s.n.loop.GetTime()))
@@ -83,6 +131,9 @@ func (s *Source) NextMillisecond() {
 
 	ml.La(s.n.name+": source running next ms", s.n.loop.GetTime())
 
+	s.n.releaseReplies()
+	s.n.expirePendingCalls()
+
 	if s.nextEvent <= 0 {
 		timeToSleep := rand.ExpFloat64()/s.lambda + s.n.loop.GetTime()
 		s.nextEvent += Milliseconds(timeToSleep)
@@ -110,6 +161,10 @@ func (s *Source) NextMillisecond() {
 func MakeSource(sourceConf *SourceConf, l *Loop) *Source {
 	source := Source{}
 	source.n.name = sourceConf.Name
+	source.n.zone = sourceConf.Zone
+	source.requestLen = sourceConf.RequestLen
+	source.priority = sourceConf.Priority
+	source.timeout = sourceConf.ReplyTimeoutMs
 	source.lambda = sourceConf.Lambda
 	source.newEventCb = sourceConf.MakeCall
 	l.AddSource(&source)
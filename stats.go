@@ -0,0 +1,232 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+const (
+	p50 = 0.50
+	p90 = 0.90
+	p99 = 0.99
+)
+
+// LatencySummary is a digest of a set of latency samples.
+type LatencySummary struct {
+	Count  int
+	Errors int
+	Mean   float64
+	P50    float64
+	P90    float64
+	P99    float64
+	Max    float64
+}
+
+// ErrorRate returns the fraction of samples that failed.
+func (s LatencySummary) ErrorRate() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+
+	return float64(s.Errors) / float64(s.Count)
+}
+
+// latencyReservoirSize bounds the samples a latencyStats keeps.
+const latencyReservoirSize = 10000
+
+// latencyStats keeps a uniform reservoir of latency samples for the
+// percentiles, exact while they fit, and exact counts, mean and max.
+type latencyStats struct {
+	mu      sync.Mutex
+	samples []float64
+	count   int
+	sum     float64
+	max     float64
+	errors  int
+}
+
+// add records one sample; failed samples count toward the error rate.
+func (ls *latencyStats) add(ms float64, failed bool) {
+	ls.mu.Lock()
+	ls.count++
+	ls.sum += ms
+	ls.max = math.Max(ls.max, ms)
+
+	if len(ls.samples) < latencyReservoirSize {
+		ls.samples = append(ls.samples, ms)
+	} else if i := rand.Intn(ls.count); i < latencyReservoirSize { //nolint:gosec
+		ls.samples[i] = ms
+	}
+
+	if failed {
+		ls.errors++
+	}
+
+	ls.mu.Unlock()
+}
+
+// merge folds o in, as when summing instances.  Past the reservoir
+// size each side keeps samples in proportion to its count.
+func (ls *latencyStats) merge(o *latencyStats) {
+	o.mu.Lock()
+	samples := append([]float64(nil), o.samples...)
+	count, sum, maxMs, errors := o.count, o.sum, o.max, o.errors
+	o.mu.Unlock()
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if len(ls.samples)+len(samples) > latencyReservoirSize {
+		keep := int(math.Round(latencyReservoirSize * float64(ls.count) / float64(ls.count+count)))
+		keep = max(latencyReservoirSize-len(samples), min(keep, len(ls.samples)))
+		ls.samples = randomSubset(ls.samples, keep)
+		samples = randomSubset(samples, latencyReservoirSize-keep)
+	}
+
+	ls.samples = append(ls.samples, samples...)
+	ls.count += count
+	ls.sum += sum
+	ls.max = math.Max(ls.max, maxMs)
+	ls.errors += errors
+}
+
+// randomSubset returns k of the samples picked at random, reordering
+// them.
+func randomSubset(samples []float64, k int) []float64 {
+	if k >= len(samples) {
+		return samples
+	}
+
+	rand.Shuffle(len(samples), func(i, j int) { samples[i], samples[j] = samples[j], samples[i] })
+
+	return samples[:k]
+}
+
+// sorted returns a sorted copy of the samples.
+func (ls *latencyStats) sorted() []float64 {
+	ls.mu.Lock()
+	s := append([]float64(nil), ls.samples...)
+	ls.mu.Unlock()
+
+	sort.Float64s(s)
+
+	return s
+}
+
+// percentile returns the p (0.0 to 1.0) percentile of the samples.
+func (ls *latencyStats) percentile(p float64) float64 {
+	return percentileOf(ls.sorted(), p)
+}
+
+// summary digests the samples.
+func (ls *latencyStats) summary() LatencySummary {
+	s := ls.sorted()
+
+	ls.mu.Lock()
+	res := LatencySummary{Count: ls.count, Errors: ls.errors, Max: ls.max}
+
+	if ls.count > 0 {
+		res.Mean = ls.sum / float64(ls.count)
+	}
+
+	ls.mu.Unlock()
+
+	res.P50 = percentileOf(s, p50)
+	res.P90 = percentileOf(s, p90)
+	res.P99 = percentileOf(s, p99)
+
+	return res
+}
+
+// percentileOf returns the p percentile of an already sorted slice.
+func percentileOf(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	i = max(0, min(i, len(sorted)-1))
+
+	return sorted[i]
+}
+
+// InstanceStats is what one LB saw from one instance of its pool.
+type InstanceStats struct {
+	Name        string
+	Sent        int
+	Outstanding int64
+	Degraded    bool
+	Latency     LatencySummary
+}
+
+// InstanceStats returns per-instance stats for the LB's pool.
+func (lb *LB) InstanceStats() []InstanceStats {
+	res := make([]InstanceStats, len(lb.appInstances))
+
+	for i, n := range lb.appInstances {
+		n.faultsMu.RLock()
+		degraded := len(n.degradations()) > 0
+		n.faultsMu.RUnlock()
+
+		res[i] = InstanceStats{
+			Name:        n.name,
+			Sent:        int(lb.sent[i].Load()),
+			Outstanding: lb.outstanding[i].Load(),
+			Degraded:    degraded,
+			Latency:     lb.instanceLatency[i].summary(),
+		}
+	}
+
+	return res
+}
+
+// WriteInstanceReport writes per-source and per-instance latency and
+// error rates and each app's retries, to see how LB strategies and
+// retry policies cope with a bad instance.
+func (l *Loop) WriteInstanceReport(w io.Writer) {
+	for _, s := range l.sources {
+		ls := s.latency.summary()
+		fmt.Fprintf(w, "source %s: n=%d err=%.3f mean=%.1fms p50=%.1fms p99=%.1fms max=%.1fms\n",
+			s.n.name, ls.Count, ls.ErrorRate(), ls.Mean, ls.P50, ls.P99, ls.Max)
+	}
+
+	for _, name := range l.lbNames() {
+		lb := l.lbs[name]
+		fmt.Fprintf(w, "lb %s strategy %s\n", name, lb.strategy)
+
+		for _, is := range lb.InstanceStats() {
+			mark := ""
+			if is.Degraded {
+				mark = " DEGRADED"
+			}
+
+			fmt.Fprintf(w, "  %s: sent=%d err=%.3f mean=%.1fms p99=%.1fms%s\n",
+				is.Name, is.Sent, is.Latency.ErrorRate(), is.Latency.Mean, is.Latency.P99, mark)
+		}
+	}
+
+	for _, rs := range l.RetryStats() {
+		fmt.Fprintf(w, "retries %s -> %s: calls=%d retries=%d denied=%d exhausted=%d amp=%.2f\n",
+			rs.App, rs.Endpoint, rs.Calls, rs.Retries, rs.Denied, rs.Exhausted, rs.Amplification())
+	}
+}
+
+// lbNames returns the LB names in a stable order.
+func (l *Loop) lbNames() []string {
+	names := make([]string, 0, len(l.lbs))
+	for name := range l.lbs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,43 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"math"
+	"testing"
+)
+
+// TestLatencyReservoir checks the samples kept stay bounded while the
+// count, mean and max stay exact and the median close.
+func TestLatencyReservoir(t *testing.T) {
+	var a, b latencyStats
+
+	n := 3 * latencyReservoirSize
+
+	for i := 1; i <= n; i++ {
+		a.add(float64(i), i%10 == 0)
+	}
+
+	b.add(float64(2*n), false)
+
+	s := a.summary()
+	t.Logf("summary %+v", s)
+
+	if len(a.samples) != latencyReservoirSize {
+		t.Errorf("Expected %d samples kept, got %d", latencyReservoirSize, len(a.samples))
+	}
+
+	if s.Count != n || s.Errors != n/10 || s.Mean != float64(n+1)/2 || s.Max != float64(n) {
+		t.Errorf("Expected exact count, errors, mean and max, got %+v", s)
+	}
+
+	if math.Abs(s.P50-float64(n)/2) > float64(n)/20 {
+		t.Errorf("Expected a median near %d, got %.0f", n/2, s.P50)
+	}
+
+	b.merge(&a)
+
+	if len(b.samples) != latencyReservoirSize || b.summary().Count != n+1 || b.summary().Max != float64(2*n) {
+		t.Errorf("Expected a bounded merge with exact counts, got %d samples %+v", len(b.samples), b.summary())
+	}
+}
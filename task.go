@@ -8,6 +8,7 @@ package sim
 import (
 	"container/heap"
 	"math/rand"
+	"sync/atomic"
 
 	count "github.com/jayalane/go-counter"
 )
@@ -20,8 +21,12 @@ type Task struct {
 	// startTime Milliseconds
 	reqID    int
 	call     *Call
+	work     float64 // ms of local work (CPU ms with cores)
+	stage    *StageConf
 	later    closure
 	nextTask *Task
+	span     *Span
+	ioDone   bool // its stage's disk I/O was submitted
 }
 
 func (n *node) handleTasks() {
@@ -71,8 +76,30 @@ func (n *node) handleTasks() {
 func (n *node) HandleTask(t *Task) {
 	ml.La(n.name+": Got a task to do", *t, t.call.ReqID, t.call.caller.name)
 
+	if n.dropCancelledTask(t) {
+		n.loop.endSpan(t.span, "cancelled", "true")
+
+		return
+	}
+
+	// Another stage failed and answered the call
+	if atomic.LoadInt32(&t.call.failed) == 1 {
+		count.IncrSyncSuffix("node_task_dropped_failed", n.name)
+		n.loop.endSpan(t.span, "failed", "true")
+
+		return
+	}
+
 	// Check if node is available
-	if n.resources != nil && !n.IsAvailable() {
+	if !n.IsAvailable() {
+		// without resources there is no restart to wait for
+		if n.resources == nil {
+			count.IncrSyncSuffix("node_task_dropped_down", n.name)
+			n.loop.endSpan(t.span, "killed", "true")
+
+			return
+		}
+
 		// Queue task for later processing
 		n.resources.mu.Lock()
 		n.resources.pendingWork = append(n.resources.pendingWork, t.call)
@@ -82,13 +109,20 @@ func (n *node) HandleTask(t *Task) {
 		return
 	}
 
-	// Consume CPU for local work
-	if n.resources != nil {
+	// Disk I/O follows the local work
+	if n.startIO(t) {
+		return
+	}
+
+	// Consume CPU for local work; with cores it was already served
+	if n.resources != nil && n.cores == nil {
 		if n.handleTaskCPU(t) {
 			return
 		}
 	}
 
+	n.loop.endSpan(t.span)
+
 	if t.later != nil {
 		t.later()
 		ml.La(n.name + ": ran closure")
@@ -96,28 +130,83 @@ func (n *node) HandleTask(t *Task) {
 		ml.La(n.name + ": No closure to run")
 	}
 
+	if t.call.awaits {
+		n.awaitDone(t.call)
+
+		return
+	}
+
 	if t.nextTask != nil {
 		ml.La(n.name + ": another task to do")
 	} else {
 		ml.La(n.name+": last task, send result", "reqid", t.call.ReqID, t.call.caller.name)
+		n.completeCall(t.call, t.reqID)
+	}
+}
 
-		// Consume network resources for reply
-		if n.resources != nil {
-			if err := n.consumeNetworkForReply(); err != nil {
-				ml.La(n.name+": Network resource error sending reply:", err.Error())
+// completeCall sends the call's reply and frees what it holds.
+func (n *node) completeCall(c *Call, reqID int) {
+	if !atomic.CompareAndSwapInt32(&c.replied, 0, 1) {
+		return
+	}
 
-				return
-			}
+	// Consume network resources for reply
+	if n.resources != nil {
+		if err := n.consumeNetworkForReply(); err != nil {
+			ml.La(n.name+": Network resource error sending reply:", err.Error())
+			n.sendErrorReply(c, "Network saturated")
+			n.finishCall(c)
+
+			return
 		}
+	}
 
-		r := Reply{}
-		p := rand.Float64() //nolint:gosec
-		r.reqID = t.reqID
-		r.length = uint64(n.App.ReplyLen(p))
-		r.status = 0
-		r.call = t.call
-		t.call.caller.replyCh <- &r
+	r := Reply{}
+	p := rand.Float64() //nolint:gosec
+	r.reqID = reqID
+	r.length = uint64(n.App.ReplyLen(p))
+	r.status = 0
+	r.call = c
+	n.sendReply(c, &r)
+	n.freeCall(c, r.length)
+	n.finishCall(c)
+}
+
+// failCall answers the call with a 503 for a stage that failed and
+// drops its other stages, unless it was already answered.
+func (n *node) failCall(c *Call, message string) {
+	if !atomic.CompareAndSwapInt32(&c.replied, 0, 1) {
+		return
 	}
+
+	atomic.StoreInt32(&c.failed, 1)
+	n.sendErrorReply(c, message)
+	n.finishCall(c)
+}
+
+// awaitDone counts off one of the stages or awaited replies a call
+// with AwaitReplies is waiting for, completing it after the last.  If
+// an awaited call failed the call fails with its status.
+func (n *node) awaitDone(c *Call) {
+	if atomic.AddInt32(&c.outstanding, -1) != 0 {
+		return
+	}
+
+	if n.honorsCancel(c) {
+		n.dropCall(c)
+
+		return
+	}
+
+	if status := atomic.LoadUint64(&c.childStatus); status != 0 {
+		count.IncrSyncSuffix("node_awaited_call_failed", n.name)
+		n.sendStatusReply(c, status, "Awaited call failed")
+		n.finishCall(c)
+
+		return
+	}
+
+	n.completeCall(c, c.ReqID)
 }
 
 // handleTaskCPU consumes CPU and checks reject/delay limits.
@@ -134,7 +223,7 @@ func (n *node) handleTaskCPU(t *Task) bool {
 		if cpuCurrent >= n.resources.config.CPURejectLimit {
 			count.IncrSyncSuffix("node_cpu_reject", n.name)
 			ml.La(n.name+": CPU above reject limit, sending 503", cpuCurrent)
-			n.sendErrorReply(t.call, "CPU reject limit exceeded")
+			n.failCall(t.call, "CPU reject limit exceeded")
 
 			return true
 		}
@@ -0,0 +1,315 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Topology node kinds.
+const (
+	TopologySource = "source"
+	TopologyPool   = "pool"
+)
+
+// TopologyNode is a source or a pool of app instances behind an LB.
+type TopologyNode struct {
+	Name     string
+	Kind     string // TopologySource or TopologyPool
+	Size     int    // instances, for a pool
+	Zones    []string
+	Strategy string // the LB's, for a pool
+}
+
+// TopologyEdge is the calls from a source or pool to a pool, with
+// what they did in the run so far.
+type TopologyEdge struct {
+	From   string
+	To     string
+	Calls  int     // replies, after retries and hedging
+	Errors int     // failed replies
+	MeanMs float64 // mean latency
+}
+
+// ErrorRate is the fraction of the edge's calls that failed.
+func (e TopologyEdge) ErrorRate() float64 {
+	if e.Calls == 0 {
+		return 0
+	}
+
+	return float64(e.Errors) / float64(e.Calls)
+}
+
+// Topology is the service graph the loop built: the pools from the
+// LBs, their calls from StageConf.RemoteCalls and the endpoints the
+// sources have called.
+type Topology struct {
+	Nodes []TopologyNode
+	Edges []TopologyEdge
+	RunMs float64 // sim time run, for the call rates
+}
+
+// CallRate is the edge's calls per second over the run.
+func (t Topology) CallRate(e TopologyEdge) float64 {
+	if t.RunMs <= 0 {
+		return 0
+	}
+
+	return float64(e.Calls) / t.RunMs * msInSec
+}
+
+// edgeKey is a caller and endpoint.
+type edgeKey struct{ from, to string }
+
+// edgeStats counts the replies on one edge.
+type edgeStats struct {
+	calls      int
+	errors     int
+	latencySum float64
+}
+
+// recordEdge notes a reply on the edge from caller to endpoint.
+func (l *Loop) recordEdge(from, to string, ms float64, failed bool) {
+	l.edgesMu.Lock()
+	defer l.edgesMu.Unlock()
+
+	if l.edges == nil {
+		l.edges = map[edgeKey]*edgeStats{}
+	}
+
+	s, ok := l.edges[edgeKey{from, to}]
+	if !ok {
+		s = &edgeStats{}
+		l.edges[edgeKey{from, to}] = s
+	}
+
+	s.calls++
+	s.latencySum += ms
+
+	if failed {
+		s.errors++
+	}
+}
+
+// edgeReply wraps f to note the reply on the edge from the node's pool
+// to the endpoint, for a call first sent at sentAt.
+func (n *node) edgeReply(endpoint string, sentAt Milliseconds, f handleReply) handleReply {
+	return func(rn *node, r *Reply) {
+		n.loop.recordEdge(n.pool, endpoint, n.loop.GetTime()-float64(sentAt), r.status != 0)
+		f(rn, r)
+	}
+}
+
+// Topology returns the service graph, sources first.
+func (l *Loop) Topology() Topology {
+	t := Topology{RunMs: l.GetTime() - loopStartMs}
+
+	l.edgesMu.Lock()
+	defer l.edgesMu.Unlock()
+
+	seen := map[edgeKey]bool{}
+	addEdge := func(e TopologyEdge) {
+		k := edgeKey{e.From, e.To}
+		if seen[k] {
+			return
+		}
+
+		seen[k] = true
+
+		if s, ok := l.edges[k]; ok {
+			e.Calls, e.Errors = s.calls, s.errors
+			e.MeanMs = s.latencySum / float64(s.calls)
+		}
+
+		t.Edges = append(t.Edges, e)
+	}
+
+	for _, s := range l.sources {
+		t.Nodes = append(t.Nodes, TopologyNode{Name: s.n.name, Kind: TopologySource})
+
+		var endpoints []string
+
+		s.endpoints.Range(func(k, _ any) bool {
+			if e, ok := k.(string); ok {
+				endpoints = append(endpoints, e)
+			}
+
+			return true
+		})
+
+		sort.Strings(endpoints)
+
+		for _, e := range endpoints {
+			addEdge(TopologyEdge{From: s.n.name, To: e})
+		}
+	}
+
+	for _, name := range l.lbNames() {
+		lb := l.lbs[name]
+		pool := strings.TrimSuffix(name, lbSuffix)
+
+		t.Nodes = append(t.Nodes, TopologyNode{
+			Name:     pool,
+			Kind:     TopologyPool,
+			Size:     len(lb.appInstances),
+			Zones:    lb.n.App.Zones,
+			Strategy: lb.strategy.String(),
+		})
+
+		for _, h := range lb.n.App.Stages {
+			for _, rc := range h.RemoteCalls {
+				addEdge(TopologyEdge{From: pool, To: rc.Endpoint})
+			}
+		}
+	}
+
+	return t
+}
+
+// depths places each node a step right of everything calling it,
+// sources at 0, for laying the graph out left to right.
+func (t Topology) depths() map[string]int {
+	d := make(map[string]int, len(t.Nodes))
+	for _, n := range t.Nodes {
+		d[n.Name] = 0
+	}
+
+	// longest path, bounded so call cycles can't loop forever
+	for range t.Nodes {
+		changed := false
+
+		for _, e := range t.Edges {
+			if d[e.To] < d[e.From]+1 && d[e.From]+1 < len(t.Nodes) {
+				d[e.To] = d[e.From] + 1
+				changed = true
+			}
+		}
+
+		if !changed {
+			break
+		}
+	}
+
+	return d
+}
+
+// edgeLabel sums up the edge's traffic.
+func (t Topology) edgeLabel(e TopologyEdge) string {
+	return fmt.Sprintf("%.1f/s err %.1f%% %.1fms", t.CallRate(e), e.ErrorRate()*reportPercent, e.MeanMs)
+}
+
+// nodeLabel is a source's name, or a pool's name and size.
+func (n TopologyNode) nodeLabel() string {
+	if n.Kind == TopologySource {
+		return n.Name
+	}
+
+	return fmt.Sprintf("%s x%d", n.Name, n.Size)
+}
+
+// WriteTopologyDOT writes the service graph in Graphviz DOT: sources,
+// an LB in front of each pool and the calls between them annotated
+// with rate, error rate and mean latency.
+func (l *Loop) WriteTopologyDOT(w io.Writer) error {
+	t := l.Topology()
+
+	var b strings.Builder
+
+	b.WriteString("digraph sim {\n  rankdir=LR;\n  node [fontname=\"Helvetica\"];\n")
+
+	for _, n := range t.Nodes {
+		if n.Kind == TopologySource {
+			fmt.Fprintf(&b, "  %q [shape=ellipse, label=%q];\n", n.Name, n.nodeLabel())
+
+			continue
+		}
+
+		lb := n.Name + lbSuffix
+		fmt.Fprintf(&b, "  %q [shape=diamond, label=%q];\n", lb, lb+"\n"+n.Strategy)
+		fmt.Fprintf(&b, "  %q [shape=box3d, label=%q];\n", n.Name, n.nodeLabel())
+		fmt.Fprintf(&b, "  %q -> %q [style=dashed];\n", lb, n.Name)
+	}
+
+	for _, e := range t.Edges {
+		fmt.Fprintf(&b, "  %q -> %q [label=%q];\n", e.From, e.To+lbSuffix, t.edgeLabel(e))
+	}
+
+	b.WriteString("}\n")
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("writing topology dot: %w", err)
+	}
+
+	return nil
+}
+
+// mermaidIDs gives each name a Mermaid node id, numbering the ones
+// that would clash once made safe, as a-b and a_b do.
+type mermaidIDs struct {
+	ids  map[string]string
+	used map[string]bool
+}
+
+// id returns the name's node id, made up the first time.
+func (m *mermaidIDs) id(name string) string {
+	if id, ok := m.ids[name]; ok {
+		return id
+	}
+
+	base := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+
+		return '_'
+	}, name)
+
+	id := base
+	for i := 2; m.used[id]; i++ {
+		id = fmt.Sprintf("%s_%d", base, i)
+	}
+
+	m.ids[name] = id
+	m.used[id] = true
+
+	return id
+}
+
+// WriteTopologyMermaid writes the same graph as WriteTopologyDOT as a
+// Mermaid flowchart, for markdown design docs.
+func (l *Loop) WriteTopologyMermaid(w io.Writer) error {
+	t := l.Topology()
+	ids := &mermaidIDs{ids: map[string]string{}, used: map[string]bool{}}
+
+	var b strings.Builder
+
+	b.WriteString("flowchart LR\n")
+
+	for _, n := range t.Nodes {
+		if n.Kind == TopologySource {
+			fmt.Fprintf(&b, "  %s([%q])\n", ids.id(n.Name), n.nodeLabel())
+
+			continue
+		}
+
+		lb := n.Name + lbSuffix
+		fmt.Fprintf(&b, "  %s{%q}\n", ids.id(lb), lb+" "+n.Strategy)
+		fmt.Fprintf(&b, "  %s[%q]\n", ids.id(n.Name), n.nodeLabel())
+		fmt.Fprintf(&b, "  %s -.-> %s\n", ids.id(lb), ids.id(n.Name))
+	}
+
+	for _, e := range t.Edges {
+		fmt.Fprintf(&b, "  %s -->|%q| %s\n", ids.id(e.From), t.edgeLabel(e), ids.id(e.To+lbSuffix))
+	}
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("writing topology mermaid: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestTopologyExport runs a front calling a back and checks the
+// edges carry the calls made and both formats draw them.
+func TestTopologyExport(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+
+	backConf := AppConf{
+		Name:      "topoBack",
+		Size:      3,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 3)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "topo-back", App: &backConf, Strategy: LbLeastOutstanding}, loop)
+
+	frontConf := AppConf{
+		Name: "topoFront",
+		Size: 2,
+		Stages: []*StageConf{{
+			LocalWork:    UniformCDF(1, 2),
+			RemoteCalls:  []*RemoteCall{{Endpoint: "topo-back"}},
+			AwaitReplies: true,
+		}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "topoFront", App: &frontConf}, loop)
+
+	sourceConf := makeTestSourceConf("topoSource", 0.1, "topoFront", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.Run(300)
+
+	topo := loop.Topology()
+
+	var back TopologyEdge
+
+	for _, e := range topo.Edges {
+		if e.From == "topoFront" && e.To == "topo-back" {
+			back = e
+		}
+	}
+
+	if back.Calls < 10 || back.MeanMs <= 0 || back.ErrorRate() != 0 {
+		t.Errorf("Expected healthy calls from the front to the back, got %+v", back)
+	}
+
+	if rate := topo.CallRate(back); rate < 50 || rate > 200 {
+		t.Errorf("Expected about 100 calls/s to the back, got %.1f", rate)
+	}
+
+	var dot bytes.Buffer
+	if err := loop.WriteTopologyDOT(&dot); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`"topo-back-lb" -> "topo-back" [style=dashed];`,
+		`"topo-back" [shape=box3d, label="topo-back x3"];`,
+		`"topoFront" -> "topo-back-lb" [label="`,
+		`least_outstanding`,
+	} {
+		if !strings.Contains(dot.String(), want) {
+			t.Errorf("Expected %s in the DOT:\n%s", want, dot.String())
+		}
+	}
+
+	var mmd bytes.Buffer
+	if err := loop.WriteTopologyMermaid(&mmd); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"flowchart LR",
+		`topoSource(["topoSource"])`,
+		`topo_back_lb -.-> topo_back`,
+		`topoFront -->|"`,
+	} {
+		if !strings.Contains(mmd.String(), want) {
+			t.Errorf("Expected %s in the Mermaid:\n%s", want, mmd.String())
+		}
+	}
+}
+
+// TestMermaidIDs numbers names that would share a Mermaid id.
+func TestMermaidIDs(t *testing.T) {
+	ids := &mermaidIDs{ids: map[string]string{}, used: map[string]bool{}}
+
+	got := []string{ids.id("a-b"), ids.id("a_b"), ids.id("a_b_2"), ids.id("a.b"), ids.id("a-b")}
+	want := []string{"a_b", "a_b_2", "a_b_2_2", "a_b_3", "a_b"}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected ids %v, got %v", want, got)
+
+			break
+		}
+	}
+}
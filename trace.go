@@ -0,0 +1,373 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const usInMs = 1000
+
+// TraceConf turns on tracing for a sampled share of source requests.
+type TraceConf struct {
+	SampleRate float64   // share of source requests traced, 0.0 to 1.0
+	Epoch      time.Time // wall time of sim time 0 in exported spans (zero = the Unix epoch)
+}
+
+// Span is one timed piece of a traced request: a call made, a call
+// handled, a wait in a queue or a stage of local work.
+type Span struct {
+	TraceID   uint64
+	SpanID    uint64
+	ParentID  uint64 // 0 for the root
+	Operation string
+	Service   string // app, LB or source name
+	Start     Milliseconds
+	End       Milliseconds
+	Tags      map[string]string
+	ended     bool
+}
+
+// spanContext is what a call carries for its callee to parent under.
+type spanContext struct {
+	traceID uint64
+	spanID  uint64
+}
+
+// tracer collects the spans of sampled requests.
+type tracer struct {
+	mu     sync.Mutex
+	conf   *TraceConf
+	lastID uint64
+	spans  []*Span
+}
+
+// SetTracing turns on tracing for the run.
+func (l *Loop) SetTracing(conf *TraceConf) {
+	l.tracer = &tracer{conf: conf}
+}
+
+// startTrace returns a new trace for a source request, or nil if the
+// request is not sampled.
+func (l *Loop) startTrace() *spanContext {
+	if l.tracer == nil || rand.Float64() >= l.tracer.conf.SampleRate { //nolint:gosec
+		return nil
+	}
+
+	l.tracer.mu.Lock()
+	defer l.tracer.mu.Unlock()
+
+	l.tracer.lastID++
+
+	return &spanContext{traceID: l.tracer.lastID}
+}
+
+// startSpan opens a span under parent, or returns nil if the request
+// isn't traced.  Tags are key, value pairs.
+func (l *Loop) startSpan(parent *spanContext, op string, service string, tags ...string) *Span {
+	return l.addSpan(parent, op, service, Milliseconds(l.GetTime()), tags...)
+}
+
+// addSpan opens a span that started at start.
+func (l *Loop) addSpan(parent *spanContext, op string, service string, start Milliseconds, tags ...string) *Span {
+	if parent == nil || l.tracer == nil {
+		return nil
+	}
+
+	s := &Span{
+		TraceID:   parent.traceID,
+		ParentID:  parent.spanID,
+		Operation: op,
+		Service:   service,
+		Start:     start,
+		Tags:      make(map[string]string),
+	}
+
+	for i := 0; i+1 < len(tags); i += 2 {
+		s.Tags[tags[i]] = tags[i+1]
+	}
+
+	l.tracer.mu.Lock()
+	l.tracer.lastID++
+	s.SpanID = l.tracer.lastID
+	l.tracer.spans = append(l.tracer.spans, s)
+	l.tracer.mu.Unlock()
+
+	return s
+}
+
+// endSpan closes the span now, adding the tags, the first time only.
+func (l *Loop) endSpan(s *Span, tags ...string) {
+	if s == nil {
+		return
+	}
+
+	l.tracer.mu.Lock()
+	defer l.tracer.mu.Unlock()
+
+	if s.ended {
+		return
+	}
+
+	s.ended = true
+	s.End = Milliseconds(l.GetTime())
+
+	for i := 0; i+1 < len(tags); i += 2 {
+		s.Tags[tags[i]] = tags[i+1]
+	}
+}
+
+// context returns the span's context for its children.
+func (s *Span) context() *spanContext {
+	if s == nil {
+		return nil
+	}
+
+	return &spanContext{traceID: s.TraceID, spanID: s.SpanID}
+}
+
+// statusTags returns the tags for a reply status.
+func statusTags(status uint64) []string {
+	if status == 0 {
+		return []string{"http.status_code", strconv.Itoa(http.StatusOK)}
+	}
+
+	return []string{"http.status_code", strconv.FormatUint(status, 10), "error", "true"}
+}
+
+// serviceName is the service the node's spans are reported under.
+func (n *node) serviceName() string {
+	if n.callCB == nil && n.App != nil {
+		return n.App.Name
+	}
+
+	return n.name
+}
+
+// traceClient opens the client span for sending the call, if it is
+// traced, and returns f wrapped to close it on the reply.
+func (c *Call) traceClient(f handleReply) handleReply {
+	if c.trace == nil {
+		return f
+	}
+
+	n := c.caller
+	tags := []string{"span.kind", "client", "peer.service", c.Endpoint, "instance", n.name}
+
+	if c.attempt > 0 {
+		tags = append(tags, "retry", strconv.Itoa(c.attempt))
+	}
+
+	if c.hedged {
+		tags = append(tags, "hedge", "true")
+	}
+
+	span := n.loop.startSpan(c.trace, "call "+c.Endpoint, n.serviceName(), tags...)
+	c.traceParent = c.trace
+	c.trace = span.context()
+
+	return func(n *node, r *Reply) {
+		n.loop.endSpan(span, statusTags(r.status)...)
+		f(n, r)
+	}
+}
+
+// traceServer opens the span for an app instance handling the call.
+func (n *node) traceServer(c *Call) {
+	c.span = n.loop.startSpan(c.trace, "handle "+n.App.Name, n.serviceName(),
+		"span.kind", "server", "instance", n.name, "priority", strconv.Itoa(c.Priority))
+}
+
+// traceStart records the call's wait for a worker and opens a span
+// per stage of local work.
+func (n *node) traceStart(c *Call, tasks []Task) {
+	if c.span == nil {
+		return
+	}
+
+	if c.startedAt > c.queuedAt {
+		n.loop.endSpanAt(n.loop.addSpan(c.span.context(), "queue", n.serviceName(), c.queuedAt), c.startedAt)
+	}
+
+	for i := range tasks {
+		tasks[i].span = n.loop.startSpan(c.span.context(), fmt.Sprintf("stage %d", i), n.serviceName(),
+			"work_ms", strconv.FormatFloat(tasks[i].work, 'f', 2, 64))
+	}
+}
+
+// endSpanAt closes the span at a time already past.
+func (l *Loop) endSpanAt(s *Span, end Milliseconds) {
+	if s == nil {
+		return
+	}
+
+	l.tracer.mu.Lock()
+	s.ended = true
+	s.End = end
+	l.tracer.mu.Unlock()
+}
+
+// Spans returns the spans recorded so far.
+func (l *Loop) Spans() []Span {
+	if l.tracer == nil {
+		return nil
+	}
+
+	l.tracer.mu.Lock()
+	defer l.tracer.mu.Unlock()
+
+	res := make([]Span, 0, len(l.tracer.spans))
+
+	for _, s := range l.tracer.spans {
+		cp := *s
+		cp.Tags = make(map[string]string, len(s.Tags))
+
+		for k, v := range s.Tags {
+			cp.Tags[k] = v
+		}
+
+		res = append(res, cp)
+	}
+
+	return res
+}
+
+// jaegerTag is a tag in Jaeger's JSON.
+type jaegerTag struct {
+	Key   string `json:"key"`
+	Type  string `json:"type"`
+	Value any    `json:"value"`
+}
+
+type jaegerRef struct {
+	RefType string `json:"refType"`
+	TraceID string `json:"traceID"`
+	SpanID  string `json:"spanID"`
+}
+
+type jaegerSpan struct {
+	TraceID       string      `json:"traceID"`
+	SpanID        string      `json:"spanID"`
+	OperationName string      `json:"operationName"`
+	References    []jaegerRef `json:"references"`
+	StartTime     int64       `json:"startTime"`
+	Duration      int64       `json:"duration"`
+	Tags          []jaegerTag `json:"tags"`
+	Logs          []any       `json:"logs"`
+	ProcessID     string      `json:"processID"`
+}
+
+type jaegerProcess struct {
+	ServiceName string      `json:"serviceName"`
+	Tags        []jaegerTag `json:"tags"`
+}
+
+type jaegerTrace struct {
+	TraceID   string                   `json:"traceID"`
+	Spans     []jaegerSpan             `json:"spans"`
+	Processes map[string]jaegerProcess `json:"processes"`
+}
+
+func traceHex(id uint64) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+// WriteJaegerJSON writes the finished spans as Jaeger JSON, the format
+// the Jaeger UI loads from a file.
+func (l *Loop) WriteJaegerJSON(w io.Writer) error {
+	var epochUs int64
+
+	if l.tracer != nil && !l.tracer.conf.Epoch.IsZero() {
+		epochUs = l.tracer.conf.Epoch.UnixMicro()
+	}
+
+	byTrace := map[uint64]*jaegerTrace{}
+	processIDs := map[uint64]map[string]string{}
+
+	for _, s := range l.Spans() {
+		if !s.ended {
+			continue // still open
+		}
+
+		t, ok := byTrace[s.TraceID]
+		if !ok {
+			t = &jaegerTrace{TraceID: traceHex(s.TraceID), Processes: map[string]jaegerProcess{}}
+			byTrace[s.TraceID] = t
+			processIDs[s.TraceID] = map[string]string{}
+		}
+
+		pid, ok := processIDs[s.TraceID][s.Service]
+		if !ok {
+			pid = fmt.Sprintf("p%d", len(processIDs[s.TraceID])+1)
+			processIDs[s.TraceID][s.Service] = pid
+			t.Processes[pid] = jaegerProcess{ServiceName: s.Service, Tags: []jaegerTag{}}
+		}
+
+		js := jaegerSpan{
+			TraceID:       t.TraceID,
+			SpanID:        traceHex(s.SpanID),
+			OperationName: s.Operation,
+			References:    []jaegerRef{},
+			StartTime:     epochUs + int64(s.Start*usInMs),
+			Duration:      int64((s.End - s.Start) * usInMs),
+			Tags:          []jaegerTag{},
+			Logs:          []any{},
+			ProcessID:     pid,
+		}
+
+		if s.ParentID != 0 {
+			js.References = append(js.References,
+				jaegerRef{RefType: "CHILD_OF", TraceID: t.TraceID, SpanID: traceHex(s.ParentID)})
+		}
+
+		keys := make([]string, 0, len(s.Tags))
+		for k := range s.Tags {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if k == "error" {
+				js.Tags = append(js.Tags, jaegerTag{Key: k, Type: "bool", Value: s.Tags[k] == "true"})
+
+				continue
+			}
+
+			js.Tags = append(js.Tags, jaegerTag{Key: k, Type: "string", Value: s.Tags[k]})
+		}
+
+		t.Spans = append(t.Spans, js)
+	}
+
+	ids := make([]uint64, 0, len(byTrace))
+	for id := range byTrace {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	data := make([]*jaegerTrace, 0, len(ids))
+	for _, id := range ids {
+		data = append(data, byTrace[id])
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(map[string]any{"data": data}); err != nil {
+		return fmt.Errorf("writing jaeger json: %w", err)
+	}
+
+	return nil
+}
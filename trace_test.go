@@ -0,0 +1,158 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTracePropagation traces every request through a source, two
+// LBs and two apps and checks each trace hangs together from the
+// source's root span down to the back's local work.
+func TestTracePropagation(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+	loop.SetTracing(&TraceConf{SampleRate: 1, Epoch: time.Unix(1_700_000_000, 0)})
+
+	backConf := AppConf{
+		Name:      "traceBack",
+		Size:      2,
+		Stages:    []*StageConf{{LocalWork: UniformCDF(1, 2)}},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "traceBack", App: &backConf}, loop)
+
+	frontConf := AppConf{
+		Name: "traceFront",
+		Size: 2,
+		Stages: []*StageConf{
+			{LocalWork: UniformCDF(1, 2), RemoteCalls: []*RemoteCall{{Endpoint: "traceBack"}}},
+			{LocalWork: UniformCDF(1, 2)},
+		},
+		ReplyLen:  UniformCDF(100, 200),
+		Resources: lightResourceConfig(),
+	}
+
+	MakeLB(&LbConf{Name: "traceFront", App: &frontConf}, loop)
+
+	sourceConf := makeTestSourceConf("traceSource", 0.05, "traceFront", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.Run(200)
+
+	byID := map[uint64]Span{}
+	roots := map[uint64]Span{}
+
+	for _, s := range loop.Spans() {
+		byID[s.SpanID] = s
+
+		if s.ParentID == 0 {
+			roots[s.TraceID] = s
+		}
+	}
+
+	if len(roots) < 3 {
+		t.Fatalf("Expected a few traces, got %d", len(roots))
+	}
+
+	backStages := 0
+
+	for _, s := range byID {
+		if _, ok := roots[s.TraceID]; !ok {
+			t.Errorf("Span %+v has no root", s)
+		}
+
+		if s.ParentID != 0 {
+			parent, ok := byID[s.ParentID]
+			if !ok || parent.TraceID != s.TraceID {
+				t.Errorf("Span %+v has a bad parent", s)
+			}
+		}
+
+		if s.Service != "traceBack" || s.Operation != "stage 0" {
+			continue
+		}
+
+		backStages++
+
+		// source call, front LB, front handle, front call, back LB, back handle
+		depth := 0
+		for p := s; p.ParentID != 0; p = byID[p.ParentID] {
+			depth++
+		}
+
+		if depth != 6 {
+			t.Errorf("Expected the back's stage 6 spans under the root, got %d", depth)
+		}
+	}
+
+	if backStages == 0 {
+		t.Error("Expected traces to reach the back")
+	}
+
+	var buf bytes.Buffer
+	if err := loop.WriteJaegerJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var out struct {
+		Data []struct {
+			TraceID   string
+			Spans     []map[string]any
+			Processes map[string]map[string]any
+		}
+	}
+
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out.Data) == 0 || len(out.Data[0].Spans) == 0 || len(out.Data[0].Processes) < 3 {
+		t.Errorf("Unexpected Jaeger JSON %s", buf.String()[:min(buf.Len(), 500)])
+	}
+}
+
+// TestTraceSampling checks only the sampled share of requests is traced.
+func TestTraceSampling(t *testing.T) {
+	loop := NewLoop()
+	loop.SetTracing(&TraceConf{SampleRate: 0.25})
+
+	traced := 0
+
+	for range 4000 {
+		if loop.startTrace() != nil {
+			traced++
+		}
+	}
+
+	if traced < 800 || traced > 1200 {
+		t.Errorf("Expected about 1000 of 4000 traced, got %d", traced)
+	}
+}
+
+// TestJaegerOpenSpans checks spans still open are left out of the
+// export whatever their times, and ended ones of no length kept.
+func TestJaegerOpenSpans(t *testing.T) {
+	loop := NewLoop()
+	loop.SetTracing(&TraceConf{SampleRate: 1})
+
+	root := loop.startTrace()
+	loop.startSpan(root, "open", "openService")
+	loop.endSpan(loop.startSpan(root, "ended", "endedService"))
+
+	var buf bytes.Buffer
+	if err := loop.WriteJaegerJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "endedService") || strings.Contains(buf.String(), "openService") {
+		t.Errorf("Expected only the ended span, got %s", buf.String())
+	}
+}
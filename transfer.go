@@ -0,0 +1,196 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"math"
+	"sync"
+
+	count "github.com/jayalane/go-counter"
+)
+
+// bwLink is a piece of network with a fixed bandwidth shared equally
+// by the transfers crossing it.
+type bwLink struct {
+	bandwidth float64 // bytes per ms
+	active    int     // transfers crossing it this ms
+	moved     float64 // bytes moved in the last ms
+	tracked   bool    // in transferSet.links
+}
+
+// transfer is a request or reply body moving across one or more links.
+type transfer struct {
+	remaining float64 // bytes
+	links     []*bwLink
+	start     Milliseconds
+	done      func(elapsed Milliseconds)
+}
+
+// transferSet is every transfer in flight in the loop.
+type transferSet struct {
+	mu        sync.Mutex
+	active    []*transfer
+	links     []*bwLink // every link a transfer has used
+	zoneLinks map[ZonePair]*bwLink
+}
+
+// newNIC returns a node's network interface link, or nil if the node
+// has no bandwidth limit.
+func newNIC(bandwidth float64) *bwLink {
+	if bandwidth <= 0 {
+		return nil
+	}
+
+	return &bwLink{bandwidth: bandwidth}
+}
+
+// startTransfer moves size bytes from one node to another, sharing
+// bandwidth with everything else on the way.  If landing is true the
+// hop lands on an app instance and also crosses the zone link.  done
+// runs once the last byte is across.  Returns false, without calling
+// done, if nothing on the path has a bandwidth limit.
+func (l *Loop) startTransfer(from *node, to *node, fromZone string, toZone string,
+	landing bool, size uint64, done func(elapsed Milliseconds),
+) bool {
+	if size == 0 {
+		return false
+	}
+
+	var links []*bwLink
+
+	if from.nicOut != nil {
+		links = append(links, from.nicOut)
+	}
+
+	if to.nicIn != nil {
+		links = append(links, to.nicIn)
+	}
+
+	l.transfers.mu.Lock()
+	defer l.transfers.mu.Unlock()
+
+	if landing {
+		if zl := l.zoneLink(fromZone, toZone); zl != nil {
+			links = append(links, zl)
+		}
+	}
+
+	if len(links) == 0 {
+		return false
+	}
+
+	for _, lk := range links {
+		if !lk.tracked {
+			lk.tracked = true
+			l.transfers.links = append(l.transfers.links, lk)
+		}
+	}
+
+	l.transfers.active = append(l.transfers.active, &transfer{
+		remaining: float64(size),
+		links:     links,
+		start:     Milliseconds(l.GetTime()),
+		done:      done,
+	})
+
+	return true
+}
+
+// zoneLink returns the shared link between two zones if it has a
+// bandwidth limit.  Caller must hold transfers.mu.
+func (l *Loop) zoneLink(from string, to string) *bwLink {
+	if l.network == nil {
+		return nil
+	}
+
+	lc := l.network.link(from, to)
+	if lc == nil || lc.Bandwidth <= 0 {
+		return nil
+	}
+
+	if from > to {
+		from, to = to, from
+	}
+
+	key := ZonePair{From: from, To: to}
+
+	if l.transfers.zoneLinks == nil {
+		l.transfers.zoneLinks = make(map[ZonePair]*bwLink)
+	}
+
+	zl, ok := l.transfers.zoneLinks[key]
+	if !ok {
+		zl = &bwLink{bandwidth: lc.Bandwidth}
+		l.transfers.zoneLinks[key] = zl
+	}
+
+	return zl
+}
+
+// advanceTransfers moves every transfer forward one ms, each getting
+// its fair share of its most contended link, and finishes the ones
+// that are done.  Called once per ms before any node runs.
+func (l *Loop) advanceTransfers() {
+	l.transfers.mu.Lock()
+
+	for _, lk := range l.transfers.links {
+		lk.active, lk.moved = 0, 0
+	}
+
+	for _, t := range l.transfers.active {
+		for _, lk := range t.links {
+			lk.active++
+		}
+	}
+
+	var finished []*transfer
+
+	remaining := l.transfers.active[:0]
+
+	for _, t := range l.transfers.active {
+		rate := math.Inf(1)
+		for _, lk := range t.links {
+			rate = math.Min(rate, lk.bandwidth/float64(lk.active))
+		}
+
+		moved := math.Min(rate, t.remaining)
+		t.remaining -= moved
+
+		for _, lk := range t.links {
+			lk.moved += moved
+		}
+
+		if t.remaining <= 0 {
+			finished = append(finished, t)
+
+			continue
+		}
+
+		remaining = append(remaining, t)
+	}
+
+	for i := len(remaining); i < len(l.transfers.active); i++ {
+		l.transfers.active[i] = nil
+	}
+
+	l.transfers.active = remaining
+	l.transfers.mu.Unlock()
+
+	now := Milliseconds(l.GetTime())
+
+	for _, t := range finished {
+		count.IncrSyncSuffix("network_transfer_done", "network")
+		t.done(now - t.start)
+	}
+}
+
+// nicUtilization returns the busier direction of the node's NIC over
+// the last ms as a fraction of its bandwidth.
+func (n *node) nicUtilization() float64 {
+	n.loop.transfers.mu.Lock()
+	defer n.loop.transfers.mu.Unlock()
+
+	return math.Max(n.nicIn.moved, n.nicOut.moved) / n.nicIn.bandwidth
+}
@@ -0,0 +1,84 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"testing"
+)
+
+// TestTransferSharing checks transfers on the same NIC share its
+// bandwidth while a transfer on an idle NIC gets all of it.
+func TestTransferSharing(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+	busy := &node{nicOut: newNIC(100)}
+	idle := &node{nicOut: newNIC(100)}
+	dest := &node{}
+
+	elapsed := map[string]Milliseconds{}
+
+	for _, name := range []string{"a", "b"} {
+		if !loop.startTransfer(busy, dest, "", "", false, 100, func(e Milliseconds) { elapsed[name] = e }) {
+			t.Fatal("Expected a transfer over a NIC to start")
+		}
+	}
+
+	loop.startTransfer(idle, dest, "", "", false, 100, func(e Milliseconds) { elapsed["c"] = e })
+
+	if loop.startTransfer(dest, dest, "", "", false, 100, func(_ Milliseconds) {}) {
+		t.Error("Expected no transfer without a bandwidth limit")
+	}
+
+	for range 3 {
+		loop.IncrementTime()
+		loop.advanceTransfers()
+	}
+
+	if elapsed["a"] != 2 || elapsed["b"] != 2 || elapsed["c"] != 1 {
+		t.Errorf("Unexpected transfer times %v", elapsed)
+	}
+
+	if busy.nicOut.moved != 0 {
+		t.Errorf("Expected idle NIC to show no bytes moved, got %f", busy.nicOut.moved)
+	}
+}
+
+// TestReplySizeLatency checks big replies take longer than small ones
+// over a slow NIC.
+func TestReplySizeLatency(t *testing.T) {
+	means := map[float64]float64{}
+
+	for _, size := range []float64{200, 5000} {
+		initTest()
+
+		loop := NewLoop()
+
+		rc := lightResourceConfig()
+		rc.NICBandwidth = 200
+
+		appConf := AppConf{
+			Name:      "bwServer",
+			Size:      2,
+			Stages:    []*StageConf{{LocalWork: UniformCDF(1, 2)}},
+			ReplyLen:  UniformCDF(size, size),
+			Resources: rc,
+		}
+
+		lbConf := LbConf{Name: "bwServer", App: &appConf}
+		MakeLB(&lbConf, loop)
+
+		sourceConf := makeTestSourceConf("bwSource", 0.2, "bwServer", 500.0)
+		source := MakeSource(&sourceConf, loop)
+
+		loop.Run(200)
+
+		means[size] = source.Latency().Mean
+	}
+
+	t.Logf("mean latency by reply size %v", means)
+
+	if means[5000] <= means[200]+10 {
+		t.Errorf("Expected 5000 byte replies to be much slower than 200 byte ones %v", means)
+	}
+}
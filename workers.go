@@ -0,0 +1,239 @@
+// -*- tab-width:2 -*-
+
+// Package sim provides a library to specify a distributed system
+// discrete event simulation and then run it to generate statistics
+package sim
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	count "github.com/jayalane/go-counter"
+)
+
+// workerPool bounds how many calls a node works on at once, like a
+// Tomcat thread pool or a goroutine semaphore.  Calls beyond the pool
+// wait in the accept queue; when that is full they are rejected.
+type workerPool struct {
+	mu    sync.Mutex
+	busy  int
+	queue admissionQueue
+
+	ticks     int // ms sampled, for the Little's Law averages
+	busySum   int
+	queueSum  int
+	completed int
+	rejected  int
+	shed      int
+	queueWait latencyStats
+	service   latencyStats
+}
+
+// WorkerStats sums up the worker pools of one app across instances.
+// MeanBusy + MeanQueued is L in Little's Law, Throughput is lambda
+// and QueueWait.Mean + Service.Mean is W.
+type WorkerStats struct {
+	App        string
+	Workers    int // per instance
+	Completed  int
+	Rejected   int     // calls refused with the accept queue full
+	Shed       int     // calls dropped from the queue by its discipline
+	MeanBusy   float64 // mean busy workers summed over instances
+	MeanQueued float64 // mean calls waiting summed over instances
+	Throughput float64 // completed calls per ms
+	QueueWait  LatencySummary
+	Service    LatencySummary
+}
+
+// admitCall starts the call if a worker is free, queues it if the
+// accept queue has room and rejects it otherwise.
+func (n *node) admitCall(c *Call) {
+	now := Milliseconds(n.loop.GetTime())
+	w := &n.workers
+
+	w.mu.Lock()
+
+	if w.busy < n.App.Workers {
+		w.busy++
+		c.queuedAt = now
+		c.startedAt = now
+		w.mu.Unlock()
+
+		w.queueWait.add(0, false)
+		n.startCall(c)
+
+		return
+	}
+
+	if w.queue.len() < n.App.AcceptQueue {
+		c.queuedAt = now
+		w.queue.conf = n.App.Queue
+		w.queue.push(c, now)
+		w.mu.Unlock()
+
+		count.IncrSyncSuffix("node_call_queued", n.name)
+
+		return
+	}
+
+	w.rejected++
+	w.mu.Unlock()
+
+	count.IncrSyncSuffix("node_accept_queue_full", n.name)
+	n.sendErrorReply(c, "Accept queue full")
+	n.releaseLimit(c)
+	n.adaptiveDrop(c)
+}
+
+// finishCall frees the call's heap, rate and concurrency limit slots
+// and worker and hands the worker to the next queued call the
+// discipline picks.  It is safe to call more than once per
+// call.
+func (n *node) finishCall(c *Call) {
+	if atomic.CompareAndSwapInt32(&c.running, 1, 0) {
+		n.inFlight.Add(-1)
+	}
+
+	n.freeCall(c, 0)
+	n.releaseLimit(c)
+	n.adaptiveRelease(c)
+	n.loop.endSpan(c.span)
+
+	if n.App == nil || n.App.Workers <= 0 {
+		return
+	}
+
+	now := Milliseconds(n.loop.GetTime())
+	w := &n.workers
+
+	w.mu.Lock()
+
+	if c.finished || c.startedAt == 0 {
+		w.mu.Unlock()
+
+		return
+	}
+
+	c.finished = true
+	w.completed++
+	w.busy = max(w.busy-1, 0)
+
+	var (
+		next *Call
+		shed []*Call
+	)
+
+	if w.busy < n.App.Workers {
+		next, shed = w.queue.pop(now)
+	}
+
+	if next != nil {
+		w.busy++
+		next.startedAt = now
+	}
+
+	w.shed += len(shed)
+	w.mu.Unlock()
+
+	w.service.add(float64(now-c.startedAt), false)
+	count.MarkDistributionSuffix("node_service_ms", float64(now-c.startedAt), n.name)
+
+	for _, s := range shed {
+		w.queueWait.add(float64(now-s.queuedAt), true)
+		count.IncrSyncSuffix("node_queue_shed", n.name)
+		n.sendErrorReply(s, "Shed from accept queue")
+		n.releaseLimit(s)
+		n.adaptiveDrop(s)
+	}
+
+	if next == nil {
+		return
+	}
+
+	w.queueWait.add(float64(now-next.queuedAt), false)
+	count.MarkDistributionSuffix("node_queue_wait_ms", float64(now-next.queuedAt), n.name)
+	n.startCall(next)
+}
+
+// sampleWorkers adds this ms to the busy and queue length averages.
+func (n *node) sampleWorkers() {
+	if n.App == nil || n.App.Workers <= 0 {
+		return
+	}
+
+	w := &n.workers
+
+	w.mu.Lock()
+	w.ticks++
+	w.busySum += w.busy
+	w.queueSum += w.queue.len()
+	busy, queued := w.busy, w.queue.len()
+	w.mu.Unlock()
+
+	count.MarkDistributionSuffix("node_workers_busy", float64(busy), n.name)
+	count.MarkDistributionSuffix("node_accept_queue_len", float64(queued), n.name)
+}
+
+// resetWorkers drops queued calls and frees all workers, as when the
+// container restarts.
+func (n *node) resetWorkers() {
+	n.workers.mu.Lock()
+	n.workers.busy = 0
+	n.workers.queue.clear()
+	n.workers.mu.Unlock()
+}
+
+// WorkerStats returns worker pool stats for each app with a pool.
+func (l *Loop) WorkerStats() []WorkerStats {
+	byApp := map[string]*WorkerStats{}
+	waits := map[string]*latencyStats{}
+	services := map[string]*latencyStats{}
+	ticks := map[string]int{}
+
+	for _, n := range l.nodes {
+		if n.App == nil || n.App.Workers <= 0 {
+			continue
+		}
+
+		s, ok := byApp[n.App.Name]
+		if !ok {
+			s = &WorkerStats{App: n.App.Name, Workers: n.App.Workers}
+			byApp[n.App.Name] = s
+			waits[n.App.Name] = &latencyStats{}
+			services[n.App.Name] = &latencyStats{}
+		}
+
+		w := &n.workers
+
+		w.mu.Lock()
+		s.Completed += w.completed
+		s.Rejected += w.rejected
+		s.Shed += w.shed
+		s.MeanBusy += float64(w.busySum)
+		s.MeanQueued += float64(w.queueSum)
+		ticks[n.App.Name] = max(ticks[n.App.Name], w.ticks)
+		w.mu.Unlock()
+
+		waits[n.App.Name].merge(&w.queueWait)
+		services[n.App.Name].merge(&w.service)
+	}
+
+	res := make([]WorkerStats, 0, len(byApp))
+
+	for name, s := range byApp {
+		if t := ticks[name]; t > 0 {
+			s.MeanBusy /= float64(t)
+			s.MeanQueued /= float64(t)
+			s.Throughput = float64(s.Completed) / float64(t)
+		}
+
+		s.QueueWait = waits[name].summary()
+		s.Service = services[name].summary()
+		res = append(res, *s)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].App < res[j].App })
+
+	return res
+}
@@ -0,0 +1,58 @@
+// -*- tab-width:2 -*-
+
+package sim
+
+import (
+	"math"
+	"testing"
+)
+
+// TestWorkerPool checks a small pool queues and rejects calls, and
+// that the queue and busy averages follow Little's Law.
+func TestWorkerPool(t *testing.T) {
+	initTest()
+
+	loop := NewLoop()
+
+	appConf := AppConf{
+		Name:        "workerServer",
+		Size:        1,
+		Stages:      []*StageConf{{LocalWork: UniformCDF(8, 12)}},
+		ReplyLen:    UniformCDF(100, 200),
+		Resources:   lightResourceConfig(),
+		Workers:     2,
+		AcceptQueue: 3,
+	}
+
+	MakeLB(&LbConf{Name: "workerServer", App: &appConf}, loop)
+
+	sourceConf := makeTestSourceConf("workerSource", 0.5, "workerServer", 500.0)
+	MakeSource(&sourceConf, loop)
+
+	loop.Run(400)
+
+	stats := loop.WorkerStats()
+	if len(stats) != 1 {
+		t.Fatalf("Expected one worker pool, got %v", stats)
+	}
+
+	s := stats[0]
+	t.Logf("%+v", s)
+
+	if s.Completed == 0 || s.Rejected == 0 {
+		t.Errorf("Expected completions and rejections, got %d/%d", s.Completed, s.Rejected)
+	}
+
+	if s.MeanBusy > float64(appConf.Workers) {
+		t.Errorf("Expected at most %d busy workers, got %f", appConf.Workers, s.MeanBusy)
+	}
+
+	if s.QueueWait.Max <= 0 || s.Service.P50 < 8 {
+		t.Errorf("Expected queue waits and service near 10ms, got %+v %+v", s.QueueWait, s.Service)
+	}
+
+	// L = lambda * W for the busy workers
+	if little := s.Throughput * s.Service.Mean; math.Abs(little-s.MeanBusy) > 0.2*s.MeanBusy {
+		t.Errorf("Expected Little's Law to hold: %f busy vs %f", s.MeanBusy, little)
+	}
+}